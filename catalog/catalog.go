@@ -0,0 +1,222 @@
+// Package catalog maintains an index of the archives a cluster uploaded.  mysqlbackup appends every upload to it and
+// mysqlrestore lists snapshots from it with a single request instead of listing every key of the cluster.
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Filename is the name of the catalog object, stored next to the year prefixes of the cluster's snapshots.
+	Filename = "catalog.json"
+	// Version is the format written, catalogs of newer versions are not read.
+	Version = 1
+
+	// maxAttempts is how often Update reads the catalog again when another writer replaced it in between.
+	maxAttempts = 5
+
+	// MaxEntries caps the catalog.  The oldest entries beyond it are dropped and Since moves past them, listings find
+	// their archives in the bucket instead, so catalog.json stops growing with every upload.
+	MaxEntries = 5000
+
+	// Error codes S3 returns when a conditional write lost against another writer.
+	errCodePreconditionFailed  = "PreconditionFailed"
+	errCodeConditionalConflict = "ConditionalRequestConflict"
+)
+
+// ErrNotFound is returned when the cluster has no catalog yet.
+var ErrNotFound = errors.New("catalog not found")
+
+// Entry is an uploaded archive.
+type Entry struct {
+	Key          string    `json:"key"`
+	Snapshot     string    `json:"snapshot"`
+	Type         string    `json:"type"`
+	Size         int64     `json:"size"`
+	Uploaded     time.Time `json:"uploaded"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	FromLSN      uint64    `json:"from_lsn,omitempty"`
+	ToLSN        uint64    `json:"to_lsn,omitempty"`
+}
+
+// Catalog holds the entries of a cluster, oldest upload first.
+// Since is when mysqlbackup created the catalog, or the upload of the newest entry dropped to keep it at MaxEntries,
+// archives uploaded before it are only found by listing the bucket.  It is zero when the catalog holds every archive.
+type Catalog struct {
+	Version int       `json:"version"`
+	Updated time.Time `json:"updated"`
+	Since   time.Time `json:"since,omitempty"`
+	Entries []Entry   `json:"entries"`
+}
+
+// ClusterPrefix is the key prefix holding every snapshot of a cluster: <env>/mysql/cluster_<cluster>.
+func ClusterPrefix(env, cluster string) string {
+	return path.Join(env, "mysql", "cluster_"+cluster)
+}
+
+// ArchiveKey is the key of an archive of a snapshot started on date:
+// <env>/mysql/cluster_<cluster>/<year>/<month>/<snapshot>/<archive>, the layout mysqlrestore lists and downloads.
+func ArchiveKey(env, cluster string, date time.Time, snapshot, archive string) string {
+	return path.Join(ClusterPrefix(env, cluster), strconv.Itoa(date.Year()), strconv.Itoa(int(date.Month())), snapshot, archive)
+}
+
+// Key is the key of the catalog of a cluster.
+func Key(env, cluster string) string {
+	return path.Join(ClusterPrefix(env, cluster), Filename)
+}
+
+// Add adds the entries, replacing the ones with the same key so an archive uploaded again is listed once.
+func (c *Catalog) Add(entries ...Entry) {
+	index := map[string]int{}
+	for i, entry := range c.Entries {
+		index[entry.Key] = i
+	}
+	for _, entry := range entries {
+		if i, ok := index[entry.Key]; ok {
+			c.Entries[i] = entry
+			continue
+		}
+		index[entry.Key] = len(c.Entries)
+		c.Entries = append(c.Entries, entry)
+	}
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Uploaded.Before(c.Entries[j].Uploaded)
+	})
+	c.compact(MaxEntries)
+}
+
+// Remove drops the entries of the keys, e.g. of archives a lifecycle rule expired.
+func (c *Catalog) Remove(keys ...string) {
+	removed := map[string]bool{}
+	for _, key := range keys {
+		removed[key] = true
+	}
+	entries := c.Entries[:0]
+	for _, entry := range c.Entries {
+		if !removed[entry.Key] {
+			entries = append(entries, entry)
+		}
+	}
+	c.Entries = entries
+}
+
+// compact drops the oldest entries beyond max and moves Since past them.
+func (c *Catalog) compact(max int) {
+	if len(c.Entries) <= max {
+		return
+	}
+	dropped := c.Entries[:len(c.Entries)-max]
+	if last := dropped[len(dropped)-1].Uploaded; last.After(c.Since) {
+		c.Since = last
+	}
+	c.Entries = append([]Entry(nil), c.Entries[len(dropped):]...)
+}
+
+// Read returns the catalog stored at key along with its ETag, which Append uses to detect concurrent writers.
+func Read(ctx context.Context, s3Client *s3.S3, bucket, key string) (*Catalog, string, error) {
+	out, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", errors.Wrapf(ErrNotFound, "no catalog at %s in bucket %s", key, bucket)
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read catalog %s from bucket %s", key, bucket)
+	}
+	defer out.Body.Close()
+
+	catalog := &Catalog{}
+	if err := json.NewDecoder(out.Body).Decode(catalog); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid catalog %s in bucket %s", key, bucket)
+	}
+	if catalog.Version > Version {
+		return nil, "", errors.Errorf("catalog %s has version %d, this version only reads up to %d", key, catalog.Version, Version)
+	}
+	return catalog, aws.StringValue(out.ETag), nil
+}
+
+// Write replaces the catalog stored at key.
+func Write(ctx context.Context, s3Client *s3.S3, bucket, key string, catalog *Catalog) error {
+	return write(ctx, s3Client, bucket, key, catalog, nil)
+}
+
+// Append adds the entries to the catalog at key, creating it when the cluster has none.
+func Append(ctx context.Context, s3Client *s3.S3, bucket, key string, entries ...Entry) error {
+	return Update(ctx, s3Client, bucket, key, func(catalog *Catalog, exists bool) error {
+		if !exists {
+			catalog.Since = time.Now().UTC()
+		}
+		catalog.Add(entries...)
+		return nil
+	})
+}
+
+// Update reads the catalog at key, has update change it and writes it back.  exists is false when the cluster has no
+// catalog yet, update then starts from an empty one.  Every write is conditional on the catalog not having changed
+// since it was read, when it did update runs again on the new catalog, so concurrent writers never lose each other's
+// entries.
+func Update(ctx context.Context, s3Client *s3.S3, bucket, key string, update func(catalog *Catalog, exists bool) error) error {
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		catalog, etag, err := Read(ctx, s3Client, bucket, key)
+		// The SDK has no fields for the conditions of a PutObject, they are sent as headers.
+		var condition map[string]string
+		exists := true
+		switch {
+		case errors.Cause(err) == ErrNotFound:
+			catalog, exists = &Catalog{}, false
+			condition = map[string]string{"If-None-Match": "*"}
+		case err != nil:
+			return err
+		default:
+			condition = map[string]string{"If-Match": etag}
+		}
+
+		if err := update(catalog, exists); err != nil {
+			return err
+		}
+		err = write(ctx, s3Client, bucket, key, catalog, condition)
+		if !conflict(err) {
+			return err
+		}
+		log.Debugf("catalog %s changed while it was updated, attempt %d of %d", key, attempt, maxAttempts)
+	}
+	return errors.Errorf("failed to update catalog %s, it kept changing during %d attempts", key, maxAttempts)
+}
+
+func write(ctx context.Context, s3Client *s3.S3, bucket, key string, catalog *Catalog, condition map[string]string) error {
+	catalog.Version = Version
+	catalog.Updated = time.Now().UTC()
+	content, err := json.Marshal(catalog)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(content),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	}, request.WithSetRequestHeaders(condition))
+	if conflict(err) {
+		return err
+	}
+	return errors.Wrapf(err, "failed to write catalog %s to bucket %s", key, bucket)
+}
+
+// conflict reports whether a conditional write failed because the catalog was changed by another writer.
+func conflict(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == errCodePreconditionFailed || aerr.Code() == errCodeConditionalConflict)
+}
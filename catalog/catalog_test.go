@@ -0,0 +1,78 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/fakes3"
+)
+
+func TestAdd(t *testing.T) {
+	assert := require.New(t)
+	day := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	catalog := &Catalog{Entries: []Entry{
+		{Key: "full.tar", Type: "full", Size: 100, Uploaded: day},
+		{Key: "incremental_1.tar", Type: "incremental", Size: 10, Uploaded: day.Add(time.Hour)},
+	}}
+
+	catalog.Add(
+		Entry{Key: "incremental_2.tar", Type: "incremental", Size: 5, Uploaded: day.Add(2 * time.Hour)},
+		Entry{Key: "incremental_1.tar", Type: "incremental", Size: 12, Uploaded: day.Add(3 * time.Hour)},
+	)
+
+	assert.Len(catalog.Entries, 3)
+	assert.Equal("full.tar", catalog.Entries[0].Key)
+	assert.Equal("incremental_2.tar", catalog.Entries[1].Key)
+	assert.Equal(int64(12), catalog.Entries[2].Size, "an archive uploaded again replaces its entry")
+	assert.Equal("qa/mysql/cluster_one/catalog.json", Key("qa", "one"))
+	assert.Equal("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full_2019_05_01_00_00_00Z.tgz",
+		ArchiveKey("qa", "one", day, "snapshot_2019_05_01", "full_2019_05_01_00_00_00Z.tgz"))
+}
+
+func TestCompact(t *testing.T) {
+	assert := require.New(t)
+	day := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	catalog := &Catalog{}
+	for i := 0; i < 5; i++ {
+		catalog.Add(Entry{Key: fmt.Sprintf("incremental_%d.tar", i), Uploaded: day.Add(time.Duration(i) * time.Hour)})
+	}
+
+	catalog.compact(3)
+	assert.Len(catalog.Entries, 3)
+	assert.Equal("incremental_2.tar", catalog.Entries[0].Key)
+	assert.Equal(day.Add(time.Hour), catalog.Since, "the dropped entries are found by listing the bucket")
+
+	catalog.Remove("incremental_3.tar", "missing.tar")
+	assert.Equal([]string{"incremental_2.tar", "incremental_4.tar"}, []string{catalog.Entries[0].Key, catalog.Entries[1].Key})
+}
+
+func TestUpdateRetriesAfterConcurrentAppend(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	server := fakes3.New()
+	defer server.Close()
+	server.CreateBucket("backups")
+	key := Key("qa", "one")
+
+	attempts := 0
+	err := Update(ctx, server.Client(), "backups", key, func(catalog *Catalog, exists bool) error {
+		attempts++
+		if attempts == 1 {
+			assert.False(exists)
+			// mysqlbackup uploads a backup while the catalog is rebuilt.
+			assert.NoError(Append(ctx, server.Client(), "backups", key, Entry{Key: "incremental.tar"}))
+		}
+		catalog.Add(Entry{Key: "full.tar"})
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(2, attempts)
+
+	catalog, _, err := Read(ctx, server.Client(), "backups", key)
+	assert.NoError(err)
+	assert.Len(catalog.Entries, 2, "the concurrent append is not lost")
+}
@@ -0,0 +1,65 @@
+// Package checkpoints reads the xtrabackup_checkpoints file innobackupex writes into every backup, mysqlbackup uses
+// it to build incremental chains and mysqlrestore to validate them.
+package checkpoints
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Filename is the name of the file in the backup directory.
+const Filename = "xtrabackup_checkpoints"
+
+// Backup types innobackupex records.
+const (
+	TypeFull        = "full-backuped"
+	TypePrepared    = "log-applied"
+	TypeIncremental = "incremental"
+)
+
+// Checkpoints holds the fields of xtrabackup_checkpoints needed to validate a backup chain.
+type Checkpoints struct {
+	BackupType string
+	FromLSN    uint64
+	ToLSN      uint64
+}
+
+// Full reports whether the backup is a full backup, prepared or not.
+func (c Checkpoints) Full() bool {
+	return c.BackupType == TypeFull || c.BackupType == TypePrepared
+}
+
+// Read parses xtrabackup_checkpoints in backupDir.
+func Read(backupDir string) (Checkpoints, error) {
+	cp := Checkpoints{}
+	content, err := ioutil.ReadFile(filepath.Join(backupDir, Filename))
+	if err != nil {
+		return cp, errors.Wrapf(err, "failed to read %s in %s", Filename, backupDir)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "backup_type":
+			cp.BackupType = value
+		case "from_lsn", "to_lsn":
+			lsn, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return cp, errors.Wrapf(err, "invalid %s %s in %s", key, value, backupDir)
+			}
+			if key == "from_lsn" {
+				cp.FromLSN = lsn
+			} else {
+				cp.ToLSN = lsn
+			}
+		}
+	}
+	return cp, nil
+}
@@ -0,0 +1,152 @@
+// Package encryption holds the xtrabackup native encryption options shared by mysqlbackup, which encrypts backups, and
+// mysqlrestore, which decrypts them before they are decompressed.
+package encryption
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+const (
+	// Algorithm is the --encrypt algorithm, its keys are KeySize bytes long.
+	Algorithm = "AES256"
+	KeySize   = 32
+
+	// Suffix is the extension xtrabackup gives encrypted files.
+	Suffix = ".xbcrypt"
+)
+
+// ErrKeyRequired is returned when a snapshot is encrypted but no key was configured.
+var ErrKeyRequired = errors.New("snapshot is encrypted, set -encrypt_key_file or -encrypt_key_command")
+
+// Options configure the key.  The key is never logged, the path of its file is masked in logged command lines.
+type Options struct {
+	// KeyFile holds exactly the key, without a trailing newline.
+	KeyFile string
+	// KeyCommand prints the key, e.g. a KMS or vault client, it is used when KeyFile is empty.
+	KeyCommand string
+	// Threads is --encrypt-threads, only used by backups.
+	Threads int
+}
+
+// Enabled reports whether a key is configured.
+func (o Options) Enabled() bool {
+	return o.KeyFile != "" || o.KeyCommand != ""
+}
+
+// Args returns the innobackupex options that encrypt a backup, or decrypt one when decrypt is set.
+// cleanup removes the temporary file holding the key KeyCommand printed, the key is fetched again for every call so a
+// rotated key is picked up without a restart.
+func (o Options) Args(decrypt bool) (args []string, cleanup func(), err error) {
+	keyFile, cleanup, err := o.keyFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if decrypt {
+		return []string{"--decrypt=" + Algorithm, "--encrypt-key-file=" + keyFile}, cleanup, nil
+	}
+	return []string{"--encrypt=" + Algorithm, "--encrypt-key-file=" + keyFile, fmt.Sprintf("--encrypt-threads=%d", o.Threads)}, cleanup, nil
+}
+
+func (o Options) keyFile() (string, func(), error) {
+	if o.KeyFile != "" {
+		key, err := ioutil.ReadFile(o.KeyFile)
+		if err != nil {
+			// os.PathError names the path, only the reason is kept so the path never reaches a log.
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			return "", nil, errors.Wrap(err, "failed to read the encryption key file")
+		}
+		return o.KeyFile, func() {}, validKey(key)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", o.KeyCommand)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", nil, errors.Wrapf(err, "encryption key command failed, stderr: %s", strings.TrimSpace(stderr.String()))
+	}
+	key := bytes.TrimRight(stdout.Bytes(), "\r\n")
+	if err := validKey(key); err != nil {
+		return "", nil, err
+	}
+	redact.AddSecret(string(key))
+
+	// ioutil.TempDir creates the directory with 0700 permissions.
+	dir, err := ioutil.TempDir("", "xtrabackup-key")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create encryption key directory")
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "failed to write encryption key file")
+	}
+	return keyFile, cleanup, nil
+}
+
+func validKey(key []byte) error {
+	if len(key) != KeySize {
+		return errors.Errorf("invalid encryption key of %d bytes, %s needs exactly %d bytes without a trailing newline, e.g. from openssl rand -base64 24",
+			len(key), Algorithm, KeySize)
+	}
+	return nil
+}
+
+// Encrypted reports whether any file below dir was encrypted by xtrabackup.
+func Encrypted(dir string) (bool, error) {
+	errFound := errors.New("found")
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, Suffix) {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, errors.Wrapf(err, "failed to look for encrypted files in %s", dir)
+}
+
+// Flags are the command line flags that configure Options.
+type Flags struct {
+	keyFile, keyCommand *string
+	threads             *int
+}
+
+// RegisterFlags adds the encryption flags to fs, call it before fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		keyFile:    fs.String("encrypt_key_file", "", "file holding the "+Algorithm+" key of xtrabackup's --encrypt, exactly 32 bytes without a trailing newline"),
+		keyCommand: fs.String("encrypt_key_command", "", "shell command printing the encryption key, e.g. a KMS or vault client, instead of -encrypt_key_file"),
+		threads:    fs.Int("encrypt_threads", 4, "innobackupex --encrypt-threads of backups"),
+	}
+}
+
+// Options returns the configured options.
+func (f *Flags) Options() (Options, error) {
+	o := Options{KeyFile: *f.keyFile, KeyCommand: *f.keyCommand, Threads: *f.threads}
+	switch {
+	case o.KeyFile != "" && o.KeyCommand != "":
+		return Options{}, errors.New("set either encrypt_key_file or encrypt_key_command, not both")
+	case o.Threads < 1:
+		return Options{}, errors.Errorf("invalid encrypt_threads %d, it must be at least 1", o.Threads)
+	}
+	return o, nil
+}
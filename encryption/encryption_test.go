@@ -0,0 +1,72 @@
+package encryption
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+func TestArgs(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "encryption")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	key := strings.Repeat("k", KeySize)
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(ioutil.WriteFile(keyFile, []byte(key), 0600))
+
+	args, cleanup, err := Options{KeyFile: keyFile, Threads: 2}.Args(false)
+	assert.NoError(err)
+	cleanup()
+	assert.Equal([]string{"--encrypt=AES256", "--encrypt-key-file=" + keyFile, "--encrypt-threads=2"}, args)
+
+	args, cleanup, err = Options{KeyCommand: "echo " + key}.Args(true)
+	assert.NoError(err)
+	commandKey := strings.TrimPrefix(args[1], "--encrypt-key-file=")
+	content, err := ioutil.ReadFile(commandKey)
+	assert.NoError(err)
+	assert.Equal(key, string(content), "the trailing newline of the command is dropped")
+	cleanup()
+	assert.NoFileExists(commandKey)
+
+	_, _, err = Options{KeyFile: filepath.Join(dir, "missing")}.Args(false)
+	assert.Error(err)
+	assert.NotContains(err.Error(), dir, "the key file path is never part of an error")
+	assert.Contains(err.Error(), "no such file or directory")
+
+	_, _, err = Options{KeyCommand: "echo short"}.Args(false)
+	assert.Error(err)
+	assert.NotContains(err.Error(), "short", "the key is never part of an error")
+
+	encrypted, err := Encrypted(dir)
+	assert.NoError(err)
+	assert.False(encrypted)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "ibdata1.qp"+Suffix), nil, 0600))
+	encrypted, err = Encrypted(dir)
+	assert.NoError(err)
+	assert.True(encrypted)
+}
+
+func TestFlagsOptions(t *testing.T) {
+	assert := require.New(t)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	assert.NoError(fs.Parse([]string{"-encrypt_key_file", "/etc/key", "-encrypt_key_command", "vault read"}))
+	_, err := flags.Options()
+	assert.Error(err)
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags = RegisterFlags(fs)
+	assert.NoError(fs.Parse([]string{"-encrypt_key_file", "/etc"}))
+	o, err := flags.Options()
+	assert.NoError(err)
+	assert.Equal("restoring /etc/my.cnf", redact.String("restoring /etc/my.cnf"), "the key file path is not a global secret")
+	assert.Equal("innobackupex --encrypt-key-file=********", redact.Command([]string{"innobackupex", "--encrypt-key-file=" + o.KeyFile}))
+}
@@ -0,0 +1,570 @@
+// Package fakes3 is an in-memory S3 compatible HTTP server for tests.  It speaks the parts of the REST API mysqlbackup
+// and mysqlrestore use through aws-sdk-go: object PUT, ranged GET, HEAD, DELETE and tagging, ListObjectsV2, multipart
+// uploads, conditional writes and restores of archived storage classes.  Requests are not authenticated.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultMaxKeys = 1000
+	xmlns          = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// Object is a stored object.
+type Object struct {
+	Key          string
+	Body         []byte
+	ETag         string
+	LastModified time.Time
+	StorageClass string
+	Metadata     map[string]string
+	Tags         map[string]string
+	// Restore is the x-amz-restore header of an object in an archived storage class, empty until a restore was requested.
+	Restore string
+}
+
+// Server is the fake S3 endpoint, create buckets with CreateBucket before using them.
+type Server struct {
+	*httptest.Server
+
+	// MaxKeys caps the keys of a listing page, small values exercise pagination.
+	MaxKeys int
+	// PendingRestores keeps requested restores ongoing until CompleteRestores is called, otherwise they finish at once.
+	PendingRestores bool
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	uploads  map[string]*upload
+	requests map[string]int
+	nextID   int
+}
+
+type upload struct {
+	bucket, key string
+	template    Object
+	parts       map[int][]byte
+}
+
+// New starts a server, Close stops it.
+func New() *Server {
+	s := &Server{
+		buckets:  map[string]map[string]*Object{},
+		uploads:  map[string]*upload{},
+		requests: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Config is the aws-sdk-go configuration of a client talking to the server.
+func (s *Server) Config() *aws.Config {
+	return aws.NewConfig().
+		WithRegion("us-east-2").
+		WithEndpoint(s.URL).
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("fake", "fake", ""))
+}
+
+// Session returns a session for the server.
+func (s *Server) Session() *session.Session {
+	return session.Must(session.NewSession(s.Config()))
+}
+
+// Client returns an S3 client for the server.
+func (s *Server) Client() *s3.S3 {
+	return s3.New(s.Session())
+}
+
+// CreateBucket creates an empty bucket, an existing bucket is left as it is.
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+}
+
+// PutObject stores an object directly, e.g. to seed a bucket with snapshots.  storageClass may be empty for STANDARD.
+func (s *Server) PutObject(bucket, key string, body []byte, storageClass string) {
+	s.CreateBucket(bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object := &Object{Key: key, StorageClass: storageClass}
+	s.store(bucket, object, body)
+}
+
+// Object returns a copy of a stored object.
+func (s *Server) Object(bucket, key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.buckets[bucket][key]
+	if !ok {
+		return Object{}, false
+	}
+	return *object, true
+}
+
+// Keys returns the keys in the bucket starting with prefix, sorted.
+func (s *Server) Keys(bucket, prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(bucket, prefix)
+}
+
+// Requests returns how many requests of an operation were served, e.g. ListObjectsV2, GetObject or PutObject.
+func (s *Server) Requests(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+// CompleteRestores finishes every ongoing restore.
+func (s *Server) CompleteRestores() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, objects := range s.buckets {
+		for _, object := range objects {
+			if object.Restore != "" {
+				object.Restore = restored()
+			}
+		}
+	}
+}
+
+func restored() string {
+	return `ongoing-request="false", expiry-date="` + time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat) + `"`
+}
+
+func archived(storageClass string) bool {
+	return storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+}
+
+func (s *Server) keys(bucket, prefix string) []string {
+	var keys []string
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) store(bucket string, object *Object, body []byte) {
+	sum := md5.Sum(body)
+	object.Body = body
+	object.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+	object.LastModified = time.Now().UTC()
+	if object.StorageClass == "" {
+		object.StorageClass = s3.StorageClassStandard
+	}
+	s.buckets[bucket][object.Key] = object
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	query := r.URL.Query()
+	_, tagging := query["tagging"]
+	_, uploads := query["uploads"]
+	_, restore := query["restore"]
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.count("ListObjectsV2")
+		s.list(w, bucket, query)
+	case r.Method == http.MethodPost && uploads:
+		s.count("CreateMultipartUpload")
+		s.createUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.count("UploadPart")
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.count("CompleteMultipartUpload")
+		s.completeUpload(w, r, bucket, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		s.count("AbortMultipartUpload")
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.count("PutObject")
+		s.put(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.count("DeleteObject")
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && restore:
+		s.count("RestoreObject")
+		s.restore(w, objects[key])
+	case r.Method == http.MethodGet && tagging:
+		s.count("GetObjectTagging")
+		s.getTagging(w, objects[key])
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.count(map[string]string{http.MethodGet: "GetObject", http.MethodHead: "HeadObject"}[r.Method])
+		s.get(w, r, objects[key])
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String()+" is not supported by the fake")
+	}
+}
+
+func (s *Server) count(operation string) {
+	s.requests[operation]++
+}
+
+// template reads the metadata, tags and storage class of a PUT or multipart upload.
+func template(r *http.Request, key string) (Object, error) {
+	object := Object{Key: key, StorageClass: r.Header.Get("X-Amz-Storage-Class"), Metadata: map[string]string{}, Tags: map[string]string{}}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			object.Metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"))] = values[0]
+		}
+	}
+	tags, err := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		return object, err
+	}
+	for tag := range tags {
+		object.Tags[tag] = tags.Get(tag)
+	}
+	return object, nil
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	existing, exists := s.buckets[bucket][key]
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || strings.Trim(ifMatch, `"`) != strings.Trim(existing.ETag, `"`))) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+	object, err := template(r, key)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidTag", err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	s.store(bucket, &object, body)
+	w.Header().Set("ETag", object.ETag)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, object *Object) {
+	if object == nil {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if r.Method == http.MethodGet && archived(object.StorageClass) && !strings.Contains(object.Restore, `ongoing-request="false"`) {
+		writeError(w, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+		return
+	}
+
+	header := w.Header()
+	header.Set("ETag", object.ETag)
+	header.Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if object.StorageClass != s3.StorageClassStandard {
+		header.Set("X-Amz-Storage-Class", object.StorageClass)
+	}
+	if object.Restore != "" {
+		header.Set("X-Amz-Restore", object.Restore)
+	}
+	if len(object.Tags) > 0 {
+		header.Set("X-Amz-Tagging-Count", strconv.Itoa(len(object.Tags)))
+	}
+	for name, value := range object.Metadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	body, status := object.Body, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && len(object.Body) > 0 {
+		start, end, ok := parseRange(rng, len(object.Body))
+		if !ok {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		body, status = object.Body[start:end+1], http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object.Body)))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+// parseRange parses a single bytes=start-end range, the end is capped at the object's size.
+func parseRange(rng string, size int) (int, int, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if bounds[1] != "" {
+		if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+type listResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listObject   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// list serves ListObjectsV2, the continuation token is the last key or common prefix of the previous page.
+func (s *Server) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	maxKeys := defaultMaxKeys
+	if s.MaxKeys > 0 {
+		maxKeys = s.MaxKeys
+	}
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	result := listResult{Xmlns: xmlns, Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys, ContinuationToken: token}
+	seen := map[string]bool{}
+	last := ""
+	for _, key := range s.keys(bucket, prefix) {
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if entry <= token || seen[entry] {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		seen[entry] = true
+		last = entry
+		result.KeyCount++
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+			continue
+		}
+		object := s.buckets[bucket][key]
+		result.Contents = append(result.Contents, listObject{
+			Key:          key,
+			LastModified: object.LastModified.Format(time.RFC3339Nano),
+			ETag:         object.ETag,
+			Size:         len(object.Body),
+			StorageClass: object.StorageClass,
+		})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+func (s *Server) getTagging(w http.ResponseWriter, object *Object) {
+	if object == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	result := tagging{Xmlns: xmlns}
+	for key, value := range object.Tags {
+		result.TagSet = append(result.TagSet, tag{Key: key, Value: value})
+	}
+	sort.Slice(result.TagSet, func(i, j int) bool { return result.TagSet[i].Key < result.TagSet[j].Key })
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) restore(w http.ResponseWriter, object *Object) {
+	switch {
+	case object == nil:
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	case !archived(object.StorageClass):
+		writeError(w, http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's current storage class")
+	case strings.Contains(object.Restore, `ongoing-request="true"`):
+		writeError(w, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+	case object.Restore != "":
+		w.WriteHeader(http.StatusOK)
+	default:
+		object.Restore = `ongoing-request="true"`
+		if !s.PendingRestores {
+			object.Restore = restored()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int `xml:"PartNumber"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	object, err := template(r, key)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidTag", err.Error())
+		return
+	}
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &upload{bucket: bucket, key: key, template: object, parts: map[int][]byte{}}
+	writeXML(w, http.StatusOK, initiateResult{Xmlns: xmlns, Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	u, ok := s.uploads[query.Get("uploadId")]
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if !ok || err != nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	u.parts[number] = body
+	sum := md5.Sum(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+		return
+	}
+	var request completeRequest
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	var body bytes.Buffer
+	for _, part := range request.Parts {
+		content, ok := u.parts[part.PartNumber]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded", part.PartNumber))
+			return
+		}
+		body.Write(content)
+	}
+	delete(s.uploads, id)
+	object := u.template
+	s.store(bucket, &object, body.Bytes())
+	writeXML(w, http.StatusOK, completeResult{Xmlns: xmlns, Bucket: bucket, Key: u.key, ETag: object.ETag})
+}
+
+type errorResult struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, errorResult{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	content, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(content)))
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(content)
+}
@@ -0,0 +1,129 @@
+package fakes3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	server := New()
+	defer server.Close()
+	server.CreateBucket("backups")
+	client := server.Client()
+
+	// Large enough for a multipart upload and a download in several ranges.
+	body := bytes.Repeat([]byte("0123456789"), 600*1024)
+	_, err := s3manager.NewUploaderWithClient(client).Upload(&s3manager.UploadInput{
+		Bucket:       aws.String("backups"),
+		Key:          aws.String("qa/full.tar"),
+		Body:         bytes.NewReader(body),
+		Tagging:      aws.String("type=full&env=qa"),
+		Metadata:     map[string]*string{"to-lsn": aws.String("1000")},
+		StorageClass: aws.String(s3.StorageClassStandardIa),
+	})
+	assert.NoError(err)
+	assert.Equal(1, server.Requests("CreateMultipartUpload"))
+
+	download := aws.NewWriteAtBuffer(nil)
+	_, err = s3manager.NewDownloaderWithClient(client).Download(download, &s3.GetObjectInput{Bucket: aws.String("backups"), Key: aws.String("qa/full.tar")})
+	assert.NoError(err)
+	assert.Equal(body, download.Bytes())
+	assert.True(server.Requests("GetObject") > 1, "downloaded in ranges")
+
+	head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("backups"), Key: aws.String("qa/full.tar")})
+	assert.NoError(err)
+	assert.Equal("1000", aws.StringValue(head.Metadata["To-Lsn"]))
+	assert.Equal(s3.StorageClassStandardIa, aws.StringValue(head.StorageClass))
+	tagging, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String("backups"), Key: aws.String("qa/full.tar")})
+	assert.NoError(err)
+	assert.Len(tagging.TagSet, 2)
+
+	server.MaxKeys = 2
+	for _, key := range []string{"qa/2019/5/a", "qa/2019/5/b", "qa/2019/6/c", "qa/2020/1/d"} {
+		server.PutObject("backups", key, []byte(key), "")
+	}
+	var keys, prefixes []string
+	err = client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("backups"), Prefix: aws.String("qa/")},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		})
+	assert.NoError(err)
+	assert.Equal([]string{"qa/2019/5/a", "qa/2019/5/b", "qa/2019/6/c", "qa/2020/1/d", "qa/full.tar"}, keys)
+	err = client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("backups"), Prefix: aws.String("qa/2019/"), Delimiter: aws.String("/")},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, prefix := range page.CommonPrefixes {
+				prefixes = append(prefixes, aws.StringValue(prefix.Prefix))
+			}
+			return true
+		})
+	assert.NoError(err)
+	assert.Equal([]string{"qa/2019/5/", "qa/2019/6/"}, prefixes)
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("backups"), Key: aws.String("missing")})
+	assert.Equal(s3.ErrCodeNoSuchKey, err.(awserr.Error).Code())
+}
+
+func TestConditionalPut(t *testing.T) {
+	assert := require.New(t)
+	server := New()
+	defer server.Close()
+	server.CreateBucket("backups")
+	client := server.Client()
+	put := func(body string, condition map[string]string) (*s3.PutObjectOutput, error) {
+		return client.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String("backups"), Key: aws.String("catalog.json"), Body: strings.NewReader(body),
+		}, request.WithSetRequestHeaders(condition))
+	}
+
+	created, err := put("1", map[string]string{"If-None-Match": "*"})
+	assert.NoError(err)
+	_, err = put("2", map[string]string{"If-None-Match": "*"})
+	assert.Equal("PreconditionFailed", err.(awserr.Error).Code())
+	_, err = put("2", map[string]string{"If-Match": aws.StringValue(created.ETag)})
+	assert.NoError(err)
+	_, err = put("3", map[string]string{"If-Match": aws.StringValue(created.ETag)})
+	assert.Equal("PreconditionFailed", err.(awserr.Error).Code())
+
+	out, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("backups"), Key: aws.String("catalog.json")})
+	assert.NoError(err)
+	content, err := ioutil.ReadAll(out.Body)
+	assert.NoError(err)
+	assert.Equal("2", string(content))
+}
+
+func TestRestore(t *testing.T) {
+	assert := require.New(t)
+	server := New()
+	defer server.Close()
+	server.PendingRestores = true
+	server.PutObject("backups", "monthly.tgz", []byte("archived"), s3.StorageClassGlacier)
+	client := server.Client()
+	get := &s3.GetObjectInput{Bucket: aws.String("backups"), Key: aws.String("monthly.tgz")}
+	restore := &s3.RestoreObjectInput{Bucket: aws.String("backups"), Key: aws.String("monthly.tgz"), RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(1)}}
+
+	_, err := client.GetObject(get)
+	assert.Equal(s3.ErrCodeInvalidObjectState, err.(awserr.Error).Code())
+	_, err = client.RestoreObject(restore)
+	assert.NoError(err)
+	_, err = client.RestoreObject(restore)
+	assert.Equal("RestoreAlreadyInProgress", err.(awserr.Error).Code())
+
+	server.CompleteRestores()
+	_, err = client.GetObject(get)
+	assert.NoError(err)
+}
@@ -0,0 +1,201 @@
+// Package fakextrabackup installs fake innobackupex, xtrabackup and qpress commands for tests.  They write the
+// directory layout and xtrabackup_checkpoints of real backups, with compressed and encrypted files, and check and
+// advance the LSNs when backups are prepared, so backup chains can be taken and restored without MySQL.
+package fakextrabackup
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	// LSNStep is how far the LSN advances with every backup: a full backup ends at LSNStep, the first incremental on
+	// top of it at 2*LSNStep.
+	LSNStep = 1000
+
+	// FailEnv makes the next backups fail half way, after part of the backup directory was written.
+	FailEnv = "FAKE_XTRABACKUP_FAIL"
+
+	callsFile = "calls.log"
+)
+
+// Commands are the installed fakes.
+type Commands struct {
+	Dir string
+	// DecompressScript decompresses every .qp file below its argument like decompress_mysql_snapshot.sh, with qpress
+	// but without GNU parallel.
+	DecompressScript string
+}
+
+// Install writes the fakes to a temporary directory and puts it first on PATH until the test ends.
+func Install(t testing.TB) *Commands {
+	dir, err := ioutil.TempDir("", "fakextrabackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	scripts := map[string]string{
+		"innobackupex":                 xtrabackupScript,
+		"xtrabackup":                   xtrabackupScript,
+		"qpress":                       qpressScript,
+		"decompress_mysql_snapshot.sh": decompressScript,
+	}
+	for name, script := range scripts {
+		script = strings.Replace(script, "@CALLS@", filepath.Join(dir, callsFile), -1)
+		script = strings.Replace(script, "@LSN_STEP@", strconv.Itoa(LSNStep), -1)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	return &Commands{Dir: dir, DecompressScript: filepath.Join(dir, "decompress_mysql_snapshot.sh")}
+}
+
+// Calls returns the command lines the fakes were run with, oldest first.
+func (c *Commands) Calls() []string {
+	content, err := ioutil.ReadFile(filepath.Join(c.Dir, callsFile))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// Run runs an installed fake, e.g. to take the backups a restore test starts from.
+func (c *Commands) Run(t testing.TB, name string, args ...string) {
+	out, err := exec.Command(filepath.Join(c.Dir, name), args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s failed: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+// xtrabackupScript understands the innobackupex options and the xtrabackup --backup/--prepare equivalents.
+// Compressed files start with a FAKEQP line and encrypted files with a FAKEXBCRYPT line holding the key's checksum, so
+// decrypting with another key fails like it does with xtrabackup.
+const xtrabackupScript = `#!/usr/bin/env bash
+set -eu
+echo "$(basename "$0") $*" >> "@CALLS@"
+
+mode=backup target= incremental=false basedir= incdir= compress=false encrypt=false keyfile= extra_lsndir=
+remove_original=false export=false
+for arg in "$@"; do
+  case "$arg" in
+    --defaults-extra-file=*|--login-path=*|--slave-info|--safe-slave-backup|--no-timestamp|--redo-only|--apply-log-only) ;;
+    --parallel=*|--compress-threads=*|--encrypt-threads=*|--use-memory=*|--throttle=*) ;;
+    --backup) mode=backup ;;
+    --apply-log|--prepare) mode=prepare ;;
+    --export) export=true ;;
+    --decrypt=*) mode=decrypt ;;
+    --decompress) mode=decompress ;;
+    --remove-original) remove_original=true ;;
+    --compress) compress=true ;;
+    --encrypt=*) encrypt=true ;;
+    --encrypt-key-file=*) keyfile="${arg#*=}" ;;
+    --extra-lsndir=*) extra_lsndir="${arg#*=}" ;;
+    --target-dir=*) target="${arg#*=}" ;;
+    --incremental) incremental=true ;;
+    --incremental-basedir=*) incremental=true; basedir="${arg#*=}" ;;
+    --incremental=*|--incremental-dir=*) incdir="${arg#*=}" ;;
+    -*) echo "fake xtrabackup: unsupported option $arg" >&2; exit 2 ;;
+    *) target="$arg" ;;
+  esac
+done
+[ -n "$target" ] || { echo "fake xtrabackup: no target directory" >&2; exit 2; }
+
+checkpoint() { sed -n "s/^$2 = //p" "$1/xtrabackup_checkpoints"; }
+key_sum() { cksum < "$keyfile" | cut -d' ' -f1; }
+write_checkpoints() {
+  printf 'backup_type = %s\nfrom_lsn = %s\nto_lsn = %s\nlast_lsn = %s\ncompact = 0\nrecover_binlog_info = 0\n' "$2" "$3" "$4" "$4" > "$1/xtrabackup_checkpoints"
+}
+
+case "$mode" in
+backup)
+  mkdir -p "$target/mysql" "$target/app"
+  from=0 type=full-backuped
+  if $incremental; then
+    [ -f "$basedir/xtrabackup_checkpoints" ] || { echo "fake xtrabackup: $basedir/xtrabackup_checkpoints not found" >&2; exit 1; }
+    from=$(checkpoint "$basedir" to_lsn) type=incremental
+  fi
+  to=$((from + @LSN_STEP@))
+  if $incremental; then
+    data="ibdata1.delta ibdata1.meta mysql/user.ibd.delta mysql/user.ibd.meta app/orders.ibd.delta app/orders.ibd.meta"
+  else
+    data="ibdata1 mysql/user.ibd app/orders.ibd"
+  fi
+  for f in $data xtrabackup_logfile; do echo "$f $from-$to" > "$target/$f"; done
+  if [ -n "${` + FailEnv + `:-}" ]; then echo "fake xtrabackup: failing as requested" >&2; exit 1; fi
+  echo "mysql-bin.000001	$to" > "$target/xtrabackup_binlog_info"
+  echo "CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000001', MASTER_LOG_POS=$to" > "$target/xtrabackup_slave_info"
+  printf '[mysqld]\ninnodb_data_file_path=ibdata1:12M:autoextend\n' > "$target/backup-my.cnf"
+  echo "tool_name = innobackupex" > "$target/xtrabackup_info"
+  write_checkpoints "$target" "$type" "$from" "$to"
+  if $compress; then
+    for f in $data xtrabackup_logfile; do { echo FAKEQP; cat "$target/$f"; } > "$target/$f.qp"; rm "$target/$f"; done
+  fi
+  checkpoints=$(cat "$target/xtrabackup_checkpoints")
+  if $encrypt; then
+    [ -f "$keyfile" ] || { echo "fake xtrabackup: --encrypt needs --encrypt-key-file" >&2; exit 2; }
+    find "$target" -type f | while read -r f; do
+      { echo "FAKEXBCRYPT $(key_sum)"; cat "$f"; } > "$f.xbcrypt"; rm "$f"
+    done
+  fi
+  if [ -n "$extra_lsndir" ]; then
+    mkdir -p "$extra_lsndir"; echo "$checkpoints" > "$extra_lsndir/xtrabackup_checkpoints"
+  fi
+  ;;
+decrypt)
+  [ -f "$keyfile" ] || { echo "fake xtrabackup: --decrypt needs --encrypt-key-file" >&2; exit 2; }
+  find "$target" -type f -name '*.xbcrypt' | while read -r f; do
+    [ "$(head -n 1 "$f")" = "FAKEXBCRYPT $(key_sum)" ] || { echo "fake xtrabackup: failed to decrypt $f, wrong key" >&2; exit 1; }
+    tail -n +2 "$f" > "${f%.xbcrypt}"
+    ! $remove_original || rm "$f"
+  done
+  ;;
+decompress)
+  find "$target" -type f -name '*.qp' | while read -r f; do
+    tail -n +2 "$f" > "${f%.qp}"
+    ! $remove_original || rm "$f"
+  done
+  ;;
+prepare)
+  if [ -n "$(find "$target" ${incdir:+"$incdir"} -name '*.qp' -o -name '*.xbcrypt' | head -n 1)" ]; then
+    echo "fake xtrabackup: decrypt and decompress the backups before preparing them" >&2; exit 1
+  fi
+  [ -f "$target/xtrabackup_checkpoints" ] || { echo "fake xtrabackup: $target/xtrabackup_checkpoints not found" >&2; exit 1; }
+  from=$(checkpoint "$target" from_lsn) to=$(checkpoint "$target" to_lsn)
+  if [ -n "$incdir" ]; then
+    [ "$(checkpoint "$incdir" backup_type)" = incremental ] || { echo "fake xtrabackup: $incdir is not an incremental backup" >&2; exit 1; }
+    if [ "$(checkpoint "$incdir" from_lsn)" != "$to" ]; then
+      echo "fake xtrabackup: This incremental backup seems not to be proper for the target. Check 'to_lsn' of the target and 'from_lsn' of the incremental." >&2
+      exit 1
+    fi
+    to=$(checkpoint "$incdir" to_lsn)
+  fi
+  write_checkpoints "$target" log-applied "$from" "$to"
+  if $export; then
+    find "$target" -name '*.ibd' | while read -r f; do echo export > "${f%.ibd}.cfg"; done
+  fi
+  ;;
+esac
+`
+
+// qpressScript only supports -do <file>, which is how decompress_mysql_snapshot.sh calls it.
+const qpressScript = `#!/usr/bin/env bash
+set -eu
+echo "qpress $*" >> "@CALLS@"
+[ "$1" = -do ] || { echo "fake qpress: only -do is supported" >&2; exit 2; }
+[ "$(head -n 1 "$2")" = FAKEQP ] || { echo "fake qpress: $2 is not compressed" >&2; exit 1; }
+tail -n +2 "$2"
+`
+
+const decompressScript = `#!/usr/bin/env bash
+set -eu
+find "$1" -name '*.qp' -type f | while read -r f; do qpress -do "$f" > "${f%.qp}" && rm -f "$f"; done
+`
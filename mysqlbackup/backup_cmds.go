@@ -2,62 +2,101 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/catalog"
+	"bb.dev.norvax.net/dep/operator/backups/checkpoints"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
 )
 
-func fullBackup(backupDir string, folderTime string, s3Session *session.Session, backupConfig *Config) error {
+// fullBackup records the backup directory, upload key and size in attempt.
+func fullBackup(backupDir string, folderTime string, s3Session *session.Session, backupConfig *Config, attempt *Attempt) error {
 	log.Infof("Creating full back up in directory: %s", backupDir)
+	attempt.Dir = backupDir
 	log.Infof("Snapshot name: snapshot_%s", backupConfig.SnapshotTime)
 
-	err := os.MkdirAll(backupDir, 0700)
+	credentials, cleanup, err := mysqlCredentials(backupConfig)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
+
+	if err := preflightBackup(backupDir, "", credentials, backupConfig); err != nil {
+		return err
+	}
+	if err := checkHealth(credentials, backupConfig); err != nil {
+		return err
+	}
+	encryptArgs, removeKey, err := encryptionArgs(backupDir, backupConfig)
+	if err != nil {
+		return err
+	}
+	defer removeKey()
+	if err := markInProgress(attempt); err != nil {
+		return err
+	}
 
-	cmdLine := []string{
-		"innobackupex",
-		fmt.Sprintf("--user=%+s", backupConfig.MysqlUser),
-		fmt.Sprintf("--password=%+s", backupConfig.MysqlPassword),
+	err = os.MkdirAll(backupDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	cmdLine := append([]string{"innobackupex"}, credentials...)
+	cmdLine = append(cmdLine,
 		"--slave-info",
 		"--safe-slave-backup",
 		"--compress",
 		backupDir,
-		"--no-timestamp",
-		"--compress-threads=8",
-		"--parallel=8",
-		"--use-memory=2G"}
+		"--no-timestamp")
+	cmdLine = append(cmdLine, encryptArgs...)
+	cmdLine = backupConfig.Tuning.Wrap(append(cmdLine, backupConfig.Tuning.BackupArgs()...))
 	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
-	log.Infof("Executing command: %s", strings.Join(cmdLine, " "))
+	log.Infof("Executing command: %s", redact.Command(cmdLine))
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	if err != nil {
-		return errors.Wrapf(err, "cmd failed %s, stderr: %s", strings.Join(cmdLine, " "), stderr.String())
+		return errors.Wrapf(err, "cmd failed %s, stderr: %s", redact.Command(cmdLine), stderr.String())
 	}
 
-	err = archiveBackupToS3(backupDir, "full", folderTime, s3Session, backupConfig)
+	err = archiveBackupToS3(backupDir, backupTypeFull, folderTime, s3Session, backupConfig, attempt)
 	if err != nil {
 		return errors.Wrapf(err, "failed to archive backup %s to s3 bucket", backupDir)
 	}
+	if err := writeMarker(backupDir, backupConfig, attempt); err != nil {
+		return err
+	}
 
 	log.Infof("successfully created full back up in directory: %s", backupDir)
 	return nil
 }
 
+// encryptionArgs returns the innobackupex options that encrypt the backup in backupDir when a key is configured.
+// --extra-lsndir also writes xtrabackup_checkpoints unencrypted, incrementals and chain checks read it.
+func encryptionArgs(backupDir string, backupConfig *Config) (args []string, cleanup func(), err error) {
+	if !backupConfig.Encryption.Enabled() {
+		return nil, func() {}, nil
+	}
+	args, cleanup, err = backupConfig.Encryption.Args(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(args, "--extra-lsndir="+backupDir), cleanup, nil
+}
+
 func incrementalBackupTimeCheck(backupDir string, dur time.Duration) (bool, error) {
 	baseName := filepath.Base(backupDir)
 	baseTime, err := time.Parse(dateFormat, baseName)
@@ -70,65 +109,80 @@ func incrementalBackupTimeCheck(backupDir string, dur time.Duration) (bool, erro
 	return dif > dur, nil
 }
 
-func incrementalBackup(backupDir string, folderTime string, dur time.Duration, s3Session *session.Session, backupConfig *Config) error {
+// incrementalBackup takes an incremental backup based on the last complete backup of chain when the latest backup,
+// complete or not, is older than dur.
+// It reports whether a backup was due, so the caller knows a nil error means a backup was taken.
+func incrementalBackup(backupDir string, chain backupChain, folderTime string, dur time.Duration, s3Session *session.Session, backupConfig *Config, attempt *Attempt) (bool, error) {
 
 	increBackupDir := filepath.Join(backupDir, time.Now().UTC().Format(dateFormat))
+	previousBackup := chain.Base
 
-	files, err := ioutil.ReadDir(backupDir)
+	res, err := incrementalBackupTimeCheck(chain.Latest, dur)
 	if err != nil {
-		return errors.Wrapf(err, "could not read directory: %v\n", backupDir)
+		return false, errors.Wrap(err, "unable to determine whether an incremental backup should be made")
 	}
 
-	previousBackupDir := files[len(files)-1]
-	previousBackup := path.Join(backupDir, previousBackupDir.Name())
-	if !previousBackupDir.IsDir() {
-		return errors.Errorf("attempted to find a previous backup directory. Found %s but that is not a directory", previousBackupDir)
+	if !res {
+		return false, nil
 	}
 
-	res, err := incrementalBackupTimeCheck(previousBackup, dur)
+	credentials, cleanup, err := mysqlCredentials(backupConfig)
 	if err != nil {
-		return errors.Wrap(err, "unable to determine whether an incremental backup should be made")
+		return true, err
 	}
+	defer cleanup()
 
-	if !res {
-		return nil
+	if err := preflightBackup(increBackupDir, previousBackup, credentials, backupConfig); err != nil {
+		return true, err
+	}
+	if err := checkHealth(credentials, backupConfig); err != nil {
+		return true, err
+	}
+	encryptArgs, removeKey, err := encryptionArgs(increBackupDir, backupConfig)
+	if err != nil {
+		return true, err
 	}
+	defer removeKey()
 
+	attempt.Dir = increBackupDir
+	if err := markInProgress(attempt); err != nil {
+		return true, err
+	}
 	log.Infof("Creating an incremental backup in %s because the last back up was made over %v ago", increBackupDir, dur)
 	log.Infof("Snapshot name: snapshot_%s", backupConfig.SnapshotTime)
 
 	var stderr bytes.Buffer
-	cmdLine := []string{
-		"innobackupex",
-		fmt.Sprintf("--user=%+s", backupConfig.MysqlUser),
-		fmt.Sprintf("--password=%+s", backupConfig.MysqlPassword),
+	cmdLine := append([]string{"innobackupex"}, credentials...)
+	cmdLine = append(cmdLine,
 		"--slave-info",
 		"--safe-slave-backup",
 		"--incremental",
 		"--compress",
 		increBackupDir,
 		fmt.Sprintf("--incremental-basedir=%s", previousBackup),
-		"--no-timestamp",
-		"--compress-threads=8",
-		"--parallel=8",
-		"--use-memory=2G"}
+		"--no-timestamp")
+	cmdLine = append(cmdLine, encryptArgs...)
+	cmdLine = backupConfig.Tuning.Wrap(append(cmdLine, backupConfig.Tuning.BackupArgs()...))
 	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
-	log.Infof("executing command: %s", strings.Join(cmdLine, " "))
+	log.Infof("executing command: %s", redact.Command(cmdLine))
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	if err != nil {
-		return errors.Wrapf(err, "cmd failed %s\nstderr: %s\n", strings.Join(cmdLine, " "), stderr.String())
+		return true, errors.Wrapf(err, "cmd failed %s\nstderr: %s\n", redact.Command(cmdLine), stderr.String())
 	}
 
-	err = archiveBackupToS3(increBackupDir, "incremental", folderTime, s3Session, backupConfig)
+	err = archiveBackupToS3(increBackupDir, backupTypeIncremental, folderTime, s3Session, backupConfig, attempt)
 	if err != nil {
-		return errors.Wrapf(err, "failed to archive backup %s to s3 bucket", backupDir)
+		return true, errors.Wrapf(err, "failed to archive backup %s to s3 bucket", backupDir)
+	}
+	if err := writeMarker(increBackupDir, backupConfig, attempt); err != nil {
+		return true, err
 	}
 	log.Infof("successfully created incremental backup in %s", increBackupDir)
-	return err
+	return true, nil
 }
 
-func archiveBackupToS3(backupDir string, backupType string, folderTime string, s3Session *session.Session, backupConfig *Config) error {
+func archiveBackupToS3(backupDir string, backupType string, folderTime string, s3Session *session.Session, backupConfig *Config, attempt *Attempt) error {
 
 	// Create tar file
 	tarFile, err := tarBackup(backupDir, backupType+"_", backupConfig)
@@ -144,10 +198,23 @@ func archiveBackupToS3(backupDir string, backupType string, folderTime string, s
 		}
 	}()
 
-	err = uploadS3Bucket(s3Session, tarFile, folderTime, backupConfig)
+	if fi, err := os.Stat(filepath.Join(backupConfig.S3Dir, tarFile)); err == nil {
+		attempt.Size = fi.Size()
+	}
+	if backupType != backupTypeLogical {
+		cp, err := checkpoints.Read(backupDir)
+		if err != nil {
+			return err
+		}
+		attempt.FromLSN, attempt.ToLSN = cp.FromLSN, cp.ToLSN
+	}
+
+	attempt.Tier, attempt.StorageClass = uploadTier(backupConfig, attempt)
+	attempt.Key, err = uploadS3Bucket(s3Session, tarFile, folderTime, attempt, backupConfig)
 	if err != nil {
 		return errors.Wrapf(err, "failed to uploaded tar file %s to s3 bucket %s", tarFile, backupConfig.Bucketname)
 	}
+	updateCatalog(s3Session, backupConfig, attempt)
 	return nil
 
 }
@@ -158,6 +225,7 @@ func tarBackup(targetDir, backupType string, backupConfig *Config) (string, erro
 		return "", errors.Wrapf(err, "Directory %s does not exist and cannot create it", backupConfig.S3Dir)
 	}
 
+	// The files are already compressed, by innobackupex --compress or gzipped by mysqldump, gzip would only cost CPU.
 	tarFileName := backupType + filepath.Base(targetDir) + ".tar"
 
 	log.Infof("Tarring directory %s into file %s", targetDir, tarFileName)
@@ -167,48 +235,72 @@ func tarBackup(targetDir, backupType string, backupConfig *Config) (string, erro
 	tarCmd.Stderr = &stderr
 	tarCmd.Stdout = &stdout
 
-	log.Infof("Executing command: %s", strings.Join(tarCmdLine, " "))
+	log.Infof("Executing command: %s", redact.Command(tarCmdLine))
 	err := tarCmd.Run()
 	if err != nil {
-		return "", errors.Wrapf(err, "cmd failed %s\nstderr: %s\nstdout: %s\n", strings.Join(tarCmdLine, " "), stderr.String(), stdout.String())
+		return "", errors.Wrapf(err, "cmd failed %s\nstderr: %s\nstdout: %s\n", redact.Command(tarCmdLine), stderr.String(), stdout.String())
 	}
 	log.Infof("Successfully created tar file %s of backup %s", tarFileName, targetDir)
 
 	return tarFileName, nil
 }
 
-func uploadS3Bucket(session *session.Session, tarFile string, folderTime string, backupConfig *Config) error {
-	log.Infof("uploading tar file %s to s3 bucket %s", tarFile, backupConfig.Bucketname)
+// uploadS3Bucket uploads the tar file of the attempt with the tags and metadata describing it.
+func uploadS3Bucket(session *session.Session, tarFile string, folderTime string, attempt *Attempt, backupConfig *Config) (string, error) {
+	log.Infof("uploading tar file %s to s3 bucket %s as %s backup with storage class %s", tarFile, backupConfig.Bucketname, attempt.Tier, attempt.StorageClass)
 
 	uploader := s3manager.NewUploader(session)
 
 	file, err := os.Open(filepath.Join(backupConfig.S3Dir, tarFile))
 	if err != nil {
-		return errors.WithStack(err)
+		return "", errors.WithStack(err)
 	}
+	defer file.Close()
 
-	// Dates for s3 directory structure in Key
-	TIMESTAMP := time.Now().UTC()
-	year := fmt.Sprintf("%v", TIMESTAMP.Year())
-	month := fmt.Sprintf("%v", TIMESTAMP.Month())
-	day := fmt.Sprintf("%v", TIMESTAMP.Day())
+	// The year and month of the key are the snapshot's, so a chain uploaded across midnight stays in one snapshot.
+	date, err := snapshotDate(backupConfig.SnapshotTime)
+	if err != nil {
+		return "", err
+	}
 	snapshotName := "snapshot" + "_" + backupConfig.SnapshotTime
-
-	keyName := filepath.Join("mysqlbackups", backupConfig.BackupEnv, year, month, day, snapshotName, tarFile)
+	keyName := catalog.ArchiveKey(backupConfig.BackupEnv, backupConfig.Cluster, date, snapshotName, tarFile)
 
 	_, err = uploader.Upload(&s3manager.UploadInput{
 		Bucket:               aws.String(backupConfig.Bucketname),
 		Key:                  aws.String(keyName),
 		Body:                 file,
 		ServerSideEncryption: aws.String("AES256"),
-		Tagging:              aws.String(snapshotName),
+		Tagging:              aws.String(objectTags(backupConfig, attempt, snapshotName).Encode()),
+		Metadata:             objectMetadata(backupConfig, attempt, snapshotName),
+		StorageClass:         aws.String(attempt.StorageClass),
 	})
 
 	if err != nil {
-		return errors.Errorf("failed to upload to s3: , %+v\n", err)
+		return "", errors.Errorf("failed to upload to s3: , %+v\n", err)
 	}
 	log.Infof("successfully uploaded tar file %s to s3 bucket %s", tarFile, backupConfig.Bucketname)
 	log.Debugf("uploaded file %s, to bucket %s, in directory %s", tarFile, backupConfig.Bucketname, keyName)
 
-	return nil
+	return keyName, nil
+}
+
+// updateCatalog adds the uploaded archive to the catalog of the cluster.  The archive is in the bucket either way, so a
+// failure is only logged, mysqlrestore -operation rebuild-catalog adds it back.
+func updateCatalog(s3Session *session.Session, backupConfig *Config, attempt *Attempt) {
+	key := catalog.Key(backupConfig.BackupEnv, backupConfig.Cluster)
+	entry := catalog.Entry{
+		Key:          attempt.Key,
+		Snapshot:     "snapshot_" + backupConfig.SnapshotTime,
+		Type:         attempt.Type,
+		Size:         attempt.Size,
+		Uploaded:     time.Now().UTC(),
+		StorageClass: attempt.StorageClass,
+		FromLSN:      attempt.FromLSN,
+		ToLSN:        attempt.ToLSN,
+	}
+	if err := catalog.Append(context.Background(), s3.New(s3Session), backupConfig.Bucketname, key, entry); err != nil {
+		log.Errorf("failed to add %s to catalog %s, run mysqlrestore -operation rebuild-catalog to add it: %v", attempt.Key, key, err)
+		return
+	}
+	log.Infof("added %s to catalog %s", attempt.Key, key)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/checkpoints"
+)
+
+// completeMarker is written into a backup directory once the backup was uploaded, directories without it are
+// backups that failed part way and are never used as the base of an incremental.
+const completeMarker = "mysqlbackup_complete.json"
+
+// errChainBroken is returned when a day's backups do not end in a complete full backup followed by complete
+// incrementals that each start at the LSN the previous backup ended at.
+var errChainBroken = errors.New("incremental chain broken")
+
+// backupMarker is the content of the completion marker.
+type backupMarker struct {
+	Type         string    `json:"type"`
+	SnapshotTime string    `json:"snapshot_time"`
+	Key          string    `json:"key"`
+	FromLSN      uint64    `json:"from_lsn"`
+	ToLSN        uint64    `json:"to_lsn"`
+	Completed    time.Time `json:"completed"`
+}
+
+// writeMarker records a backup that was uploaded to S3 with the LSNs of xtrabackup backups, logical backups have none.
+func writeMarker(backupDir string, backupConfig *Config, attempt *Attempt) error {
+	marker := backupMarker{
+		Type:         attempt.Type,
+		SnapshotTime: backupConfig.SnapshotTime,
+		Key:          attempt.Key,
+		Completed:    time.Now().UTC(),
+	}
+	if attempt.Type != backupTypeLogical {
+		cp, err := checkpoints.Read(backupDir)
+		if err != nil {
+			return err
+		}
+		marker.FromLSN, marker.ToLSN = cp.FromLSN, cp.ToLSN
+	}
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(ioutil.WriteFile(filepath.Join(backupDir, completeMarker), content, 0600), "failed to mark %s complete", backupDir)
+}
+
+// readMarker reports whether backupDir holds a complete backup.
+func readMarker(backupDir string) (backupMarker, bool, error) {
+	var marker backupMarker
+	content, err := ioutil.ReadFile(filepath.Join(backupDir, completeMarker))
+	if os.IsNotExist(err) {
+		return marker, false, nil
+	}
+	if err != nil {
+		return marker, false, errors.Wrapf(err, "failed to read completion marker of %s", backupDir)
+	}
+	if err := json.Unmarshal(content, &marker); err != nil {
+		return marker, false, errors.Wrapf(err, "invalid completion marker in %s", backupDir)
+	}
+	return marker, true, nil
+}
+
+// backupChain is the chain of complete backups incrementals are added to.
+type backupChain struct {
+	// Base is the last complete backup of the chain, the next incremental is based on it.
+	Base string
+	// SnapshotTime names the snapshot the chain is uploaded to.
+	SnapshotTime string
+	// Latest is the newest backup directory, complete or not, the incremental interval counts from it.
+	Latest string
+}
+
+// findChain builds the chain from the last complete full backup in dayBackupDir, skipping backups that did not
+// complete.  It returns errChainBroken when there is no complete full backup or an incremental does not start where
+// its predecessor ended, Latest is set even then.
+func findChain(dayBackupDir string) (backupChain, error) {
+	var chain backupChain
+	files, err := ioutil.ReadDir(dayBackupDir)
+	if err != nil {
+		return chain, errors.Wrapf(err, "could not read directory: %v", dayBackupDir)
+	}
+
+	var previous backupMarker
+	var broken error
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		backupDir := filepath.Join(dayBackupDir, fi.Name())
+		chain.Latest = backupDir
+		marker, complete, err := readMarker(backupDir)
+		if err != nil {
+			return chain, err
+		}
+		if !complete {
+			log.Debugf("skipping %s, the backup did not complete", backupDir)
+			continue
+		}
+
+		switch {
+		case marker.Type == backupTypeLogical:
+			log.Debugf("skipping %s, logical backups are not part of a chain", backupDir)
+			continue
+		case marker.Type == backupTypeFull:
+			chain.Base, chain.SnapshotTime, broken = backupDir, marker.SnapshotTime, nil
+		case chain.Base == "":
+			log.Debugf("skipping %s, there is no complete full backup before it", backupDir)
+			continue
+		case marker.FromLSN != previous.ToLSN:
+			broken = errors.Wrapf(errChainBroken, "incremental %s starts at lsn %d but %s ends at lsn %d", backupDir, marker.FromLSN, chain.Base, previous.ToLSN)
+			chain.Base = ""
+			continue
+		default:
+			chain.Base = backupDir
+		}
+		previous = marker
+	}
+
+	if broken != nil {
+		return chain, broken
+	}
+	if chain.Base == "" {
+		return chain, errors.Wrapf(errChainBroken, "there is no complete full backup in %s", dayBackupDir)
+	}
+	return chain, nil
+}
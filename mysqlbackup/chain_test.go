@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBackup(t *testing.T, dayDir, name string, marker *backupMarker) string {
+	assert := require.New(t)
+	dir := filepath.Join(dayDir, name)
+	assert.NoError(os.MkdirAll(dir, 0700))
+	if marker != nil {
+		content, err := json.Marshal(marker)
+		assert.NoError(err)
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, completeMarker), content, 0600))
+	}
+	return dir
+}
+
+func TestFindChain(t *testing.T) {
+	assert := require.New(t)
+	dayDir, err := ioutil.TempDir("", "chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dayDir)
+
+	_, err = findChain(dayDir)
+	assert.Equal(errChainBroken, errors.Cause(err))
+
+	full := writeBackup(t, dayDir, "2019_05_01_00_00_00Z", &backupMarker{Type: backupTypeFull, SnapshotTime: "2019_05_01", ToLSN: 100})
+	first := writeBackup(t, dayDir, "2019_05_01_01_00_00Z", &backupMarker{Type: backupTypeIncremental, FromLSN: 100, ToLSN: 200})
+	failed := writeBackup(t, dayDir, "2019_05_01_02_00_00Z", nil)
+
+	chain, err := findChain(dayDir)
+	assert.NoError(err)
+	assert.Equal(backupChain{Base: first, SnapshotTime: "2019_05_01", Latest: failed}, chain)
+
+	gap := writeBackup(t, dayDir, "2019_05_01_03_00_00Z", &backupMarker{Type: backupTypeIncremental, FromLSN: 300, ToLSN: 400})
+	chain, err = findChain(dayDir)
+	assert.Equal(errChainBroken, errors.Cause(err))
+	assert.Equal(gap, chain.Latest)
+
+	refull := writeBackup(t, dayDir, "2019_05_01_04_00_00Z", &backupMarker{Type: backupTypeFull, SnapshotTime: "2019_05_01_04_00_00Z", ToLSN: 500})
+	chain, err = findChain(dayDir)
+	assert.NoError(err)
+	assert.Equal(refull, chain.Base)
+	assert.Equal("2019_05_01_04_00_00Z", chain.SnapshotTime)
+	assert.NotEqual(full, chain.Base)
+}
+
+func TestLogicalMarker(t *testing.T) {
+	assert := require.New(t)
+	dayDir, err := ioutil.TempDir("", "chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dayDir)
+	assert.Len(newSnapshotTime(dayDir), len(snapshotFormat))
+
+	dump := writeBackup(t, dayDir, "2019_05_01_00_00_00Z", nil)
+	assert.NoError(writeMarker(dump, &Config{SnapshotTime: "2019_05_01"}, &Attempt{Type: backupTypeLogical, Key: "logical.tar"}))
+	marker, complete, err := readMarker(dump)
+	assert.NoError(err)
+	assert.True(complete)
+	assert.Equal(backupTypeLogical, marker.Type)
+	// A second backup of the day goes to a snapshot of its own.
+	assert.Len(newSnapshotTime(dayDir), len(dateFormat))
+
+	_, err = findChain(dayDir)
+	assert.Equal(errChainBroken, errors.Cause(err))
+}
+
+func TestLegacySnapshotTime(t *testing.T) {
+	assert := require.New(t)
+	dayDir, err := ioutil.TempDir("", "chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dayDir)
+
+	// A full backup taken before completion markers existed was uploaded under the day's snapshot.
+	writeBackup(t, dayDir, "2019_05_01_00_00_00Z", nil)
+	_, err = findChain(dayDir)
+	assert.Equal(errChainBroken, errors.Cause(err))
+	assert.Len(newSnapshotTime(dayDir), len(dateFormat), "the next full backup does not reuse the day's snapshot")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+const (
+	failedBackupRemove     = "remove"
+	failedBackupQuarantine = "quarantine"
+
+	// inProgressSuffix names the file next to a running backup's directory, innobackupex needs the directory itself to
+	// be empty.  One left behind at startup belongs to a backup that was interrupted.
+	inProgressSuffix = ".in_progress"
+	quarantineDir    = "quarantine"
+)
+
+// markInProgress records the attempt next to its backup directory until the backup finished.
+func markInProgress(attempt *Attempt) error {
+	content, err := json.Marshal(attempt)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(ioutil.WriteFile(attempt.Dir+inProgressSuffix, content, 0600), "failed to mark %s in progress", attempt.Dir)
+}
+
+// cleanupBackup removes the in progress file of a finished backup and removes or quarantines the backup directory when
+// the backup failed, so it is never mistaken for a backup to base incrementals on.  What happened is recorded in
+// attempt.Cleanup for the history.
+func cleanupBackup(backupConfig *Config, attempt *Attempt, backupErr error) {
+	if attempt.Dir == "" {
+		return
+	}
+	if err := os.Remove(attempt.Dir + inProgressSuffix); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove %s: %v", attempt.Dir+inProgressSuffix, err)
+	}
+	if backupErr == nil {
+		return
+	}
+	if _, err := os.Stat(attempt.Dir); os.IsNotExist(err) {
+		return
+	}
+	if _, complete, _ := readMarker(attempt.Dir); complete {
+		return
+	}
+
+	switch backupConfig.FailedBackupAction {
+	case failedBackupQuarantine:
+		dest := filepath.Join(backupConfig.BackupDir, quarantineDir, filepath.Base(filepath.Dir(attempt.Dir))+"_"+filepath.Base(attempt.Dir))
+		err := os.MkdirAll(filepath.Dir(dest), 0700)
+		if err == nil {
+			err = os.Rename(attempt.Dir, dest)
+		}
+		if err != nil {
+			attempt.Cleanup = redact.String("quarantine failed: " + err.Error())
+			log.Errorf("failed to quarantine failed backup %s: %v", attempt.Dir, err)
+			return
+		}
+		attempt.Cleanup = "quarantined to " + dest
+	default:
+		if err := os.RemoveAll(attempt.Dir); err != nil {
+			attempt.Cleanup = redact.String("remove failed: " + err.Error())
+			log.Errorf("failed to remove failed backup %s: %v", attempt.Dir, err)
+			return
+		}
+		attempt.Cleanup = "removed"
+	}
+	log.Warnf("failed backup %s %s", attempt.Dir, attempt.Cleanup)
+}
+
+// cleanupInterrupted cleans up the backups a previous mysqlbackup did not finish and records them as failed.
+func cleanupInterrupted(backupConfig *Config) error {
+	markers, err := filepath.Glob(filepath.Join(backupConfig.BackupDir, "*", "*"+inProgressSuffix))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, marker := range markers {
+		attempt := Attempt{Dir: strings.TrimSuffix(marker, inProgressSuffix)}
+		if content, err := ioutil.ReadFile(marker); err == nil {
+			if err := json.Unmarshal(content, &attempt); err != nil {
+				log.Warnf("invalid in progress file %s: %v", marker, err)
+			}
+		}
+		attempt.Dir = strings.TrimSuffix(marker, inProgressSuffix)
+		attempt.End = time.Now().UTC()
+		attempt.Status = statusFailed
+		attempt.Error = "interrupted, mysqlbackup stopped before the backup finished"
+
+		cleanupBackup(backupConfig, &attempt, errors.New(attempt.Error))
+		log.Warnf("%s backup %s started at %s was interrupted", attempt.Type, attempt.Dir, attempt.Start.Format(time.RFC3339))
+		if err := backupConfig.History.Append(attempt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
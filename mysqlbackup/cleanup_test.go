@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupBackup(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "cleanup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	config := &Config{BackupDir: dir, FailedBackupAction: failedBackupQuarantine, History: newHistory(dir)}
+
+	failed := &Attempt{Type: backupTypeFull, Dir: writeBackup(t, filepath.Join(dir, "2019-05-01"), "2019_05_01_00_00_00Z", nil)}
+	assert.NoError(markInProgress(failed))
+	cleanupBackup(config, failed, errors.New("innobackupex failed"))
+	assert.Equal("quarantined to "+filepath.Join(dir, quarantineDir, "2019-05-01_2019_05_01_00_00_00Z"), failed.Cleanup)
+	assert.NoDirExists(failed.Dir)
+	assert.NoFileExists(failed.Dir + inProgressSuffix)
+
+	uploaded := &Attempt{Dir: writeBackup(t, filepath.Join(dir, "2019-05-01"), "2019_05_01_01_00_00Z", &backupMarker{Type: backupTypeFull})}
+	cleanupBackup(config, uploaded, errors.New("history not written"))
+	assert.DirExists(uploaded.Dir)
+	assert.Empty(uploaded.Cleanup)
+
+	config.FailedBackupAction = failedBackupRemove
+	interrupted := &Attempt{Type: backupTypeIncremental, Start: time.Now().UTC(), Dir: writeBackup(t, filepath.Join(dir, "2019-05-01"), "2019_05_01_02_00_00Z", nil)}
+	assert.NoError(markInProgress(interrupted))
+	assert.NoError(cleanupInterrupted(config))
+	assert.NoDirExists(interrupted.Dir)
+
+	attempts, err := config.History.Read()
+	assert.NoError(err)
+	assert.Len(attempts, 1)
+	assert.Equal(backupTypeIncremental, attempts[0].Type)
+	assert.Equal(statusFailed, attempts[0].Status)
+	assert.Equal("removed", attempts[0].Cleanup)
+}
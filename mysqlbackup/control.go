@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const controlSocketName = "mysqlbackup.sock"
+
+// backupRequest forces a backup of Type, the zero value is the scheduled backup.
+type backupRequest struct {
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+}
+
+// validate rejects unknown types, labelled incrementals and labels S3 does not take as a tag value.  Only the labelled
+// object is tagged retain=true, an incremental's full backup and earlier incrementals would still expire and leave it
+// impossible to restore.
+func (r backupRequest) validate() error {
+	if r.Type != backupTypeFull && r.Type != backupTypeIncremental {
+		return errors.Errorf("invalid type %q.  Try full or incremental", r.Type)
+	}
+	if r.Label != "" && r.Type == backupTypeIncremental {
+		return errors.New("only full backups can be labelled, an incremental cannot be restored once its full backup expired")
+	}
+	if err := validTagValue(r.Label); err != nil {
+		return errors.Wrapf(err, "invalid label %q", r.Label)
+	}
+	return nil
+}
+
+// trigger is a backup requested over the control socket, the attempt is sent on done once it finished.
+type trigger struct {
+	request backupRequest
+	done    chan *Attempt
+}
+
+// serveControl accepts POST /backups on a unix socket and queues the requested backups on triggers.
+// The request is answered with the attempt as JSON once the backup finished.
+func serveControl(path string, triggers chan<- trigger) error {
+	// a socket left behind by a previous run makes listen fail.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove stale control socket %s", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on control socket %s", path)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return errors.Wrapf(err, "failed to restrict control socket %s", path)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var request backupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t := trigger{request: request, done: make(chan *Attempt, 1)}
+		select {
+		case triggers <- t:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case attempt := <-t.done:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(attempt)
+		case <-r.Context().Done():
+			log.Warnf("client stopped waiting for the triggered %s backup, it keeps running", request.Type)
+		}
+	})
+
+	log.Infof("listening for backup triggers on %s", path)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("control socket %s stopped: %v", path, err)
+		}
+	}()
+	return nil
+}
+
+// triggerBackup runs the trigger subcommand, it asks the running mysqlbackup for a backup and waits for it.
+func triggerBackup(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	backupDir := fs.String("backup_dir", defaultBackupDir, "MySQL backup directory of the running mysqlbackup")
+	socket := fs.String("control_socket", "", "control socket of the running mysqlbackup(default: <backup_dir>/"+controlSocketName+")")
+	backupType := fs.String("type", backupTypeFull, "type of backup to take: full or incremental")
+	label := fs.String("label", "", "label recorded with a full backup, labelled backups are exempt from retention")
+	timeout := fs.Duration("timeout", 0, "give up waiting after this long, the backup keeps running(default: wait until it completes)")
+	output := fs.String("output", outputTable, "output format: table prints the snapshot key, json prints the whole attempt")
+	fs.Parse(args)
+	if *socket == "" {
+		*socket = filepath.Join(*backupDir, controlSocketName)
+	}
+
+	request := backupRequest{Type: *backupType, Label: *label}
+	if err := request.validate(); err != nil {
+		return err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+	log.Infof("requesting a %s backup from the mysqlbackup listening on %s", *backupType, *socket)
+	resp, err := client.Post("http://mysqlbackup/backups", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to trigger backup, is mysqlbackup running?")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("mysqlbackup refused the backup: %s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var attempt Attempt
+	if err := json.NewDecoder(resp.Body).Decode(&attempt); err != nil {
+		return errors.Wrap(err, "failed to read the backup attempt")
+	}
+	if *output == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(attempt); err != nil {
+			return err
+		}
+	} else if attempt.Key != "" {
+		fmt.Println(attempt.Key)
+	}
+	if attempt.Status != statusSucceeded {
+		return errors.Errorf("%s backup failed: %s", attempt.Type, attempt.Error)
+	}
+	return nil
+}
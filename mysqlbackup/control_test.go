@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggerBackup(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "control")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	triggers := make(chan trigger)
+	socket := filepath.Join(dir, controlSocketName)
+	assert.NoError(serveControl(socket, triggers))
+
+	go func() {
+		for t := range triggers {
+			attempt := &Attempt{Type: t.request.Type, Label: t.request.Label, Status: statusSucceeded, Key: "dev/mysql/cluster_one/2019/5/snapshot_2019_05_01/full.tar"}
+			if t.request.Type == backupTypeIncremental {
+				attempt.Status, attempt.Error = statusFailed, "no full backup"
+			}
+			t.done <- attempt
+		}
+	}()
+	defer close(triggers)
+
+	assert.NoError(triggerBackup("trigger", []string{"-backup_dir", dir, "-type", "full", "-label", "pre-migration"}))
+	err = triggerBackup("trigger", []string{"-control_socket", socket, "-type", "incremental"})
+	assert.EqualError(err, "incremental backup failed: no full backup")
+	err = triggerBackup("trigger", []string{"-control_socket", socket, "-type", "incremental", "-label", "pre-migration"})
+	assert.Contains(err.Error(), "only full backups can be labelled")
+	err = triggerBackup("trigger", []string{"-control_socket", socket, "-type", "full", "-label", "pre&migration"})
+	assert.Contains(err.Error(), "invalid label")
+	err = triggerBackup("trigger", []string{"-control_socket", socket, "-type", "full", "-label", strings.Repeat("l", maxTagValue+1)})
+	assert.Contains(err.Error(), "invalid label")
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	for _, body := range []string{`{"type": "differential"}`, `{"type": "full", "label": "pre&migration"}`} {
+		resp, err := client.Post("http://mysqlbackup/backups", "application/json", strings.NewReader(body))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, body)
+	}
+}
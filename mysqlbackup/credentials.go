@@ -0,0 +1,25 @@
+package main
+
+import "bb.dev.norvax.net/dep/operator/backups/mysqlcli"
+
+// mysqlPassword reads the password from -mysql_password_file, falling back to MYSQL_PASSWORD.
+// The file is read for every backup so a rotated password is picked up without a restart.
+func mysqlPassword(backupConfig *Config) (string, error) {
+	if backupConfig.MysqlPasswordFile == "" {
+		return backupConfig.MysqlPassword, nil
+	}
+	return mysqlcli.ReadPassword(backupConfig.MysqlPasswordFile)
+}
+
+// mysqlCredentials returns the options innobackupex, mysql and mysqldump need to log in, they must come first on the
+// command line.  cleanup removes the temporary option file holding the password.
+func mysqlCredentials(backupConfig *Config) (args []string, cleanup func(), err error) {
+	if backupConfig.MysqlLoginPath != "" {
+		return []string{"--login-path=" + backupConfig.MysqlLoginPath}, func() {}, nil
+	}
+	password, err := mysqlPassword(backupConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mysqlcli.OptionFile(backupConfig.MysqlUser, password, "xtrabackup")
+}
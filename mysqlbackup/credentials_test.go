@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMysqlCredentials(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	assert.NoError(ioutil.WriteFile(passwordFile, []byte("p\"a\\ss\n"), 0600))
+	config := &Config{MysqlUser: "backup", MysqlPassword: "ignored", MysqlPasswordFile: passwordFile}
+
+	args, cleanup, err := mysqlCredentials(config)
+	assert.NoError(err)
+	assert.Len(args, 1)
+	optionFile := strings.TrimPrefix(args[0], "--defaults-extra-file=")
+	info, err := os.Stat(optionFile)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	content, err := ioutil.ReadFile(optionFile)
+	assert.NoError(err)
+	assert.Contains(string(content), "[client]\nuser=\"backup\"\npassword=\"p\\\"a\\\\ss\"\n")
+
+	cleanup()
+	_, err = os.Stat(optionFile)
+	assert.True(os.IsNotExist(err))
+
+	args, _, err = mysqlCredentials(&Config{MysqlLoginPath: "backups"})
+	assert.NoError(err)
+	assert.Equal([]string{"--login-path=backups"}, args)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/catalog"
+	"bb.dev.norvax.net/dep/operator/backups/checkpoints"
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/fakes3"
+	"bb.dev.norvax.net/dep/operator/backups/fakextrabackup"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/archive"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/restore"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/snapshots"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
+)
+
+// e2eConfig configures backups of cluster one in env qa to the bucket backups of server.
+func e2eConfig(t *testing.T, server *fakes3.Server) *Config {
+	dir, err := ioutil.TempDir("", "e2e")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	backupDir, s3Dir := filepath.Join(dir, "backups"), filepath.Join(dir, "s3")
+	require.NoError(t, os.MkdirAll(backupDir, 0700))
+	require.NoError(t, os.MkdirAll(s3Dir, 0700))
+	server.CreateBucket("backups")
+	return &Config{
+		BackupDir:          backupDir,
+		S3Dir:              s3Dir,
+		BackupEnv:          "qa",
+		Cluster:            "one",
+		Host:               "db1",
+		Bucketname:         "backups",
+		StorageClasses:     StorageClasses{Full: s3.StorageClassStandard, Incremental: s3.StorageClassStandardIa},
+		Engine:             engineXtrabackup,
+		Tuning:             tuning.Default(),
+		SkipPreflight:      true,
+		History:            newHistory(backupDir),
+		FailedBackupAction: failedBackupRemove,
+	}
+}
+
+// e2eRestore points the restore at the fake decompress script and returns the options that point mysqlrestore's
+// packages at server, so the archives the backups uploaded are listed, downloaded and prepared the way mysqlrestore does.
+func e2eRestore(t *testing.T, server *fakes3.Server, commands *fakextrabackup.Commands) execute.S3Options {
+	script := restore.DecompressScript
+	restore.DecompressScript = commands.DecompressScript
+	t.Cleanup(func() { restore.DecompressScript = script })
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		value, set := os.LookupEnv(env)
+		os.Setenv(env, "fake")
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(env, value)
+			} else {
+				os.Unsetenv(env)
+			}
+		})
+	}
+	return execute.S3Options{Endpoint: server.URL}
+}
+
+// latestUpload lists the snapshots of cluster one in env qa like mysqlrestore -operation list and returns the latest.
+func latestUpload(t *testing.T, store execute.S3Options) snapshots.SnapshotMeta {
+	list, latest, err := snapshots.ListSnapshots(context.Background(), store, "backups", snapshots.Ref{Env: "qa", Cluster: "one"})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, latest, list[0].Ref)
+	return list[0]
+}
+
+func tempRestoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "restore")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// nextSecond waits until backup directories named after the current time no longer collide with the last one.
+func nextSecond() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
+
+func TestBackupChain(t *testing.T) {
+	assert := require.New(t)
+	commands := fakextrabackup.Install(t)
+	server := fakes3.New()
+	defer server.Close()
+	config := e2eConfig(t, server)
+
+	full, err := executeBackup(server.Session(), config, backupRequest{})
+	assert.NoError(err)
+	assert.Equal(backupTypeFull, full.Type)
+	nextSecond()
+	incremental, err := executeBackup(server.Session(), config, backupRequest{})
+	assert.NoError(err)
+	assert.Equal(backupTypeIncremental, incremental.Type)
+	assert.Equal(full.Snapshot, incremental.Snapshot)
+	assert.Contains(commands.Calls()[1], "--incremental-basedir="+full.Dir)
+
+	keys := server.Keys("backups", "qa/mysql/cluster_one/")
+	assert.Equal([]string{full.Key, incremental.Key, catalog.Key("qa", "one")}, keys)
+	for _, key := range []string{full.Key, incremental.Key} {
+		ref, archive, err := snapshots.RefFromKey(key)
+		assert.NoError(err, key)
+		assert.Equal(full.Snapshot, ref.Name)
+		assert.True(strings.HasSuffix(archive, ".tar"), archive)
+	}
+	object, ok := server.Object("backups", incremental.Key)
+	assert.True(ok)
+	assert.Equal(s3.StorageClassStandardIa, object.StorageClass)
+	assert.Equal("incremental", object.Tags["type"])
+	assert.Equal("one", object.Tags["cluster"])
+	assert.Equal("1000", object.Metadata["from-lsn"])
+	assert.Equal("2000", object.Metadata["to-lsn"])
+
+	cat, _, err := catalog.Read(context.Background(), server.Client(), "backups", catalog.Key("qa", "one"))
+	assert.NoError(err)
+	assert.Len(cat.Entries, 2)
+	assert.False(cat.Since.IsZero(), "a catalog created by a backup records when it was created")
+	assert.Equal(full.Key, cat.Entries[0].Key)
+	assert.Equal(uint64(1000), cat.Entries[0].ToLSN)
+	assert.Equal(uint64(2000), cat.Entries[1].ToLSN)
+
+	store := e2eRestore(t, server, commands)
+	snapshot := latestUpload(t, store)
+	assert.Equal(full.Snapshot, snapshot.Ref.Name)
+	assert.Len(snapshot.Full, 1)
+	assert.Equal(full.Key, snapshot.Full[0].Key)
+	assert.Len(snapshot.Incrementals, 1)
+	fullDir, err := restore.PrepareSnapshot(context.Background(), &archive.S3Retriever{S3: store, Bucket: "backups", Snapshot: snapshot.Ref}, tempRestoreDir(t), true, tuning.Default(), encryption.Options{})
+	assert.NoError(err)
+	cp, err := checkpoints.Read(fullDir)
+	assert.NoError(err)
+	assert.Equal(checkpoints.TypePrepared, cp.BackupType)
+	assert.Equal(incremental.ToLSN, cp.ToLSN)
+	assert.FileExists(filepath.Join(fullDir, "app", "orders.cfg"))
+}
+
+func TestEncryptedBackupChain(t *testing.T) {
+	assert := require.New(t)
+	commands := fakextrabackup.Install(t)
+	server := fakes3.New()
+	defer server.Close()
+	config := e2eConfig(t, server)
+	keyFile := filepath.Join(config.BackupDir, "backup.key")
+	assert.NoError(ioutil.WriteFile(keyFile, []byte(strings.Repeat("k", encryption.KeySize)), 0600))
+	config.Encryption = encryption.Options{KeyFile: keyFile, Threads: 2}
+
+	full, err := executeBackup(server.Session(), config, backupRequest{Type: backupTypeFull})
+	assert.NoError(err)
+	encrypted, err := encryption.Encrypted(full.Dir)
+	assert.NoError(err)
+	assert.True(encrypted)
+	nextSecond()
+	incremental, err := executeBackup(server.Session(), config, backupRequest{Type: backupTypeIncremental})
+	assert.NoError(err)
+	assert.Equal(uint64(2000), incremental.ToLSN)
+
+	store := e2eRestore(t, server, commands)
+	retriever := &archive.S3Retriever{S3: store, Bucket: "backups", Snapshot: latestUpload(t, store).Ref}
+	_, err = restore.PrepareSnapshot(context.Background(), retriever, tempRestoreDir(t), false, tuning.Default(), encryption.Options{})
+	assert.Equal(encryption.ErrKeyRequired, errors.Cause(err))
+	fullDir, err := restore.PrepareSnapshot(context.Background(), retriever, tempRestoreDir(t), false, tuning.Default(), encryption.Options{KeyFile: keyFile})
+	assert.NoError(err)
+	cp, err := checkpoints.Read(fullDir)
+	assert.NoError(err)
+	assert.Equal(incremental.ToLSN, cp.ToLSN)
+}
+
+func TestArchivedBackupChain(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	commands := fakextrabackup.Install(t)
+	server := fakes3.New()
+	defer server.Close()
+	server.PendingRestores = true
+	config := e2eConfig(t, server)
+	config.StorageClasses = StorageClasses{Full: s3.StorageClassGlacier, Incremental: s3.StorageClassGlacier}
+
+	_, err := executeBackup(server.Session(), config, backupRequest{Type: backupTypeFull})
+	assert.NoError(err)
+	nextSecond()
+	_, err = executeBackup(server.Session(), config, backupRequest{Type: backupTypeIncremental})
+	assert.NoError(err)
+
+	store := e2eRestore(t, server, commands)
+	retriever := &archive.S3Retriever{S3: store, Bucket: "backups", Snapshot: latestUpload(t, store).Ref}
+	_, err = restore.PrepareSnapshot(ctx, retriever, tempRestoreDir(t), false, tuning.Default(), encryption.Options{})
+	assert.Equal(archive.ErrThawPending, errors.Cause(err))
+	status, err := retriever.Thaw(ctx)
+	assert.NoError(err)
+	assert.Equal(archive.ThawStatus{Archives: 2, Archived: 2, Pending: 2}, status)
+	assert.Equal(2, server.Requests("RestoreObject"))
+
+	server.CompleteRestores()
+	_, err = restore.PrepareSnapshot(ctx, retriever, tempRestoreDir(t), false, tuning.Default(), encryption.Options{})
+	assert.NoError(err)
+}
+
+func TestFailedBackup(t *testing.T) {
+	assert := require.New(t)
+	fakextrabackup.Install(t)
+	server := fakes3.New()
+	defer server.Close()
+	config := e2eConfig(t, server)
+	os.Setenv(fakextrabackup.FailEnv, "1")
+	defer os.Unsetenv(fakextrabackup.FailEnv)
+
+	attempt, err := executeBackup(server.Session(), config, backupRequest{})
+	assert.Error(err)
+	assert.Equal("removed", attempt.Cleanup)
+	assert.NoDirExists(attempt.Dir)
+	assert.Empty(server.Keys("backups", ""))
+	assert.Equal(0, server.Requests("PutObject"))
+
+	config.RetryInterval = time.Hour
+	attempt, err = executeBackup(server.Session(), config, backupRequest{})
+	assert.NoError(err)
+	assert.Nil(attempt)
+	assert.Contains(config.skipped, "-retry_interval 1h0m0s")
+}
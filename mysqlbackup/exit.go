@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+// Exit codes returned by mysqlbackup run-once, documented in the README for cron and CronJob alerting.
+const (
+	exitOK              = 0
+	exitFailure         = 1
+	exitUsage           = 2
+	exitPreflightFailed = 3
+	exitSkipped         = 4
+)
+
+func exitCode(err error) int {
+	switch errors.Cause(err) {
+	case nil:
+		return exitOK
+	case preflight.ErrInsufficientSpace, preflight.ErrMissingCommand:
+		return exitPreflightFailed
+	case ErrReplicaUnhealthy:
+		return exitSkipped
+	default:
+		return exitFailure
+	}
+}
+
+// configError is a configuration that failed to load although its flags are valid, e.g. an unreadable password file.
+type configError struct {
+	error
+}
+
+// configExitCode is the exit code of a configuration that failed to load: exitUsage for invalid flags and missing
+// environment variables, exitFailure for everything else.
+func configExitCode(err error) int {
+	if _, ok := errors.Cause(err).(configError); ok {
+		return exitFailure
+	}
+	return exitUsage
+}
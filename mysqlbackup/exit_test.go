@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+func TestExitCode(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal(exitOK, exitCode(nil))
+	assert.Equal(exitPreflightFailed, exitCode(errors.Wrap(preflight.ErrInsufficientSpace, "backup_dir")))
+	assert.Equal(exitSkipped, exitCode(errors.Wrap(ErrReplicaUnhealthy, "lag")))
+	assert.Equal(exitFailure, exitCode(errors.New("upload failed")))
+
+	assert.Equal(exitUsage, configExitCode(errors.New("env flag is not set and it is a required flag")))
+	_, err := getBackupConfig([]string{"-env", "qa", "-cluster", "one", "-bucket_name", "backups", "-mysql_password_file", "/nonexistent/password"})
+	assert.Error(err)
+	assert.Equal(exitFailure, configExitCode(err), "an unreadable password file is not a usage error")
+	assert.Equal(exitFailure, configExitCode(configError{os.ErrPermission}))
+}
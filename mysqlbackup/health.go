@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	healthActionSkip  = "skip"
+	healthActionDefer = "defer"
+)
+
+// ErrReplicaUnhealthy is returned when the health gate skipped a backup, the attempt is recorded as skipped.
+var ErrReplicaUnhealthy = errors.New("replica unhealthy")
+
+// HealthGate checks the server before every backup so backups are not taken from a broken or lagging replica.
+// An unhealthy server skips the backup, or with Action defer is checked again every RetryInterval for up to MaxDefer.
+type HealthGate struct {
+	Enabled        bool
+	RequireReplica bool
+	// MaxLag is the highest Seconds_Behind_Master a backup is taken at, 0 does not check the lag.
+	MaxLag        time.Duration
+	Action        string
+	RetryInterval time.Duration
+	MaxDefer      time.Duration
+	// MetricsFile is written in the Prometheus text format after every check, e.g. for the node_exporter textfile collector.
+	MetricsFile string
+
+	// skipUntil stops the daemon from checking again every second after a scheduled backup was skipped.
+	skipUntil time.Time
+	skipped   int
+}
+
+// ReplicaHealth is the replication state reported by SHOW SLAVE STATUS.
+type ReplicaHealth struct {
+	Replica        bool
+	ThreadsRunning bool
+	// Lag is the highest Seconds_Behind_Master of all channels, LagKnown is false when any of them is NULL.
+	Lag      time.Duration
+	LagKnown bool
+}
+
+// parseSlaveStatus reads the tab separated output of SHOW SLAVE STATUS with column names, one row per channel.
+func parseSlaveStatus(out string) (ReplicaHealth, error) {
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) < 2 {
+		return ReplicaHealth{}, nil
+	}
+	columns := strings.Split(lines[0], "\t")
+	health := ReplicaHealth{Replica: true, ThreadsRunning: true, LagKnown: true}
+	for _, line := range lines[1:] {
+		values := strings.Split(line, "\t")
+		if len(values) != len(columns) {
+			return ReplicaHealth{}, errors.Errorf("unexpected SHOW SLAVE STATUS row with %d columns instead of %d", len(values), len(columns))
+		}
+		row := map[string]string{}
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+		if row["Slave_IO_Running"] != "Yes" || row["Slave_SQL_Running"] != "Yes" {
+			health.ThreadsRunning = false
+		}
+		seconds, err := strconv.ParseInt(row["Seconds_Behind_Master"], 10, 64)
+		if err != nil {
+			health.LagKnown = false
+			continue
+		}
+		if lag := time.Duration(seconds) * time.Second; lag > health.Lag {
+			health.Lag = lag
+		}
+	}
+	return health, nil
+}
+
+// problems lists why a backup must not be taken, it is empty for a healthy server.
+func (g *HealthGate) problems(health ReplicaHealth) []string {
+	if !health.Replica {
+		if g.RequireReplica {
+			return []string{"the server is not a replica"}
+		}
+		return nil
+	}
+	var problems []string
+	if !health.ThreadsRunning {
+		problems = append(problems, "replication threads are not running")
+	}
+	if g.MaxLag > 0 {
+		if !health.LagKnown {
+			problems = append(problems, "the replication lag is unknown")
+		} else if health.Lag > g.MaxLag {
+			problems = append(problems, fmt.Sprintf("the replica is %v behind its master, more than %v", health.Lag, g.MaxLag))
+		}
+	}
+	return problems
+}
+
+// checkHealth returns ErrReplicaUnhealthy when the server is unhealthy, after deferring the backup when configured to.
+// Errors running the check fail the backup instead of skipping it.
+func checkHealth(credentials []string, backupConfig *Config) error {
+	gate := backupConfig.Health
+	if gate == nil || !gate.Enabled {
+		return nil
+	}
+	client := append(credentials, backupConfig.Connection.Args()...)
+	deadline := time.Now().Add(gate.MaxDefer)
+	for {
+		out, err := runMysql(client, "--batch", "--execute=SHOW SLAVE STATUS")
+		if err != nil {
+			return errors.Wrap(err, "health check failed")
+		}
+		health, err := parseSlaveStatus(out)
+		if err != nil {
+			return errors.Wrap(err, "health check failed")
+		}
+
+		problems := gate.problems(health)
+		if len(problems) == 0 {
+			log.Infof("health check passed, replica: %t, lag: %v", health.Replica, health.Lag)
+			gate.writeMetrics(health, true)
+			return nil
+		}
+		reason := strings.Join(problems, ", ")
+		if gate.Action != healthActionDefer || time.Now().Add(gate.RetryInterval).After(deadline) {
+			gate.skipped++
+			gate.skipUntil = time.Now().Add(gate.RetryInterval)
+			gate.writeMetrics(health, false)
+			return errors.Wrap(ErrReplicaUnhealthy, reason)
+		}
+		log.Warnf("deferring backup for %v, %s", gate.RetryInterval, reason)
+		gate.writeMetrics(health, false)
+		time.Sleep(gate.RetryInterval)
+	}
+}
+
+// writeMetrics replaces the metrics file, a failure is logged and never fails a backup.
+func (g *HealthGate) writeMetrics(health ReplicaHealth, healthy bool) {
+	if g.MetricsFile == "" {
+		return
+	}
+	lag := -1.0
+	if health.Replica && health.LagKnown {
+		lag = health.Lag.Seconds()
+	}
+	var metrics strings.Builder
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&metrics, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	gauge("mysqlbackup_replica_healthy", "Whether the last health check allowed a backup.", boolMetric(healthy))
+	gauge("mysqlbackup_replica_threads_running", "Whether both replication threads were running at the last health check.", boolMetric(health.Replica && health.ThreadsRunning))
+	gauge("mysqlbackup_replica_lag_seconds", "Seconds_Behind_Master at the last health check, -1 when unknown or not a replica.", lag)
+	gauge("mysqlbackup_health_check_timestamp_seconds", "Unix time of the last health check.", float64(time.Now().Unix()))
+	fmt.Fprintf(&metrics, "# HELP mysqlbackup_backups_skipped_total Backups skipped by the health gate since mysqlbackup started.\n")
+	fmt.Fprintf(&metrics, "# TYPE mysqlbackup_backups_skipped_total counter\nmysqlbackup_backups_skipped_total %d\n", g.skipped)
+
+	tmp := g.MetricsFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(metrics.String()), 0644); err != nil {
+		log.Errorf("failed to write metrics file %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, g.MetricsFile); err != nil {
+		log.Errorf("failed to replace metrics file %s: %v", g.MetricsFile, err)
+	}
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
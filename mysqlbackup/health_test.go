@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlaveStatus(t *testing.T) {
+	assert := require.New(t)
+
+	health, err := parseSlaveStatus("")
+	assert.NoError(err)
+	assert.False(health.Replica)
+
+	out := "Master_Host\tSlave_IO_Running\tSlave_SQL_Running\tSeconds_Behind_Master\n" +
+		"db1\tYes\tYes\t42\n" +
+		"db2\tYes\tYes\t7\n"
+	health, err = parseSlaveStatus(out)
+	assert.NoError(err)
+	assert.Equal(ReplicaHealth{Replica: true, ThreadsRunning: true, Lag: 42 * time.Second, LagKnown: true}, health)
+
+	health, err = parseSlaveStatus("Slave_IO_Running\tSlave_SQL_Running\tSeconds_Behind_Master\nConnecting\tYes\tNULL\n")
+	assert.NoError(err)
+	assert.False(health.ThreadsRunning)
+	assert.False(health.LagKnown)
+
+	_, err = parseSlaveStatus("Slave_IO_Running\tSlave_SQL_Running\nYes\n")
+	assert.Error(err)
+}
+
+func TestHealthGateProblems(t *testing.T) {
+	assert := require.New(t)
+	gate := &HealthGate{Enabled: true, MaxLag: time.Minute}
+
+	assert.Empty(gate.problems(ReplicaHealth{}))
+	assert.Empty(gate.problems(ReplicaHealth{Replica: true, ThreadsRunning: true, Lag: time.Second, LagKnown: true}))
+	assert.Len(gate.problems(ReplicaHealth{Replica: true, ThreadsRunning: true, Lag: time.Hour, LagKnown: true}), 1)
+	assert.Len(gate.problems(ReplicaHealth{Replica: true}), 2)
+
+	gate.RequireReplica = true
+	assert.Equal([]string{"the server is not a replica"}, gate.problems(ReplicaHealth{}))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+const (
+	backupTypeFull        = "full"
+	backupTypeIncremental = "incremental"
+
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	// statusSkipped attempts were not taken because the health gate found the server unhealthy.
+	statusSkipped = "skipped"
+
+	historyFileName = "history.jsonl"
+	// defaultHistoryEntries is how many attempts are kept, a backup failing every second would otherwise fill the disk.
+	defaultHistoryEntries = 1000
+)
+
+// Attempt is a single backup attempt as recorded in the history file.
+type Attempt struct {
+	Type     string    `json:"type"`
+	Status   string    `json:"status"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Dir      string    `json:"dir,omitempty"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	FromLSN  uint64    `json:"from_lsn,omitempty"`
+	ToLSN    uint64    `json:"to_lsn,omitempty"`
+	// Tier is monthly for the month's first full backup, full or incremental otherwise, StorageClass follows from it.
+	Tier         string `json:"tier,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// Label is set on backups triggered with a label, they are exempt from retention.
+	Label string `json:"label,omitempty"`
+	// Cleanup tells what happened to the directory of a failed backup: removed or quarantined to <dir>.
+	Cleanup string `json:"cleanup,omitempty"`
+}
+
+func (a Attempt) Duration() time.Duration {
+	return a.End.Sub(a.Start)
+}
+
+// History is the JSON lines file every backup attempt is appended to.
+// It is trimmed to the last MaxEntries attempts once it holds twice as many.
+type History struct {
+	Path       string
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries int
+	counted bool
+}
+
+func newHistory(backupDir string) *History {
+	return &History{Path: filepath.Join(backupDir, historyFileName), MaxEntries: defaultHistoryEntries}
+}
+
+// Append records an attempt.
+func (h *History) Append(attempt Attempt) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.counted {
+		attempts, err := h.Read()
+		if err != nil {
+			return err
+		}
+		h.entries, h.counted = len(attempts), true
+	}
+
+	line, err := json.Marshal(attempt)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode backup attempt")
+	}
+	f, err := os.OpenFile(h.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open history file %s", h.Path)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write history file %s", h.Path)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close history file %s", h.Path)
+	}
+	h.entries++
+
+	if h.MaxEntries > 0 && h.entries > 2*h.MaxEntries {
+		return h.trim()
+	}
+	return nil
+}
+
+func (h *History) trim() error {
+	attempts, err := h.Read()
+	if err != nil {
+		return err
+	}
+	attempts = attempts[len(attempts)-h.MaxEntries:]
+
+	tmp, err := ioutil.TempFile(filepath.Dir(h.Path), historyFileName)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary history file")
+	}
+	defer os.Remove(tmp.Name())
+	encoder := json.NewEncoder(tmp)
+	for _, attempt := range attempts {
+		if err := encoder.Encode(attempt); err != nil {
+			tmp.Close()
+			return errors.Wrap(err, "failed to write temporary history file")
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temporary history file")
+	}
+	if err := os.Rename(tmp.Name(), h.Path); err != nil {
+		return errors.Wrapf(err, "failed to replace history file %s", h.Path)
+	}
+	h.entries = len(attempts)
+	return nil
+}
+
+// Read returns every recorded attempt, oldest first.  A missing file is an empty history.
+func (h *History) Read() ([]Attempt, error) {
+	f, err := os.Open(h.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open history file %s", h.Path)
+	}
+	defer f.Close()
+
+	var attempts []Attempt
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var attempt Attempt
+		if err := json.Unmarshal(scanner.Bytes(), &attempt); err != nil {
+			log.Warnf("skipping line %d of history file %s: %v", line, h.Path, err)
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, errors.Wrapf(scanner.Err(), "failed to read history file %s", h.Path)
+}
+
+// Status summarizes the history for the status subcommand.
+type Status struct {
+	LastAttempt          *Attempt `json:"last_attempt,omitempty"`
+	LastFull             *Attempt `json:"last_full,omitempty"`
+	LastIncremental      *Attempt `json:"last_incremental,omitempty"`
+	FailuresSinceSuccess int      `json:"failures_since_success"`
+	SuccessesLastDay     int      `json:"successes_last_24h"`
+}
+
+func summarize(attempts []Attempt, now time.Time) Status {
+	var status Status
+	for i := len(attempts) - 1; i >= 0; i-- {
+		a := attempts[i]
+		if status.LastAttempt == nil {
+			status.LastAttempt = &attempts[i]
+		}
+		if a.Status == statusSucceeded {
+			if a.Type == backupTypeFull && status.LastFull == nil {
+				status.LastFull = &attempts[i]
+			}
+			if a.Type == backupTypeIncremental && status.LastIncremental == nil {
+				status.LastIncremental = &attempts[i]
+			}
+			if now.Sub(a.End) <= 24*time.Hour {
+				status.SuccessesLastDay++
+			}
+		}
+	}
+	for i := len(attempts) - 1; i >= 0 && attempts[i].Status != statusSucceeded; i-- {
+		if attempts[i].Status == statusFailed {
+			status.FailuresSinceSuccess++
+		}
+	}
+	return status
+}
+
+func writeStatus(w io.Writer, output string, status Status) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	describe := func(name string, a *Attempt) {
+		if a == nil {
+			fmt.Fprintf(table, "%s:\tnone\n", name)
+			return
+		}
+		fmt.Fprintf(table, "%s:\t%s %s at %s (%s ago)\n", name, a.Type, a.Status,
+			a.End.Format(time.RFC3339), time.Since(a.End).Round(time.Second))
+	}
+	describe("last attempt", status.LastAttempt)
+	if status.LastAttempt != nil && status.LastAttempt.Error != "" {
+		fmt.Fprintf(table, "last error:\t%s\n", firstLine(status.LastAttempt.Error))
+	}
+	describe("last full backup", status.LastFull)
+	describe("last incremental", status.LastIncremental)
+	fmt.Fprintf(table, "failures since last success:\t%d\n", status.FailuresSinceSuccess)
+	fmt.Fprintf(table, "successful backups in 24h:\t%d\n", status.SuccessesLastDay)
+	return table.Flush()
+}
+
+func writeHistory(w io.Writer, output string, attempts []Attempt) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if attempts == nil {
+			attempts = []Attempt{}
+		}
+		return encoder.Encode(attempts)
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "START\tTYPE\tSTATUS\tDURATION\tSIZE\tLABEL\tKEY\tERROR")
+	for _, a := range attempts {
+		size := "-"
+		if a.Size > 0 {
+			size = preflight.FormatBytes(a.Size)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Start.Format(time.RFC3339), a.Type, a.Status,
+			a.Duration().Round(time.Second), size, orDash(a.Label), orDash(a.Key), orDash(firstLine(a.Error)))
+	}
+	return table.Flush()
+}
+
+// firstLine keeps multi line errors such as innobackupex stderr from breaking the table.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + " ..."
+	}
+	return s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "history")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	history := newHistory(dir)
+	history.MaxEntries = 3
+	start := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	attempts := []Attempt{
+		{Type: backupTypeFull, Status: statusSucceeded, Key: "full"},
+		{Type: backupTypeIncremental, Status: statusSucceeded, Key: "incremental"},
+		{Type: backupTypeIncremental, Status: statusFailed, Error: "innobackupex failed"},
+		{Type: backupTypeIncremental, Status: statusFailed, Error: "innobackupex failed"},
+		{Type: backupTypeIncremental, Status: statusFailed, Error: "innobackupex failed"},
+		{Type: backupTypeIncremental, Status: statusFailed, Error: "innobackupex failed"},
+		{Type: backupTypeIncremental, Status: statusFailed, Error: "innobackupex failed"},
+	}
+	for i, attempt := range attempts {
+		attempt.Start = start.Add(time.Duration(i) * time.Hour)
+		attempt.End = attempt.Start.Add(time.Minute)
+		assert.NoError(history.Append(attempt))
+	}
+
+	recorded, err := newHistory(dir).Read()
+	assert.NoError(err)
+	assert.Len(recorded, 3, "history is trimmed to MaxEntries once it holds twice as many")
+	assert.Equal(start.Add(4*time.Hour), recorded[0].Start)
+
+	recorded = append([]Attempt{{Type: backupTypeFull, Status: statusSucceeded, End: start.Add(time.Hour)}}, recorded...)
+	status := summarize(recorded, start.Add(7*time.Hour))
+	assert.Equal(3, status.FailuresSinceSuccess)
+	assert.Equal(1, status.SuccessesLastDay)
+	assert.Nil(status.LastIncremental)
+	assert.Equal(start.Add(time.Hour), status.LastFull.End)
+	assert.Equal(statusFailed, status.LastAttempt.Status)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+const (
+	engineXtrabackup = "xtrabackup"
+	engineMysqldump  = "mysqldump"
+
+	// logical dumps are always complete, there are no logical incrementals.
+	backupTypeLogical = "logical"
+
+	// dumpSuffix names the per database dump files, mysqlrestore's logical-restore loads every file with it.
+	dumpSuffix = ".sql.gz"
+)
+
+// databasesQuery lists the databases a logical backup dumps.  The mysql schema is skipped, users and grants of managed
+// instances cannot be restored with a dump and are managed outside of the database.
+const databasesQuery = `SELECT schema_name FROM information_schema.schemata
+WHERE schema_name NOT IN ('information_schema', 'performance_schema', 'sys', 'mysql') ORDER BY schema_name`
+
+// logicalBackup dumps every database to its own compressed file with mysqldump, -dump_parallel at a time, and
+// archives the directory to S3 the same way innobackupex backups are.
+// Each database is dumped in a single transaction, so it is consistent on its own but not with the other databases.
+func logicalBackup(backupDir string, folderTime string, s3Session *session.Session, backupConfig *Config, attempt *Attempt) error {
+	log.Infof("Creating logical backup in directory: %s", backupDir)
+	log.Infof("Snapshot name: snapshot_%s", backupConfig.SnapshotTime)
+	attempt.Dir = backupDir
+
+	credentials, cleanup, err := mysqlCredentials(backupConfig)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := preflightBackup(backupDir, "", credentials, backupConfig); err != nil {
+		return err
+	}
+	if err := checkHealth(credentials, backupConfig); err != nil {
+		return err
+	}
+	if err := markInProgress(attempt); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return err
+	}
+
+	client := append(credentials, backupConfig.Connection.Args()...)
+	out, err := mysqlQuery(client, databasesQuery)
+	if err != nil {
+		return errors.Wrap(err, "failed to list databases")
+	}
+	databases := strings.Fields(out)
+	if len(databases) == 0 {
+		return errors.New("there are no databases to back up")
+	}
+
+	group, ctx := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, backupConfig.DumpParallel)
+	for _, database := range databases {
+		database := database
+		group.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			return dumpDatabase(ctx, client, database, backupDir, backupConfig.DumpOptions)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	err = archiveBackupToS3(backupDir, backupTypeLogical, folderTime, s3Session, backupConfig, attempt)
+	if err != nil {
+		return errors.Wrapf(err, "failed to archive backup %s to s3 bucket", backupDir)
+	}
+	// The marker makes the next backup of the day start a new snapshot instead of adding its dumps to this one.
+	if err := writeMarker(backupDir, backupConfig, attempt); err != nil {
+		return err
+	}
+	log.Infof("successfully created logical backup of %d databases in directory: %s", len(databases), backupDir)
+	return nil
+}
+
+// dumpDatabase writes database to <backupDir>/<database>.sql.gz, the file only appears once the dump completed.
+func dumpDatabase(ctx context.Context, client []string, database, backupDir string, options []string) (err error) {
+	path := filepath.Join(backupDir, database+dumpSuffix)
+	tmp := path + ".partial"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create dump file %s", tmp)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	cmdLine := append([]string{"mysqldump"}, client...)
+	cmdLine = append(cmdLine, "--single-transaction", "--routines", "--triggers", "--events")
+	cmdLine = append(cmdLine, options...)
+	cmdLine = append(cmdLine, "--databases", database)
+	log.Infof("Executing command: %s", redact.Command(cmdLine))
+
+	compressed := gzip.NewWriter(f)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+	cmd.Stdout = compressed
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "cmd failed %s, stderr: %s", redact.Command(cmdLine), stderr.String())
+	}
+	if err := compressed.Close(); err != nil {
+		return errors.Wrapf(err, "failed to compress dump of %s", database)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync %s", tmp)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "failed to rename %s", tmp)
+}
+
+// mysqlQuery runs query with the mysql client and returns its tab separated output without column names.
+func mysqlQuery(client []string, query string) (string, error) {
+	return runMysql(client, "--batch", "--skip-column-names", "--execute="+query)
+}
+
+func runMysql(client []string, options ...string) (string, error) {
+	cmdLine := append([]string{"mysql"}, client...)
+	cmdLine = append(cmdLine, options...)
+	log.Debugf("executing command: %s", redact.Command(cmdLine))
+	var stderr bytes.Buffer
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "cmd failed %s, stderr: %s", redact.Command(cmdLine), stderr.String())
+	}
+	return string(out), nil
+}
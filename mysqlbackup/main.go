@@ -1,21 +1,34 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlcli"
+	"bb.dev.norvax.net/dep/operator/backups/notify"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
 )
 
 const (
-	dateFormat     = "2006_01_02_15_04_05Z"
-	snapshotFormat = "2006_01_02"
+	dateFormat       = "2006_01_02_15_04_05Z"
+	snapshotFormat   = "2006_01_02"
+	defaultBackupDir = "/opt/mysql_backups"
+
+	outputTable = "table"
+	outputJSON  = "json"
 )
 
 func init() {
@@ -23,6 +36,8 @@ func init() {
 		DisableColors: true,
 		FullTimestamp: true,
 	})
+	log.AddHook(redact.Hook{})
+	redact.AddSecret(os.Getenv("SMTP_PASSWORD"))
 }
 
 func getOrCreateDayBackupDir(backupConfig *Config) (string, string, error) {
@@ -39,6 +54,29 @@ func getOrCreateDayBackupDir(backupConfig *Config) (string, string, error) {
 	return dayBackupDir, folderTime, nil
 }
 
+// newSnapshotTime names the snapshot of a full backup after the day, or after the time when the day already holds a
+// backup, so every snapshot in S3 holds a single chain.  Any backup directory counts, not only completed ones: backups
+// taken before completion markers existed have none, although they were uploaded under the day's snapshot.
+func newSnapshotTime(dayBackupDir string) string {
+	now := time.Now().UTC()
+	files, _ := ioutil.ReadDir(dayBackupDir)
+	for _, fi := range files {
+		if fi.IsDir() {
+			return now.Format(dateFormat)
+		}
+	}
+	return now.Format(snapshotFormat)
+}
+
+// snapshotDate is the day a snapshot was started, parsed from its snapshot time.
+func snapshotDate(snapshotTime string) (time.Time, error) {
+	if len(snapshotTime) < len(snapshotFormat) {
+		return time.Time{}, errors.Errorf("invalid snapshot time %q", snapshotTime)
+	}
+	date, err := time.Parse(snapshotFormat, snapshotTime[:len(snapshotFormat)])
+	return date, errors.Wrapf(err, "invalid snapshot time %q", snapshotTime)
+}
+
 func doesFullBackupDirExist(backupDir string) bool {
 	files, err := ioutil.ReadDir(backupDir)
 	if err != nil {
@@ -53,71 +91,320 @@ func doesFullBackupDirExist(backupDir string) bool {
 	return false
 }
 
-func executeBackup(s3Session *session.Session, backupConfig *Config) {
+// executeBackup takes the scheduled backup, or the requested one, and returns its attempt.
+// The attempt is nil when no backup was due, backupConfig.skipped holds why.  The error is the reason the attempt failed.
+func executeBackup(s3Session *session.Session, backupConfig *Config, request backupRequest) (*Attempt, error) {
+	backupConfig.skipped = ""
+	if request.Type == "" && backupConfig.Health != nil && time.Now().Before(backupConfig.Health.skipUntil) {
+		backupConfig.skipped = fmt.Sprintf("the replica was unhealthy, it is checked again after %s", backupConfig.Health.skipUntil.Format(time.RFC3339))
+		return nil, nil
+	}
+	if request.Type == "" && time.Since(backupConfig.lastFailure) < backupConfig.RetryInterval {
+		backupConfig.skipped = fmt.Sprintf("the last backup failed, it is retried after -retry_interval %v", backupConfig.RetryInterval)
+		return nil, nil
+	}
+	attempt := &Attempt{Start: time.Now().UTC(), Label: request.Label}
 	backupDir, folderTime, err := getOrCreateDayBackupDir(backupConfig)
 
 	if err != nil {
 		log.Errorf("creating a backup failed: %+v\n", err)
-		return
+		finishAttempt(backupConfig, attempt, "creating the backup directory failed", err)
+		return attempt, err
+	}
+
+	full := request.Type == backupTypeFull
+	var chain backupChain
+	var chainErr error
+	if backupConfig.Engine == engineMysqldump {
+		full = full || request.Type == "" && !doesFullBackupDirExist(backupDir)
+	} else if !full {
+		chain, chainErr = findChain(backupDir)
+		if chainErr != nil && request.Type == "" {
+			// A failed backup is not retried before the incremental interval passed, whatever broke the chain.
+			if chain.Latest != "" {
+				if due, err := incrementalBackupTimeCheck(chain.Latest, backupConfig.IncrementalInterval); err == nil && !due {
+					backupConfig.skipped = fmt.Sprintf("the last backup failed, it is retried once the last incremental backup is %v old", backupConfig.IncrementalInterval)
+					return nil, nil
+				}
+				log.Warnf("falling back to a full backup: %v", chainErr)
+			}
+			full = true
+		}
 	}
 
-	if !doesFullBackupDirExist(backupDir) {
-		backupConfig.SnapshotTime = time.Now().UTC().Format(snapshotFormat)
+	if full {
+		backupConfig.SnapshotTime = newSnapshotTime(backupDir)
 		fullBackupdir := filepath.Join(backupDir, time.Now().UTC().Format(dateFormat))
-		if err := fullBackup(fullBackupdir, folderTime, s3Session, backupConfig); err != nil {
-			log.Errorf("full backup failed for %s: %+v", fullBackupdir, err)
+		attempt.Type = backupTypeFull
+		backup := fullBackup
+		if backupConfig.Engine == engineMysqldump {
+			attempt.Type = backupTypeLogical
+			backup = logicalBackup
 		}
-		return
+		err := backup(fullBackupdir, folderTime, s3Session, backupConfig, attempt)
+		if err != nil && errors.Cause(err) != ErrReplicaUnhealthy {
+			log.Errorf("%s backup failed for %s: %+v", attempt.Type, fullBackupdir, err)
+		}
+		finishAttempt(backupConfig, attempt, attempt.Type+" backup of "+fullBackupdir, err)
+		return attempt, err
+	}
+
+	if backupConfig.Engine == engineMysqldump {
+		if request.Type != backupTypeIncremental {
+			return nil, nil
+		}
+		attempt.Type = backupTypeIncremental
+		err := errors.New("mysqldump backups have no incrementals, trigger a full backup instead")
+		finishAttempt(backupConfig, attempt, "incremental backup in "+backupDir, err)
+		return attempt, err
 	}
 
-	if err := incrementalBackup(backupDir, folderTime, backupConfig.IncrementalInterval, s3Session, backupConfig); err != nil {
+	attempt.Type = backupTypeIncremental
+	interval := backupConfig.IncrementalInterval
+	if request.Type == backupTypeIncremental {
+		if chainErr != nil {
+			err := errors.Wrapf(chainErr, "there is no complete backup in %s to base an incremental backup on", backupDir)
+			finishAttempt(backupConfig, attempt, "incremental backup in "+backupDir, err)
+			return attempt, err
+		}
+		interval = 0
+	}
+	backupConfig.SnapshotTime = chain.SnapshotTime
+	taken, err := incrementalBackup(backupDir, chain, folderTime, interval, s3Session, backupConfig, attempt)
+	if err != nil && errors.Cause(err) != ErrReplicaUnhealthy {
 		log.Errorf("incremental backup failed for %s: %+v", backupDir, err)
+	}
+	if !taken && err == nil {
+		return nil, nil
+	}
+	finishAttempt(backupConfig, attempt, "incremental backup in "+backupDir, err)
+	return attempt, err
+}
+
+// finishAttempt records the outcome of a backup attempt in the history and notifies it.
+// The directory of a failed backup is removed or quarantined first, so the history records what happened to it.
+func finishAttempt(backupConfig *Config, attempt *Attempt, message string, err error) {
+	cleanupBackup(backupConfig, attempt, err)
+	attempt.End = time.Now().UTC()
+	attempt.Status = statusSucceeded
+	if backupConfig.SnapshotTime != "" {
+		attempt.Snapshot = "snapshot_" + backupConfig.SnapshotTime
+	}
+	if err != nil {
+		attempt.Status = statusFailed
+		// The history file is read by status and history, which do not go through the log hook.
+		attempt.Error = redact.String(err.Error())
+		backupConfig.lastFailure = attempt.End
+	}
+	if errors.Cause(err) == ErrReplicaUnhealthy {
+		log.Warnf("skipped %s: %v", message, err)
+		attempt.Status = statusSkipped
+	}
+	if histErr := backupConfig.History.Append(*attempt); histErr != nil {
+		log.Errorf("failed to record backup attempt: %+v", histErr)
+	}
+
+	fields := map[string]string{
+		"type":     attempt.Type,
+		"env":      backupConfig.BackupEnv,
+		"bucket":   backupConfig.Bucketname,
+		"snapshot": attempt.Snapshot,
+		"key":      attempt.Key,
+		"duration": attempt.Duration().Round(time.Second).String(),
+	}
+	if attempt.Status == statusSkipped {
+		backupConfig.Notifier.Notify(context.Background(), notify.Event{Type: notify.BackupSkipped, Message: message, Error: err.Error(), Fields: fields})
 		return
 	}
+	backupConfig.Notifier.Result(context.Background(), notify.BackupSucceeded, notify.BackupFailed, message, fields, err)
 }
 
 type Config struct {
 	BackupDir           string
 	S3Dir               string
 	BackupEnv           string
+	Cluster             string
+	Host                string
+	Labels              map[string]string
+	StorageClasses      StorageClasses
 	IncrementalInterval time.Duration
 	Bucketname          string
 	AwsRegion           string
+	S3Endpoint          string
 	MysqlUser           string
 	MysqlPassword       string
+	MysqlPasswordFile   string
+	MysqlLoginPath      string
+	Engine              string
+	Connection          mysqlcli.Connection
+	DumpParallel        int
+	DumpOptions         []string
+	Tuning              tuning.Params
+	Encryption          encryption.Options
+	SkipPreflight       bool
+	Health              *HealthGate
+	Notifier            *notify.Notifier
+	History             *History
+	ControlSocket       string
 	SnapshotTime        string
+	FailedBackupAction  string
+	RetryInterval       time.Duration
+
+	// lastFailure holds scheduled backups back for RetryInterval after a failure.
+	lastFailure time.Time
+	// skipped is why the last call of executeBackup took no backup.
+	skipped string
 }
 
-func getBackupConfig() (*Config, error) {
+func getBackupConfig(args []string) (*Config, error) {
 	config := &Config{}
+	var err error
 	var (
-		backupDir           = flag.String("backup_dir", "/opt/mysql_backups", "set the MySQL backup directory to use for backups")
+		backupDir           = flag.String("backup_dir", defaultBackupDir, "set the MySQL backup directory to use for backups")
 		incrementalInterval = flag.Duration("incremental_interval", time.Minute*60, "incremental backup intervals, use -i to set the interval(i.e 60s, 60m, 1h, etc...)")
 		awsRegion           = flag.String("aws_region", "us-east-2", "set the region, default is us-east-2.")
+		s3Endpoint          = flag.String("s3_endpoint", "", "endpoint of an S3 compatible store to upload to instead of AWS, e.g. MinIO")
 		backupEnv           = flag.String("env", "", "set the environment(qa, uat, prod).")
+		cluster             = flag.String("cluster", "", "cluster the server belongs to, backups are uploaded below <env>/mysql/cluster_<cluster> and added to its catalog")
+		labels              = flag.String("labels", "", "comma separated key=value labels added to the tags and metadata of uploaded backups, at most 2")
+		fullStorageClass    = flag.String("full_storage_class", "STANDARD", "S3 storage class of full and logical backups")
+		incrStorageClass    = flag.String("incremental_storage_class", "STANDARD", "S3 storage class of incremental backups, e.g. STANDARD_IA")
+		monthlyStorageClass = flag.String("monthly_storage_class", "", "S3 storage class of the first full backup of every month, e.g. GLACIER_IR(default: -full_storage_class)")
 		bucketName          = flag.String("bucket_name", "", "set the S3 Bucket.")
 		mysqlUser           = flag.String("mysql_user", "root", "set the MySQL username")
+		mysqlPasswordFile   = flag.String("mysql_password_file", "", "read the MySQL password from this file instead of MYSQL_PASSWORD")
+		mysqlLoginPath      = flag.String("mysql_login_path", "", "log in with this mysql_config_editor login path instead of a user and password")
+		engine              = flag.String("engine", engineXtrabackup, "backup engine: xtrabackup for physical backups of the local server, mysqldump for logical backups of local or remote servers")
+		mysqlHost           = flag.String("mysql_host", "", "host of the MySQL server, only with -engine mysqldump(default: the local server over -mysql_socket)")
+		mysqlPort           = flag.Int("mysql_port", 3306, "port of the MySQL server used with -mysql_host")
+		mysqlSocket         = flag.String("mysql_socket", "/var/lib/mysql/mysql.sock", "set the MySQL socket the mysql and mysqldump clients use when -mysql_host is not set")
+		sslMode             = flag.String("ssl_mode", "", "--ssl-mode of the connection to -mysql_host, e.g. REQUIRED or VERIFY_IDENTITY")
+		sslCA               = flag.String("ssl_ca", "", "CA certificate file used to verify -mysql_host")
+		sslCert             = flag.String("ssl_cert", "", "client certificate file used to connect to -mysql_host")
+		sslKey              = flag.String("ssl_key", "", "client key file used to connect to -mysql_host")
+		dumpParallel        = flag.Int("dump_parallel", 4, "number of databases dumped at the same time with -engine mysqldump")
+		dumpOptions         = flag.String("dump_options", "", "space separated extra mysqldump options, e.g. --set-gtid-purged=OFF for managed instances")
+		skipPreflight       = flag.Bool("skip_preflight", false, "do not check for free disk space and required commands before a backup")
+		healthGate          = flag.Bool("health_gate", false, "check replication before every backup and skip or defer the backup when the replica is unhealthy")
+		requireReplica      = flag.Bool("require_replica", false, "with -health_gate, only back up servers that are replicas")
+		maxReplicaLag       = flag.Duration("max_replica_lag", 5*time.Minute, "with -health_gate, highest Seconds_Behind_Master a backup is taken at, 0 does not check the lag")
+		unhealthyAction     = flag.String("unhealthy_action", healthActionSkip, "what -health_gate does with the backup of an unhealthy replica: skip, or defer to check again every -health_retry_interval")
+		healthRetryInterval = flag.Duration("health_retry_interval", time.Minute, "how long a skipped or deferred backup waits before the replica is checked again")
+		maxDefer            = flag.Duration("max_defer", 30*time.Minute, "how long -unhealthy_action defer waits for the replica to recover before the backup is skipped")
+		failedBackupAction  = flag.String("failed_backup_action", failedBackupRemove, "what happens to the directory of a failed or interrupted backup: remove, or quarantine to move it to <backup_dir>/"+quarantineDir)
+		retryInterval       = flag.Duration("retry_interval", 5*time.Minute, "how long the daemon waits before it retries a failed scheduled backup")
+		metricsFile         = flag.String("metrics_file", "", "write health gate metrics in the Prometheus text format to this file, e.g. for the node_exporter textfile collector")
 		debug               = flag.Bool("debug", false, "change log level to debug")
+		controlSocket       = flag.String("control_socket", "", "unix socket the trigger subcommand requests backups on(default: <backup_dir>/"+controlSocketName+")")
+		notifyFlags         = notify.RegisterFlags(flag.CommandLine)
+		tuningFlags         = tuning.RegisterFlags(flag.CommandLine, tuning.Default())
+		encryptionFlags     = encryption.RegisterFlags(flag.CommandLine)
 	)
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 	config.BackupDir = *backupDir
 	config.S3Dir = filepath.Join(config.BackupDir, "s3_backups")
+	config.History = newHistory(config.BackupDir)
+	config.ControlSocket = *controlSocket
+	if config.ControlSocket == "" {
+		config.ControlSocket = filepath.Join(config.BackupDir, controlSocketName)
+	}
 	config.BackupEnv = *backupEnv
 	if config.BackupEnv == "" {
 		return nil, errors.New("env flag is not set and it is a required flag")
 	}
+	config.Cluster = *cluster
+	if config.Cluster == "" {
+		return nil, errors.New("cluster flag is not set and it is a required flag, backups are uploaded below <env>/mysql/cluster_<cluster>")
+	}
+	if strings.Contains(config.Cluster, "/") {
+		return nil, errors.Errorf("invalid cluster %q, it is part of the S3 keys and cannot contain a slash", config.Cluster)
+	}
+	if config.Labels, err = parseLabels(*labels); err != nil {
+		return nil, err
+	}
+	if config.Host, err = os.Hostname(); err != nil {
+		return nil, configError{errors.Wrap(err, "failed to get the hostname")}
+	}
+	config.StorageClasses = StorageClasses{Full: *fullStorageClass, Incremental: *incrStorageClass, Monthly: *monthlyStorageClass}
+	if err := config.StorageClasses.Validate(); err != nil {
+		return nil, err
+	}
 	config.IncrementalInterval = *incrementalInterval
 	config.Bucketname = *bucketName
 	if config.Bucketname == "" {
 		return nil, errors.New("bucket_name flag is not set")
 	}
 	config.AwsRegion = *awsRegion
+	config.S3Endpoint = *s3Endpoint
 	config.MysqlUser = *mysqlUser
+	config.Engine = *engine
+	if config.Engine != engineXtrabackup && config.Engine != engineMysqldump {
+		return nil, errors.Errorf("invalid engine %s.  Try xtrabackup or mysqldump", config.Engine)
+	}
+	config.Connection = mysqlcli.Connection{
+		Host:    *mysqlHost,
+		Port:    *mysqlPort,
+		Socket:  *mysqlSocket,
+		SSLMode: *sslMode,
+		SSLCA:   *sslCA,
+		SSLCert: *sslCert,
+		SSLKey:  *sslKey,
+	}
+	if config.Connection.Remote() && config.Engine == engineXtrabackup {
+		return nil, errors.New("innobackupex can only back up the local server, use -engine mysqldump with -mysql_host")
+	}
+	if *dumpParallel < 1 {
+		return nil, errors.Errorf("invalid dump_parallel %d, it must be at least 1", *dumpParallel)
+	}
+	config.DumpParallel = *dumpParallel
+	config.DumpOptions = strings.Fields(*dumpOptions)
+	// mysqld keeps running during a backup, the auto profile leaves it most of the memory.
+	params, err := tuningFlags.Params(0.1)
+	if err != nil {
+		return nil, err
+	}
+	config.Tuning = params
+	if config.Encryption, err = encryptionFlags.Options(); err != nil {
+		return nil, err
+	}
+	if config.Encryption.Enabled() && config.Engine == engineMysqldump {
+		return nil, errors.New("encryption is done by innobackupex, it is only supported with -engine xtrabackup")
+	}
+	config.SkipPreflight = *skipPreflight
+	if *failedBackupAction != failedBackupRemove && *failedBackupAction != failedBackupQuarantine {
+		return nil, errors.Errorf("invalid failed_backup_action %s.  Try remove or quarantine", *failedBackupAction)
+	}
+	config.FailedBackupAction = *failedBackupAction
+	config.RetryInterval = *retryInterval
+	if *unhealthyAction != healthActionSkip && *unhealthyAction != healthActionDefer {
+		return nil, errors.Errorf("invalid unhealthy_action %s.  Try skip or defer", *unhealthyAction)
+	}
+	config.Health = &HealthGate{
+		Enabled:        *healthGate,
+		RequireReplica: *requireReplica,
+		MaxLag:         *maxReplicaLag,
+		Action:         *unhealthyAction,
+		RetryInterval:  *healthRetryInterval,
+		MaxDefer:       *maxDefer,
+		MetricsFile:    *metricsFile,
+	}
 	config.MysqlPassword = os.Getenv("MYSQL_PASSWORD")
-	if config.MysqlPassword == "" {
-		return nil, errors.New("environment variable MYSQL_PASSWORD is not set")
+	config.MysqlPasswordFile = *mysqlPasswordFile
+	config.MysqlLoginPath = *mysqlLoginPath
+	redact.AddSecret(config.MysqlPassword)
+	if config.MysqlPassword == "" && config.MysqlPasswordFile == "" && config.MysqlLoginPath == "" {
+		return nil, errors.New("environment variable MYSQL_PASSWORD is not set, set it or use -mysql_password_file or -mysql_login_path")
+	}
+	if _, err := mysqlPassword(config); err != nil {
+		return nil, configError{err}
 	}
 
+	notifier, err := notifyFlags.Notifier("mysqlbackup")
+	if err != nil {
+		return nil, err
+	}
+	config.Notifier = notifier
+
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	} else {
@@ -127,21 +414,103 @@ func getBackupConfig() (*Config, error) {
 	return config, nil
 }
 
+// report runs the status and history subcommands, which only read the history file of a running mysqlbackup.
+func report(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	backupDir := fs.String("backup_dir", defaultBackupDir, "MySQL backup directory the history file is kept in")
+	output := fs.String("output", outputTable, "output format: table or json")
+	limit := fs.Int("limit", 20, "only print the most recent N attempts, 0 prints all(history only)")
+	fs.Parse(args)
+	if *output != outputTable && *output != outputJSON {
+		return errors.Errorf("invalid output %s.  Try table or json", *output)
+	}
+
+	attempts, err := newHistory(*backupDir).Read()
+	if err != nil {
+		return err
+	}
+	if command == "status" {
+		return writeStatus(os.Stdout, *output, summarize(attempts, time.Now()))
+	}
+	if *limit > 0 && len(attempts) > *limit {
+		attempts = attempts[len(attempts)-*limit:]
+	}
+	return writeHistory(os.Stdout, *output, attempts)
+}
+
+// subcommands talk to or read the files of a running mysqlbackup, without a subcommand mysqlbackup runs as the daemon.
+var subcommands = map[string]func(command string, args []string) error{
+	"status":  report,
+	"history": report,
+	"trigger": triggerBackup,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[1], os.Args[2:]); err != nil {
+				log.Error(err)
+				os.Exit(exitFailure)
+			}
+			return
+		}
+	}
 
-	backupConfig, err := getBackupConfig()
+	// run-once takes the backup the daemon would take now and exits, for cron, systemd timers and CronJobs.
+	args := os.Args[1:]
+	runOnce := len(args) > 0 && args[0] == "run-once"
+	if runOnce {
+		args = args[1:]
+	}
+
+	backupConfig, err := getBackupConfig(args)
 	if err != nil {
+		if code := configExitCode(err); code != exitUsage {
+			log.Errorf("failed to load the configuration: %v", err)
+			os.Exit(code)
+		}
 		log.Errorf("required command line flags or environment variables are not set: %v\n", err)
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+
+	if err := cleanupInterrupted(backupConfig); err != nil {
+		log.Errorf("failed to clean up interrupted backups: %+v", err)
 	}
 
-	s3Session := session.Must(session.NewSession(&aws.Config{
+	awsConfig := &aws.Config{
 		Region: aws.String(backupConfig.AwsRegion),
-	}))
+	}
+	if backupConfig.S3Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(backupConfig.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	s3Session := session.Must(session.NewSession(awsConfig))
+
+	if runOnce {
+		attempt, err := executeBackup(s3Session, backupConfig, backupRequest{})
+		if attempt == nil {
+			log.Infof("no backup was taken, %s", backupConfig.skipped)
+		}
+		os.Exit(exitCode(err))
+	}
+
+	// triggers is unbuffered, requests wait in their handlers until the running backup finished.
+	triggers := make(chan trigger)
+	if err := os.MkdirAll(backupConfig.BackupDir, 0700); err != nil {
+		log.Errorf("cannot create backup directory %s: %v", backupConfig.BackupDir, err)
+	}
+	if err := serveControl(backupConfig.ControlSocket, triggers); err != nil {
+		log.Errorf("backups cannot be triggered: %+v", err)
+	}
 
 	for {
-		executeBackup(s3Session, backupConfig)
-		time.Sleep(time.Second * 1)
+		executeBackup(s3Session, backupConfig, backupRequest{})
+		select {
+		case t := <-triggers:
+			log.Infof("taking %s backup triggered over the control socket, label: %q", t.request.Type, t.request.Label)
+			attempt, _ := executeBackup(s3Session, backupConfig, t.request)
+			t.done <- attempt
+		case <-time.After(time.Second):
+		}
 	}
 }
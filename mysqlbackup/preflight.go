@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+const dataSizeQuery = `SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE engine IS NOT NULL`
+
+// preflightBackup fails before innobackupex or mysqldump run when the backup directory cannot hold the backup and its tar file.
+// previousBackup is the backup an incremental is based on, it is empty for a full backup.
+func preflightBackup(backupDir, previousBackup string, credentials []string, backupConfig *Config) error {
+	if backupConfig.SkipPreflight {
+		return nil
+	}
+	commands := []string{"innobackupex", "mysql", "tar"}
+	if backupConfig.Engine == engineMysqldump {
+		commands = []string{"mysqldump", "mysql", "tar"}
+	}
+	if err := preflight.CheckCommands(commands...); err != nil {
+		return errors.Wrap(err, "pre-flight checks failed, use -skip_preflight to back up anyway")
+	}
+	estimate, err := estimateBackupSize(previousBackup, credentials, backupConfig)
+	if err != nil {
+		return err
+	}
+	log.Infof("estimated backup size: %s", preflight.FormatBytes(estimate))
+
+	err = preflight.CheckSpace(
+		preflight.Requirement{Path: backupDir, Bytes: estimate, Purpose: "backup"},
+		preflight.Requirement{Path: backupConfig.S3Dir, Bytes: estimate, Purpose: "tar file"},
+	)
+	return errors.Wrap(err, "pre-flight checks failed, use -skip_preflight to back up anyway")
+}
+
+// estimateBackupSize sizes full and logical backups from the tables' data and index lengths, which compression only
+// makes smaller, and an incremental from the size of the backup it is based on.
+func estimateBackupSize(previousBackup string, credentials []string, backupConfig *Config) (int64, error) {
+	if previousBackup != "" {
+		return preflight.DirSize(previousBackup)
+	}
+
+	out, err := mysqlQuery(append(credentials, backupConfig.Connection.Args()...), dataSizeQuery)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to estimate the data size from information_schema")
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unexpected data size %q from information_schema", out)
+	}
+	return size, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tiers a backup is uploaded as, recorded in the tier tag for bucket lifecycle rules.
+const (
+	tierMonthly     = "monthly"
+	tierFull        = "full"
+	tierIncremental = "incremental"
+)
+
+// storageClasses are the S3 storage classes backups can be uploaded with.
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacierIr,
+	s3.StorageClassGlacier,
+	s3.StorageClassDeepArchive,
+}
+
+// StorageClasses picks the storage class of an upload by its tier.
+type StorageClasses struct {
+	Full        string
+	Incremental string
+	// Monthly is used for the first full backup of every month, Full when empty.
+	Monthly string
+}
+
+func (c StorageClasses) Validate() error {
+	for name, class := range map[string]string{"full_storage_class": c.Full, "incremental_storage_class": c.Incremental, "monthly_storage_class": c.Monthly} {
+		if class == "" && name == "monthly_storage_class" {
+			continue
+		}
+		valid := false
+		for _, s := range storageClasses {
+			valid = valid || class == s
+		}
+		if !valid {
+			return errors.Errorf("invalid %s %s.  Try %s", name, class, strings.Join(storageClasses, ", "))
+		}
+	}
+	return nil
+}
+
+// uploadTier returns the tier and storage class of the attempt.  The first full or logical backup of a month is the
+// monthly backup, a month's earlier failed attempts do not count.
+func uploadTier(backupConfig *Config, attempt *Attempt) (string, string) {
+	classes := backupConfig.StorageClasses
+	if attempt.Type == backupTypeIncremental {
+		return tierIncremental, classes.Incremental
+	}
+	attempts, err := backupConfig.History.Read()
+	if err != nil {
+		log.Warnf("cannot tell whether this is the month's first full backup, uploading it as a daily full backup: %v", err)
+		return tierFull, classes.Full
+	}
+	if monthlyDone(attempts, attempt.Start) {
+		return tierFull, classes.Full
+	}
+	if classes.Monthly == "" {
+		return tierMonthly, classes.Full
+	}
+	return tierMonthly, classes.Monthly
+}
+
+// monthlyDone reports whether a full or logical backup already succeeded in the month of now.
+func monthlyDone(attempts []Attempt, now time.Time) bool {
+	year, month, _ := now.UTC().Date()
+	for _, a := range attempts {
+		if a.Status != statusSucceeded || a.Type == backupTypeIncremental {
+			continue
+		}
+		if y, m, _ := a.Start.UTC().Date(); y == year && m == month {
+			return true
+		}
+	}
+	return false
+}
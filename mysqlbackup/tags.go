@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// maxObjectTags is the number of tags S3 allows on an object.
+const maxObjectTags = 10
+
+// maxTagValue is the length S3 allows for a tag value.
+const maxTagValue = 256
+
+// reservedTags are set by mysqlbackup on every object, user labels cannot use them.
+var reservedTags = []string{"snapshot", "retain", "label", "env", "cluster", "host", "type", "tier"}
+
+var (
+	labelKey = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	// labelValue are the characters S3 accepts in tag values that are also valid in metadata.
+	labelValue = regexp.MustCompile(`^[A-Za-z0-9 +\-=._:/@]*$`)
+)
+
+// Semver and GitCommit are set at build time and recorded in the metadata of every object.
+var (
+	Semver    string
+	GitCommit string
+)
+
+func toolVersion() string {
+	if Semver == "" {
+		return "dev"
+	}
+	if GitCommit == "" {
+		return Semver
+	}
+	return Semver + "+" + GitCommit
+}
+
+// parseLabels parses the comma separated key=value list of -labels.  Only as many labels as fit next to the reserved
+// tags are accepted, because every label is also an object tag.
+func parseLabels(list string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !labelKey.MatchString(kv[0]) {
+			return nil, errors.Errorf("invalid label %q, expected key=value with a key of lower case letters, digits, _ and -", pair)
+		}
+		if err := validTagValue(kv[1]); err != nil {
+			return nil, errors.Wrapf(err, "invalid value of label %s", kv[0])
+		}
+		for _, reserved := range reservedTags {
+			if kv[0] == reserved {
+				return nil, errors.Errorf("label %s is reserved, mysqlbackup sets it itself", kv[0])
+			}
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if len(labels) > maxObjectTags-len(reservedTags) {
+		return nil, errors.Errorf("too many labels, S3 objects take %d tags and mysqlbackup uses %d of them", maxObjectTags, len(reservedTags))
+	}
+	return labels, nil
+}
+
+// validTagValue rejects values S3 refuses as tag values, so a backup is not taken only to fail at upload.
+func validTagValue(value string) error {
+	if !labelValue.MatchString(value) {
+		return errors.New("S3 tags only allow letters, digits, spaces and + - = . _ : / @")
+	}
+	if len(value) > maxTagValue {
+		return errors.Errorf("S3 tags are at most %d characters long", maxTagValue)
+	}
+	return nil
+}
+
+// objectTags are the tags bucket lifecycle rules can filter on.  Every object is tagged retain=false, labelled
+// backups are tagged retain=true and label=<label> instead so lifecycle rules can expire unlabelled backups only.
+func objectTags(backupConfig *Config, attempt *Attempt, snapshotName string) url.Values {
+	tags := url.Values{
+		"snapshot": {snapshotName},
+		"retain":   {"false"},
+		"env":      {backupConfig.BackupEnv},
+		"host":     {backupConfig.Host},
+		"type":     {attempt.Type},
+		"tier":     {attempt.Tier},
+	}
+	if backupConfig.Cluster != "" {
+		tags.Set("cluster", backupConfig.Cluster)
+	}
+	if attempt.Label != "" {
+		tags.Set("retain", "true")
+		tags.Set("label", attempt.Label)
+	}
+	for key, value := range backupConfig.Labels {
+		tags.Set(key, value)
+	}
+	return tags
+}
+
+// objectMetadata describes the backup in the object's metadata, including the LSNs that do not fit in the tags.
+// User labels are prefixed with label- so they cannot be confused with the other keys.
+func objectMetadata(backupConfig *Config, attempt *Attempt, snapshotName string) map[string]*string {
+	metadata := map[string]string{
+		"snapshot":     snapshotName,
+		"env":          backupConfig.BackupEnv,
+		"host":         backupConfig.Host,
+		"backup-type":  attempt.Type,
+		"tier":         attempt.Tier,
+		"tool-version": toolVersion(),
+	}
+	if backupConfig.Cluster != "" {
+		metadata["cluster"] = backupConfig.Cluster
+	}
+	if attempt.Label != "" {
+		metadata["label"] = attempt.Label
+	}
+	if attempt.ToLSN != 0 {
+		metadata["from-lsn"] = strconv.FormatUint(attempt.FromLSN, 10)
+		metadata["to-lsn"] = strconv.FormatUint(attempt.ToLSN, 10)
+	}
+	for key, value := range backupConfig.Labels {
+		metadata["label-"+key] = value
+	}
+	return aws.StringMap(metadata)
+}
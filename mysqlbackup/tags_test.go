@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabels(t *testing.T) {
+	assert := require.New(t)
+
+	labels, err := parseLabels("team=dba, purpose=pre-migration")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"team": "dba", "purpose": "pre-migration"}, labels)
+
+	_, err = parseLabels("env=prod")
+	assert.Error(err, "reserved tag")
+	_, err = parseLabels("Team=dba")
+	assert.Error(err, "upper case key")
+	_, err = parseLabels("team=d&a")
+	assert.Error(err, "invalid tag value")
+	_, err = parseLabels("team=" + strings.Repeat("a", maxTagValue+1))
+	assert.Error(err, "tag value too long")
+	_, err = parseLabels("a=1,b=2,c=3")
+	assert.Error(err, "more labels than tags left")
+}
+
+func TestObjectTags(t *testing.T) {
+	assert := require.New(t)
+	config := &Config{BackupEnv: "prod", Cluster: "one", Host: "db1", Labels: map[string]string{"team": "dba"}}
+	attempt := &Attempt{Type: backupTypeIncremental, Tier: tierIncremental, Label: "pre-migration", FromLSN: 100, ToLSN: 200}
+
+	tags := objectTags(config, attempt, "snapshot_2019_05_01")
+	assert.Equal("cluster=one&env=prod&host=db1&label=pre-migration&retain=true&snapshot=snapshot_2019_05_01&team=dba&tier=incremental&type=incremental", tags.Encode())
+	assert.True(len(tags) <= maxObjectTags)
+
+	metadata := aws.StringValueMap(objectMetadata(config, attempt, "snapshot_2019_05_01"))
+	assert.Equal("100", metadata["from-lsn"])
+	assert.Equal("200", metadata["to-lsn"])
+	assert.Equal("dba", metadata["label-team"])
+	assert.Equal("dev", metadata["tool-version"])
+}
+
+func TestUploadTier(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "tier")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	config := &Config{
+		History:        newHistory(dir),
+		StorageClasses: StorageClasses{Full: "STANDARD", Incremental: "STANDARD_IA", Monthly: "GLACIER_IR"},
+	}
+	start := time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC)
+
+	tier, class := uploadTier(config, &Attempt{Type: backupTypeFull, Start: start})
+	assert.Equal(tierMonthly, tier)
+	assert.Equal("GLACIER_IR", class)
+
+	assert.NoError(config.History.Append(Attempt{Type: backupTypeFull, Status: statusSucceeded, Start: start.AddDate(0, 0, -1)}))
+	tier, class = uploadTier(config, &Attempt{Type: backupTypeFull, Start: start})
+	assert.Equal(tierFull, tier)
+	assert.Equal("STANDARD", class)
+
+	_, class = uploadTier(config, &Attempt{Type: backupTypeIncremental, Start: start})
+	assert.Equal("STANDARD_IA", class)
+
+	assert.Error(StorageClasses{Full: "STANDARD", Incremental: "COLD"}.Validate())
+}
@@ -0,0 +1,103 @@
+// Package mysqlcli builds the login and connection options of the mysql, mysqldump and innobackupex clients.
+package mysqlcli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+// ReadPassword reads a password file, the trailing newline is dropped and the password is redacted from the logs.
+func ReadPassword(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read mysql password file %s", path)
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	redact.AddSecret(password)
+	return password, nil
+}
+
+// OptionFile writes user and password to a temporary option file readable only by the current user and returns the
+// --defaults-extra-file option pointing at it, which must come first on the client's command line.
+// The password never shows up in argv where ps and the logs would see it.  cleanup removes the file.
+// The credentials are written to the client group, and to every group in groups, e.g. xtrabackup.
+func OptionFile(user, password string, groups ...string) (args []string, cleanup func(), err error) {
+	// ioutil.TempFile creates the file with 0600 permissions.
+	f, err := ioutil.TempFile("", "mysql-credentials")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create mysql credentials file")
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+
+	var content strings.Builder
+	for _, group := range append([]string{"client"}, groups...) {
+		fmt.Fprintf(&content, "[%s]\nuser=%s\npassword=%s\n", group, quoteOption(user), quoteOption(password))
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		f.Close()
+		cleanup()
+		return nil, nil, errors.Wrap(err, "failed to write mysql credentials file")
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return nil, nil, errors.Wrap(err, "failed to close mysql credentials file")
+	}
+	return []string{"--defaults-extra-file=" + f.Name()}, cleanup, nil
+}
+
+// quoteOption quotes a value for a MySQL option file, where backslash escapes are interpreted inside quotes.
+func quoteOption(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
+
+// Connection is where a client connects to, a TCP host when Host is set and the unix Socket otherwise.
+type Connection struct {
+	Host   string
+	Port   int
+	Socket string
+
+	// SSLMode is passed as --ssl-mode, e.g. REQUIRED or VERIFY_IDENTITY.
+	SSLMode string
+	SSLCA   string
+	SSLCert string
+	SSLKey  string
+}
+
+// Remote reports whether the connection goes over TCP.
+func (c Connection) Remote() bool {
+	return c.Host != ""
+}
+
+// Args are the client options for the connection.
+func (c Connection) Args() []string {
+	var args []string
+	if c.Remote() {
+		args = append(args, "--host="+c.Host)
+		if c.Port != 0 {
+			args = append(args, "--port="+strconv.Itoa(c.Port))
+		}
+	} else if c.Socket != "" {
+		args = append(args, "--socket="+c.Socket)
+	}
+	tls := []struct{ option, value string }{
+		{"--ssl-mode", c.SSLMode},
+		{"--ssl-ca", c.SSLCA},
+		{"--ssl-cert", c.SSLCert},
+		{"--ssl-key", c.SSLKey},
+	}
+	for _, o := range tls {
+		if o.value != "" {
+			args = append(args, o.option+"="+o.value)
+		}
+	}
+	return args
+}
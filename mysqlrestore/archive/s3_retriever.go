@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -18,17 +19,39 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/snapshots"
 )
 
+const (
+	// DefaultDownloadWorkers is the number of snapshot files downloaded at the same time.
+	DefaultDownloadWorkers = 4
+	// DefaultPartSize is the size of each ranged GET issued for a single snapshot file.
+	DefaultPartSize = s3manager.DefaultDownloadPartSize
+	// DefaultPartConcurrency is the number of ranged GETs in flight for a single snapshot file.
+	DefaultPartConcurrency = s3manager.DefaultDownloadConcurrency
+)
+
+// DefaultExtractWorkers is the number of tar files extracted at the same time.
+var DefaultExtractWorkers = runtime.NumCPU()
+
 // Used in the Get method to download the snapshot.
 // Can be nil if used w/ the Prepare method.
+// Zero values for the worker and part settings fall back to the package defaults.
 type S3Retriever struct {
+	S3       execute.S3Options
 	Bucket   string
-	Snapshot string
+	Snapshot snapshots.Ref
+
+	DownloadWorkers int
+	ExtractWorkers  int
+	PartSize        int64
+	PartConcurrency int
+	// ThawOptions configure how archives in glacier storage classes are restored before they are downloaded.
+	ThawOptions ThawOptions
 }
 
 func (s *S3Retriever) Get(ctx context.Context, restoreDir string) error {
-	if err := download(ctx, s.Bucket, s.Snapshot, restoreDir); err != nil {
+	if err := s.download(ctx, restoreDir); err != nil {
 		return errors.Wrapf(err, "failed to download backups from snapshot %s ", s.Snapshot)
 	}
 
@@ -36,17 +59,85 @@ func (s *S3Retriever) Get(ctx context.Context, restoreDir string) error {
 }
 
 func (s *S3Retriever) Prepare(ctx context.Context, restoreDir string) error {
-	return Prepare(ctx, restoreDir)
+	if err := untar(ctx, restoreDir, s.extractWorkers()); err != nil {
+		return errors.Wrapf(err, "failed to untar files in snapshot directory %s", restoreDir)
+	}
+	return nil
 }
 
 func Prepare(ctx context.Context, restoreDir string) error {
-	if err := untar(ctx, restoreDir); err != nil {
+	if err := untar(ctx, restoreDir, DefaultExtractWorkers); err != nil {
 		return errors.Wrapf(err, "failed to untar files in snapshot directory %s", restoreDir)
 	}
 	return nil
 }
 
-func untar(ctx context.Context, restoreDir string) error {
+func (s *S3Retriever) downloadWorkers() int {
+	if s.DownloadWorkers > 0 {
+		return s.DownloadWorkers
+	}
+	return DefaultDownloadWorkers
+}
+
+func (s *S3Retriever) extractWorkers() int {
+	if s.ExtractWorkers > 0 {
+		return s.ExtractWorkers
+	}
+	return DefaultExtractWorkers
+}
+
+func (s *S3Retriever) partSize() int64 {
+	if s.PartSize > 0 {
+		return s.PartSize
+	}
+	return DefaultPartSize
+}
+
+func (s *S3Retriever) partConcurrency() int {
+	if s.PartConcurrency > 0 {
+		return s.PartConcurrency
+	}
+	return DefaultPartConcurrency
+}
+
+// forEach runs fn for every item using at most workers goroutines.
+// The first error cancels the context handed to fn and stops any items that have not started yet.
+func forEach(ctx context.Context, workers int, items []string, fn func(ctx context.Context, item string) error) error {
+	group, groupCtx := errgroup.WithContext(ctx)
+	queue := make(chan string)
+
+	group.Go(func() error {
+		defer close(queue)
+		for _, item := range items {
+			select {
+			case queue <- item:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+		}
+		return nil
+	})
+
+	if workers > len(items) {
+		workers = len(items)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		group.Go(func() error {
+			for item := range queue {
+				if err := fn(groupCtx, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+func untar(ctx context.Context, restoreDir string, workers int) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	tarFileDir, err := ioutil.ReadDir(restoreDir)
@@ -60,43 +151,49 @@ func untar(ctx context.Context, restoreDir string) error {
 	}
 	log.Debugf("list of backups to prepare: %s", tarFiles)
 
-	group, _ := errgroup.WithContext(ctx)
 	for _, file := range tarFiles {
-		fileTemp := file
-		defer os.Remove(fileTemp)
-		wrap := func() error {
-			log.Debugf("untarring %s", fileTemp)
-			prepareCmdLine := []string{
-				"tar",
-				"-xzf",
-				fileTemp,
-				"--directory",
-				restoreDir,
-			}
-			return execute.CmdRun(ctx, prepareCmdLine)
+		defer os.Remove(file)
+	}
+
+	extract := func(ctx context.Context, tarFile string) error {
+		log.Debugf("untarring %s", tarFile)
+		flags := "-xf"
+		if strings.HasSuffix(tarFile, gzipArchiveSuffix) {
+			flags = "-xzf"
+		}
+		prepareCmdLine := []string{
+			"tar",
+			flags,
+			tarFile,
+			"--directory",
+			restoreDir,
 		}
-		group.Go(wrap)
+		return execute.CmdRun(ctx, prepareCmdLine)
 	}
+
 	done := make(chan error)
 	go func() {
-		done <- group.Wait()
+		done <- forEach(ctx, workers, tarFiles, extract)
 	}()
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
 	select {
 	case err := <-done:
 		return err
 	case stopSignal := <-stop:
 		fmt.Printf("program received OS signal %v so it is shutting down\n", stopSignal)
+		cancel()
 		err := <-done
 		return errors.Wrap(err, "untar failed")
 	}
 }
 
-func download(ctx context.Context, bucket, snapshot, restoreDir string) error {
+func (s *S3Retriever) download(ctx context.Context, restoreDir string) error {
+	bucket, snapshot := s.Bucket, s.Snapshot
 	log.Infof("downloading snapshot %v, to directory: %v", snapshot, restoreDir)
-	if snapshot == "" {
-		return errors.New("snapshot flag is not set so a restore cannot be performed")
+	if err := snapshot.Validate(); err != nil {
+		return errors.Wrap(err, "snapshot is not valid so a restore cannot be performed")
 	}
 
 	if err := os.MkdirAll(restoreDir, 0700); err != nil {
@@ -104,47 +201,43 @@ func download(ctx context.Context, bucket, snapshot, restoreDir string) error {
 	}
 
 	log.Debug("creating s3client")
-	s3Client, err := execute.GetS3Client()
+	s3Client, err := execute.GetS3Client(s.S3)
 	if err != nil {
 		return errors.Wrap(err, "failed to create s3 client")
 	}
 
-	snapshotFiles, err := listBucketFiles(s3Client, bucket, snapshot)
+	archives, err := listArchives(ctx, s3Client, bucket, snapshot.Prefix())
 	if err != nil {
 		return errors.Wrap(err, "failed to get list of snapshotFiles for snapshot in bucket")
 	}
+	if err := s.waitThawed(ctx, s3Client, archives); err != nil {
+		return err
+	}
+	var snapshotFiles []string
+	for _, object := range archives {
+		snapshotFiles = append(snapshotFiles, *object.Key)
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	downloader := s3manager.NewDownloaderWithClient(s3Client)
-	group, _ := errgroup.WithContext(ctx)
-	for _, b := range snapshotFiles {
-		baseName := filepath.Base(b)
-		localPath := filepath.Join(restoreDir, baseName)
-		log.Debugf("creating local file of backup to download to: %s", localPath)
-		localFile, err := os.Create(localPath)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create dir fo %s", localPath)
-		}
-
-		input := &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(b),
-		}
+	downloader := s3manager.NewDownloaderWithClient(s3Client, func(d *s3manager.Downloader) {
+		d.PartSize = s.partSize()
+		d.Concurrency = s.partConcurrency()
+	})
+	log.Debugf("downloading %d files with %d workers, part size: %d, part concurrency: %d",
+		len(snapshotFiles), s.downloadWorkers(), downloader.PartSize, downloader.Concurrency)
 
-		wrap := func() error {
-			log.Debugf("Downloading: %s", input)
-			_, err := downloader.DownloadWithContext(ctx, localFile, input)
-			return err
-		}
-		group.Go(wrap)
+	fetch := func(ctx context.Context, key string) error {
+		return downloadFile(ctx, downloader, bucket, key, filepath.Join(restoreDir, filepath.Base(key)))
 	}
+
 	// buffered channel is necessary to avoid losing signals accidentally, consult the docks if making a change here.
 	stopCh := make(chan os.Signal, 1)
 	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stopCh)
 	done := make(chan error)
 	go func() {
-		done <- group.Wait()
+		done <- forEach(ctx, s.downloadWorkers(), snapshotFiles, fetch)
 	}()
 	select {
 	case err := <-done:
@@ -157,26 +250,78 @@ func download(ctx context.Context, bucket, snapshot, restoreDir string) error {
 	}
 }
 
-func listBucketFiles(s3Client *s3.S3, bucket, prefix string) ([]string, error) {
-	params := &s3.ListObjectsInput{
+// downloadFile writes a single object to localPath.
+// A partially written file is removed so a failed or cancelled download never looks complete.
+func downloadFile(ctx context.Context, downloader *s3manager.Downloader, bucket, key, localPath string) (err error) {
+	log.Debugf("creating local file of backup to download to: %s", localPath)
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create local file %s", localPath)
+	}
+	defer func() {
+		if closeErr := localFile.Close(); closeErr != nil && err == nil {
+			err = errors.Wrapf(closeErr, "failed to close local file %s", localPath)
+		}
+		if err != nil {
+			os.Remove(localPath)
+		}
+	}()
+
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
+		Key:    aws.String(key),
+	}
+	log.Debugf("Downloading: %s", input)
+	if _, err := downloader.DownloadWithContext(ctx, localFile, input); err != nil {
+		return errors.Wrapf(err, "failed to download %s", key)
+	}
+	return nil
+}
+
+// Size is the total size of the snapshot's archives in the bucket.
+func (s *S3Retriever) Size(ctx context.Context) (int64, error) {
+	if err := s.Snapshot.Validate(); err != nil {
+		return 0, errors.Wrap(err, "snapshot is not valid so it cannot be sized")
+	}
+	s3Client, err := execute.GetS3Client(s.S3)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create s3 client")
 	}
+	archives, err := listArchives(ctx, s3Client, s.Bucket, s.Snapshot.Prefix())
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, object := range archives {
+		size += aws.Int64Value(object.Size)
+	}
+	return size, nil
+}
+
+// Archives are tarred by mysqlbackup, plain for backups it compressed itself and gzipped by older versions.
+const (
+	archiveSuffix     = ".tar"
+	gzipArchiveSuffix = ".tgz"
+)
+
+func isArchive(key string) bool {
+	return strings.HasSuffix(key, archiveSuffix) || strings.HasSuffix(key, gzipArchiveSuffix)
+}
 
-	log.Debugf("params for ListObject func: %s", params)
-	resp, err := s3Client.ListObjects(params)
+func listArchives(ctx context.Context, s3Client *s3.S3, bucket, prefix string) ([]*s3.Object, error) {
+	resp, err := snapshots.ListObjects(ctx, s3Client, bucket, prefix)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to list objects in s3 bucket %s", bucket)
+		return nil, err
 	}
 
-	var objects []string
-	for _, k := range resp.Contents {
-		if strings.Contains(*k.Key, ".tgz") {
-			objects = append(objects, *k.Key)
+	var objects []*s3.Object
+	for _, k := range resp {
+		if isArchive(aws.StringValue(k.Key)) {
+			objects = append(objects, k)
 		}
 	}
 	if len(objects) == 0 {
-		log.Errorf("response from s3Client.ListObjects resp object is empty, check snapshot passed in: %s", objects)
+		return nil, errors.Wrapf(snapshots.ErrSnapshotNotFound, "no archives found in bucket %s with prefix %s", bucket, prefix)
 	}
 
 	return objects, nil
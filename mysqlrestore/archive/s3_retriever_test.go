@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachLimitsWorkers(t *testing.T) {
+	assert := require.New(t)
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	var running, maxRunning, processed int32
+	err := forEach(context.Background(), 3, items, func(ctx context.Context, item string) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&processed, 1)
+		return nil
+	})
+
+	assert.NoError(err)
+	assert.Equal(int32(len(items)), processed)
+	assert.True(maxRunning <= 3, "ran %d workers at once", maxRunning)
+}
+
+func TestForEachStopsOnFirstError(t *testing.T) {
+	assert := require.New(t)
+	items := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	failure := errors.New("download failed")
+
+	var started int32
+	err := forEach(context.Background(), 2, items, func(ctx context.Context, item string) error {
+		atomic.AddInt32(&started, 1)
+		if item == "a" {
+			return failure
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+
+	assert.Equal(failure, err)
+	assert.True(started < int32(len(items)), "all %d items started after the first error", started)
+}
+
+func TestRestoreState(t *testing.T) {
+	assert := require.New(t)
+
+	requested, ready := restoreState("")
+	assert.False(requested)
+	assert.False(ready)
+	requested, ready = restoreState(`ongoing-request="true"`)
+	assert.True(requested)
+	assert.False(ready)
+	requested, ready = restoreState(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+	assert.True(requested)
+	assert.True(ready)
+
+	assert.True(archivedClass("DEEP_ARCHIVE"))
+	assert.False(archivedClass("GLACIER_IR"), "glacier instant retrieval is downloaded directly")
+}
+
+func TestIsArchive(t *testing.T) {
+	assert := require.New(t)
+	assert.True(isArchive("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full_2019_05_01_00_00_00Z.tar"))
+	assert.True(isArchive("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full_2019_05_01_00_00_00Z.tgz"))
+	assert.False(isArchive("qa/mysql/cluster_one/catalog.json"))
+	assert.False(isArchive("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full.tar.partial"))
+}
@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+)
+
+// ErrThawPending is returned when archived objects of a snapshot were not restored within ThawOptions.Wait.
+var ErrThawPending = errors.New("snapshot is still being restored from glacier")
+
+// errCodeRestoreInProgress is returned by RestoreObject when the object is already being restored.
+const errCodeRestoreInProgress = "RestoreAlreadyInProgress"
+
+const (
+	// DefaultThawDays is how long restored copies of archived objects stay available.
+	DefaultThawDays = 3
+	// DefaultThawPollInterval is how often a restore waiting for archived objects checks on them.
+	DefaultThawPollInterval = time.Minute
+)
+
+// ThawOptions configure the restore requests for archives in the GLACIER and DEEP_ARCHIVE storage classes,
+// which have to be restored before they can be downloaded.
+type ThawOptions struct {
+	// Days the restored copies are kept, DefaultThawDays when 0.
+	Days int64
+	// Tier is the retrieval tier: Expedited, Standard or Bulk.  Deep archive does not support Expedited.
+	Tier string
+	// Wait is how long a download waits for the restores to finish, 0 fails right away.
+	Wait         time.Duration
+	PollInterval time.Duration
+}
+
+// ThawStatus counts the archives of a snapshot by their restore state.
+type ThawStatus struct {
+	Archives int
+	// Archived is how many archives are in an archive storage class, Pending how many of them are still being restored.
+	Archived int
+	Pending  int
+}
+
+// Ready reports whether every archive can be downloaded.
+func (t ThawStatus) Ready() bool {
+	return t.Pending == 0
+}
+
+// archivedClass reports whether objects of the storage class must be restored before they can be downloaded.
+func archivedClass(storageClass string) bool {
+	return storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+}
+
+// restoreState parses the x-amz-restore header: empty when no restore was requested, ongoing-request="true" while it
+// runs and ongoing-request="false", expiry-date="..." once the copy is available.
+func restoreState(header string) (requested, ready bool) {
+	if header == "" {
+		return false, false
+	}
+	return true, strings.Contains(header, `ongoing-request="false"`)
+}
+
+// Thaw requests restores of the snapshot's archived objects that were not requested yet and reports how many are
+// still pending.  It does not wait, a restore calls it repeatedly until every archive is ready.
+func (s *S3Retriever) Thaw(ctx context.Context) (ThawStatus, error) {
+	if err := s.Snapshot.Validate(); err != nil {
+		return ThawStatus{}, errors.Wrap(err, "snapshot is not valid so it cannot be thawed")
+	}
+	s3Client, err := execute.GetS3Client(s.S3)
+	if err != nil {
+		return ThawStatus{}, errors.Wrap(err, "failed to create s3 client")
+	}
+	archives, err := listArchives(ctx, s3Client, s.Bucket, s.Snapshot.Prefix())
+	if err != nil {
+		return ThawStatus{}, err
+	}
+	return s.thaw(ctx, s3Client, archives)
+}
+
+func (s *S3Retriever) thaw(ctx context.Context, s3Client *s3.S3, archives []*s3.Object) (ThawStatus, error) {
+	status := ThawStatus{Archives: len(archives)}
+	for _, object := range archives {
+		if !archivedClass(aws.StringValue(object.StorageClass)) {
+			continue
+		}
+		status.Archived++
+		key := aws.StringValue(object.Key)
+		head, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.Bucket), Key: object.Key})
+		if err != nil {
+			return status, errors.Wrapf(err, "failed to get the restore state of %s", key)
+		}
+		requested, ready := restoreState(aws.StringValue(head.Restore))
+		if ready {
+			continue
+		}
+		status.Pending++
+		if requested {
+			continue
+		}
+
+		log.Infof("requesting %s restore of %s archive %s for %d days", s.thawTier(), aws.StringValue(object.StorageClass), key, s.thawDays())
+		_, err = s3Client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    object.Key,
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(s.thawDays()),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s.thawTier())},
+			},
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeRestoreInProgress {
+			err = nil
+		}
+		if err != nil {
+			return status, errors.Wrapf(err, "failed to request restore of %s", key)
+		}
+	}
+	return status, nil
+}
+
+// waitThawed requests restores of archived objects and polls until every one of them can be downloaded.
+func (s *S3Retriever) waitThawed(ctx context.Context, s3Client *s3.S3, archives []*s3.Object) error {
+	deadline := time.Now().Add(s.ThawOptions.Wait)
+	for {
+		status, err := s.thaw(ctx, s3Client, archives)
+		if err != nil {
+			return err
+		}
+		if status.Ready() {
+			if status.Archived > 0 {
+				log.Infof("all %d archived files of snapshot %s are restored", status.Archived, s.Snapshot)
+			}
+			return nil
+		}
+		if time.Now().Add(s.thawPollInterval()).After(deadline) {
+			return errors.Wrapf(ErrThawPending, "%d of %d archived files of snapshot %s are not restored yet, try again later or raise -thaw_wait",
+				status.Pending, status.Archived, s.Snapshot)
+		}
+		log.Infof("waiting for %d of %d archived files of snapshot %s to be restored", status.Pending, status.Archived, s.Snapshot)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.thawPollInterval()):
+		}
+	}
+}
+
+func (s *S3Retriever) thawDays() int64 {
+	if s.ThawOptions.Days > 0 {
+		return s.ThawOptions.Days
+	}
+	return DefaultThawDays
+}
+
+func (s *S3Retriever) thawTier() string {
+	if s.ThawOptions.Tier != "" {
+		return s.ThawOptions.Tier
+	}
+	return s3.TierStandard
+}
+
+func (s *S3Retriever) thawPollInterval() time.Duration {
+	if s.ThawOptions.PollInterval > 0 {
+		return s.ThawOptions.PollInterval
+	}
+	return DefaultThawPollInterval
+}
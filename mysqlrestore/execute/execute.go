@@ -17,8 +17,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
 )
 
+// ErrCredentialsUnavailable is returned when AWS credentials cannot be read from the instance metadata service.
+var ErrCredentialsUnavailable = errors.New("aws credentials unavailable")
+
 type awsSecurityCreds struct {
 	Code            string
 	LastUpdated     string
@@ -34,36 +39,63 @@ func awsMetaDataRequest(url string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "GET request failed for url: %s", url)
 	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("GET request failed for url: %s, status: %s", url, httpRes.Status)
+	}
 	httpResponse, err := ioutil.ReadAll(httpRes.Body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read http reponse: %s", httpRes.Body)
+		return nil, errors.Wrapf(err, "failed to read http reponse from url: %s", url)
 	}
 
 	return httpResponse, nil
 }
 
-func GetS3Client() (*s3.S3, error) {
+// DefaultRegion is the region of the backup buckets.
+const DefaultRegion = "us-east-2"
+
+// S3Options pick the store the S3 client talks to.  Endpoint points it at an S3 compatible store instead of AWS, e.g.
+// MinIO or the fake server of the tests, credentials then come from the environment or the shared credentials file
+// instead of the instance metadata.  An empty Region is DefaultRegion.
+type S3Options struct {
+	Endpoint string
+	Region   string
+}
+
+func GetS3Client(opts S3Options) (*s3.S3, error) {
+	region := opts.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	if opts.Endpoint != "" {
+		cfg := aws.NewConfig().WithRegion(region).WithEndpoint(opts.Endpoint).WithS3ForcePathStyle(true)
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create aws session")
+		}
+		return s3.New(sess), nil
+	}
 
 	iamRoleURL := "http://169.254.169.254/latest/meta-data/iam/security-credentials"
 	iamRole, err := awsMetaDataRequest(iamRoleURL)
 	if err != nil {
-		errors.Cause(err)
+		return nil, errors.Wrapf(ErrCredentialsUnavailable, "failed to look up iam role: %v", err)
 	}
 	log.Debugf("AWS iam role is %s\n", string(iamRole))
 
 	iamCredentialsUrl := "http://169.254.169.254/latest/meta-data/iam/security-credentials/" + string(iamRole)
 	securityCredResp, err := awsMetaDataRequest(iamCredentialsUrl)
 	if err != nil {
-		errors.Cause(err)
+		return nil, errors.Wrapf(ErrCredentialsUnavailable, "failed to get credentials for iam role %s: %v", iamRole, err)
 	}
 	awsCreds := &awsSecurityCreds{}
 	err = json.Unmarshal(securityCredResp, awsCreds)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrapf(ErrCredentialsUnavailable, "failed to parse credentials for iam role %s: %v", iamRole, err)
 	}
 
 	creds := credentials.NewStaticCredentials(awsCreds.AccessKeyId, awsCreds.SecretAccessKey, awsCreds.Token)
-	cfg := aws.NewConfig().WithRegion("us-east-2").WithCredentials(creds)
+	cfg := aws.NewConfig().WithRegion(region).WithCredentials(creds)
 	sess, err := session.NewSession(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create aws session")
@@ -98,9 +130,9 @@ func CmdRun(ctx context.Context, cmdLine []string) error {
 	case <-stop:
 		procCancel()
 		err := <-done
-		return errors.Wrapf(err, "command failed %v %s %s", cmdLine, stderr.String(), stdout.String())
+		return errors.Wrapf(err, "command failed %s %s %s", redact.Command(cmdLine), stderr.String(), stdout.String())
 	case err := <-done:
 		procCancel()
-		return errors.Wrapf(err, "command failed %v %s %s", cmdLine, stderr.String(), stdout.String())
+		return errors.Wrapf(err, "command failed %s %s %s", redact.Command(cmdLine), stderr.String(), stdout.String())
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/archive"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/restore"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/snapshots"
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+// Exit codes returned by mysqlrestore, documented in the README for the runbooks.
+const (
+	exitOK                     = 0
+	exitFailure                = 1
+	exitUsage                  = 2
+	exitNoSnapshots            = 3
+	exitSnapshotNotFound       = 4
+	exitChainBroken            = 5
+	exitCredentialsUnavailable = 6
+	exitPreflightFailed        = 7
+	exitThawPending            = 8
+)
+
+func exitCode(err error) int {
+	switch errors.Cause(err) {
+	case nil:
+		return exitOK
+	case snapshots.ErrNoSnapshots:
+		return exitNoSnapshots
+	case snapshots.ErrSnapshotNotFound:
+		return exitSnapshotNotFound
+	case restore.ErrChainBroken:
+		return exitChainBroken
+	case execute.ErrCredentialsUnavailable, encryption.ErrKeyRequired:
+		return exitCredentialsUnavailable
+	case preflight.ErrInsufficientSpace, preflight.ErrMissingCommand:
+		return exitPreflightFailed
+	case archive.ErrThawPending:
+		return exitThawPending
+	default:
+		return exitFailure
+	}
+}
+
+// fatal logs the error and exits with the code matching its cause.
+func fatal(err error) {
+	log.Error(err)
+	os.Exit(exitCode(err))
+}
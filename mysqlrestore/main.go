@@ -2,18 +2,29 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/onrik/logrus/filename"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlcli"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/archive"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/restore"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/snapshots"
+	"bb.dev.norvax.net/dep/operator/backups/notify"
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
 	"bb.dev.norvax.net/dep/operator/cli"
 )
 
@@ -27,14 +38,20 @@ func init() {
 	filenameHook := filename.NewHook()
 	filenameHook.Field = "source"
 	log.AddHook(filenameHook)
+	log.AddHook(redact.Hook{})
+	for _, env := range []string{"MYSQL_PASSWORD", "REPLICATION_PASSWORD", "SMTP_PASSWORD"} {
+		redact.AddSecret(os.Getenv(env))
+	}
 }
 
 var (
-	op          = flag.String("operation", "", "operation to be run: list, restore snapshotX, latest to restore latest snapshot")
-	cluster     = flag.String("cluster", "", "cluster to list or restore from(cluster one or two")
+	op          = flag.String("operation", "", "operation to be run: list, restore snapshotX, latest to restore latest snapshot, seed-replica to restore a snapshot and start replicating from -source_host, logical-restore to load a mysqldump snapshot, thaw to request restores of a snapshot's archived files ahead of a restore, rebuild-catalog to recreate the cluster's catalog from a listing of the bucket")
+	cluster     = flag.String("cluster", "", "cluster to list or restore from(cluster one or two), not needed when -snapshot is a full snapshot path")
 	env         = flag.String("env", "", "environment to use(dev, qa, ga, or prod)")
 	bucket      = flag.String("bucket", "", "s3 bucket that holds mysql backups")
-	snapshot    = flag.String("snapshot", "", "snapshot to be restored(if performing a restore operation")
+	s3Endpoint  = flag.String("s3_endpoint", "", "endpoint of an S3 compatible store to use instead of AWS, e.g. MinIO, credentials are then read from the environment")
+	awsRegion   = flag.String("aws_region", execute.DefaultRegion, "region of the s3 bucket")
+	snapshot    = flag.String("snapshot", "", "snapshot to be restored(if performing a restore operation), either <env>/mysql/cluster_<cluster>/<year>/<month>/<snapshot> as printed by list or a snapshot name used with -env and -cluster")
 	restoreDir  = flag.String("directory", "", "restore directory to use for full and incremental backups.")
 	debug       = flag.Bool("debug", false, "change log level to debug(default: false)")
 	datadir     = flag.String("datadir", "/var/lib/mysql/data", "default location for mysql datadir")
@@ -42,6 +59,77 @@ var (
 	GitCommit   string
 	BuildTime   string
 	Semver      string
+
+	downloadWorkers = flag.Int("download_workers", archive.DefaultDownloadWorkers, "number of snapshot files to download at the same time")
+	extractWorkers  = flag.Int("extract_workers", archive.DefaultExtractWorkers, "number of snapshot files to untar at the same time")
+	partSize        = flag.Int64("part_size", archive.DefaultPartSize, "size in bytes of each ranged request used to download a snapshot file")
+	partConcurrency = flag.Int("part_concurrency", archive.DefaultPartConcurrency, "number of ranged requests in flight for each snapshot file")
+	thawDays        = flag.Int64("thaw_days", archive.DefaultThawDays, "days the restored copies of GLACIER and DEEP_ARCHIVE archives are kept")
+	thawTier        = flag.String("thaw_tier", "Standard", "retrieval tier of GLACIER and DEEP_ARCHIVE archives: Expedited, Standard or Bulk")
+	thawWait        = flag.Duration("thaw_wait", 12*time.Hour, "how long a restore waits for GLACIER and DEEP_ARCHIVE archives to be restored before it gives up")
+
+	output  = flag.String("output", snapshots.OutputText, "list output format: text, table or json")
+	since   = flag.String("since", "", "only list snapshots started at or after this time(2006-01-02 or RFC3339)")
+	until   = flag.String("until", "", "only list snapshots started at or before this time(2006-01-02 for the end of that day, or RFC3339)")
+	limit   = flag.Int("limit", 0, "only list the most recent N snapshots(default: all)")
+	details = flag.Bool("details", false, "also list the tags and metadata of every listed snapshot's archives, two requests per archive")
+
+	databases         = flag.String("databases", "", "comma separated databases to restore instead of the whole datadir")
+	tables            = flag.String("tables", "", "comma separated database.table list to restore instead of the whole datadir")
+	partialMode       = flag.String("partial_mode", "import", "how -databases and -tables are restored: import tablespaces into the running server or dump them as SQL")
+	dumpFile          = flag.String("dump_file", "", "file the SQL dump is written to when -partial_mode is dump")
+	mysqlUser         = flag.String("mysql_user", "root", "MySQL user used to import tablespaces, the password is read from MYSQL_PASSWORD")
+	mysqlSocket       = flag.String("mysql_socket", "/var/lib/mysql/mysql.sock", "socket of the local server, tablespaces are imported into it and -start_command waits for it")
+	mysqlPasswordFile = flag.String("mysql_password_file", "", "read the MySQL password from this file instead of MYSQL_PASSWORD")
+
+	mysqlHost    = flag.String("mysql_host", "", "host of the server logical-restore loads dumps into(default: the local server over -mysql_socket)")
+	mysqlPort    = flag.Int("mysql_port", 3306, "port of the server used with -mysql_host")
+	sslMode      = flag.String("ssl_mode", "", "--ssl-mode of the connection to -mysql_host, e.g. REQUIRED or VERIFY_IDENTITY")
+	sslCA        = flag.String("ssl_ca", "", "CA certificate file used to verify -mysql_host")
+	sslCert      = flag.String("ssl_cert", "", "client certificate file used to connect to -mysql_host")
+	sslKey       = flag.String("ssl_key", "", "client key file used to connect to -mysql_host")
+	loadParallel = flag.Int("load_parallel", 4, "number of databases logical-restore loads at the same time")
+
+	sourceHost         = flag.String("source_host", "", "host the seeded replica replicates from, the password is read from REPLICATION_PASSWORD")
+	sourcePort         = flag.Int("source_port", 3306, "port the seeded replica replicates from")
+	replicationUser    = flag.String("replication_user", "repl", "user the seeded replica replicates as")
+	coordinates        = flag.String("coordinates", restore.CoordinatesBinlog, "binlog to replicate from the backed up server, slave to replicate from the backed up server's master")
+	replicationTimeout = flag.Duration("replication_timeout", 5*time.Minute, "how long to wait for the seeded replica to start replicating")
+
+	owner        = flag.String("owner", "mysql", "user that owns the restored datadir, a name or uid")
+	group        = flag.String("group", "", "group that owns the restored datadir, a name or gid(default: the owner's primary group)")
+	dirMode      = flag.String("dir_mode", "", "octal mode applied to every restored directory, e.g. 0750(default: keep the backup's modes)")
+	fileMode     = flag.String("file_mode", "", "octal mode applied to every restored file, e.g. 0640(default: keep the backup's modes)")
+	preHook      = flag.String("pre_hook", "", "script run with the datadir as argument before the datadir is replaced")
+	postHook     = flag.String("post_hook", "", "script run with the datadir as argument after mysql is started")
+	service      = flag.String("service", "mysql", "systemd unit started after the restore")
+	startCommand = flag.String("start_command", "", "command used to start mysql instead of systemctl start <service>, it may keep running in the foreground")
+	startTimeout = flag.Duration("start_timeout", restore.DefaultStartTimeout, "how long mysql started with -start_command has to accept connections on -mysql_socket")
+	noStart      = flag.Bool("no_start", false, "do not start mysql after the restore")
+
+	moveBack      = flag.Bool("move_back", false, "move the prepared backup into the datadir instead of copying it, the backup is consumed")
+	innodbLogDir  = flag.String("innodb_log_dir", "", "directory the ib_logfile files are restored to when innodb_log_group_home_dir is outside the datadir")
+	innodbUndoDir = flag.String("innodb_undo_dir", "", "directory the undo tablespaces are restored to when innodb_undo_directory is outside the datadir")
+
+	decompressionFactor = flag.Float64("decompression_factor", 3, "how much larger a snapshot is once extracted and decompressed than its archives in s3, used to estimate the space a restore needs")
+	skipPreflight       = flag.Bool("skip_preflight", false, "do not check for free disk space and required commands before restoring")
+
+	notifyFlags     = notify.RegisterFlags(flag.CommandLine)
+	tuningFlags     = tuning.RegisterFlags(flag.CommandLine, tuning.RestoreDefault())
+	encryptionFlags = encryption.RegisterFlags(flag.CommandLine)
+
+	// target is the cluster to list or the snapshot to restore, it is parsed and validated once in setup.
+	target snapshots.Ref
+	// tableFilter selects the databases and tables of a partial restore, it is empty for a full restore.
+	tableFilter restore.TableFilter
+	// postActions configure ownership, hooks and how mysql is started after a full restore.
+	postActions restore.PostActions
+	// tuningParams are the innobackupex options used to prepare backups.
+	tuningParams tuning.Params
+	// encryptionOptions decrypt encrypted snapshots.
+	encryptionOptions encryption.Options
+	// notifier reports the outcome of restores, it has no routes when no -notify_* flag is set.
+	notifier *notify.Notifier
 )
 
 func setup() error {
@@ -51,16 +139,90 @@ func setup() error {
 		fmt.Println(version)
 		os.Exit(0)
 	}
-	switch *env {
-	case "dev", "qa", "ga", "prod", "testing":
-	default:
-		return errors.Errorf("invalid env %s.  Try qa, ga, prod", *env)
-	}
 	if *bucket == "" {
 		return errors.New("failed to specify s3 bucket")
 	}
-	if *op == "list" && *cluster == "" {
-		return errors.New("failed to specify which cluster to use(one or two).")
+	ref, err := targetRef()
+	if err != nil {
+		return err
+	}
+	target = ref
+	if *op == "list" && !snapshots.ValidOutput(*output) {
+		return errors.Errorf("invalid output %s.  Try text, table or json", *output)
+	}
+	if *limit < 0 {
+		return errors.Errorf("invalid limit %d, it must not be negative", *limit)
+	}
+	filter, err := restore.ParseTableFilter(*databases, *tables)
+	if err != nil {
+		return err
+	}
+	tableFilter = filter
+	switch *partialMode {
+	case "import":
+	case "dump":
+		if !tableFilter.Empty() && *dumpFile == "" {
+			return errors.New("need to specify -dump_file when -partial_mode is dump")
+		}
+	default:
+		return errors.Errorf("invalid partial_mode %s.  Try import or dump", *partialMode)
+	}
+	switch *thawTier {
+	case "Expedited", "Standard", "Bulk":
+	default:
+		return errors.Errorf("invalid thaw_tier %s.  Try Expedited, Standard or Bulk", *thawTier)
+	}
+	if *thawDays < 1 {
+		return errors.Errorf("invalid thaw_days %d, it must be at least 1", *thawDays)
+	}
+	if *decompressionFactor < 1 {
+		return errors.Errorf("invalid decompression_factor %v, it must be at least 1", *decompressionFactor)
+	}
+	// mysqld is stopped or not yet running while backups are prepared, the auto profile can use most of the memory.
+	if tuningParams, err = tuningFlags.Params(0.5); err != nil {
+		return err
+	}
+	if encryptionOptions, err = encryptionFlags.Options(); err != nil {
+		return err
+	}
+	if notifier, err = notifyFlags.Notifier("mysqlrestore"); err != nil {
+		return err
+	}
+	actions, err := restorePostActions()
+	if err != nil {
+		return err
+	}
+	postActions = actions
+	if *op == "seed-replica" {
+		if *noStart {
+			return errors.New("-no_start can not be used to seed a replica, mysql has to run to configure replication")
+		}
+		if *sourceHost == "" {
+			return errors.New("need to specify -source_host to seed a replica")
+		}
+		if os.Getenv("REPLICATION_PASSWORD") == "" {
+			return errors.New("environment variable REPLICATION_PASSWORD is not set")
+		}
+		if !tableFilter.Empty() {
+			return errors.New("-databases and -tables can not be used to seed a replica")
+		}
+		if *restoreDir == "" {
+			return errors.New("need to specify a directory to use for full and incremental backups")
+		}
+		if *coordinates != restore.CoordinatesBinlog && *coordinates != restore.CoordinatesSlave {
+			return errors.Errorf("invalid coordinates %s.  Try binlog or slave", *coordinates)
+		}
+	}
+	if *op == "logical-restore" {
+		if len(tableFilter.Tables) > 0 {
+			return errors.New("-tables can not be used with logical-restore, dumps are restored per database with -databases")
+		}
+		if *restoreDir == "" {
+			return errors.New("need to specify a directory to download the dumps to")
+		}
+		if *loadParallel < 1 {
+			return errors.Errorf("invalid load_parallel %d, it must be at least 1", *loadParallel)
+		}
 	}
 	if *op == "restore" && *restoreDir == "" {
 		return errors.New("need to specify a directory to use for full and incremental backups")
@@ -78,71 +240,418 @@ func setup() error {
 	return nil
 }
 
+// targetRef resolves the env, cluster and snapshot flags into a single snapshot reference.
+// A restore needs a complete snapshot reference, list and latest only need the env and cluster.
+// seed-replica, logical-restore and thaw use the snapshot when one is given and the latest one otherwise.
+func targetRef() (snapshots.Ref, error) {
+	if *op != "restore" && !((*op == "seed-replica" || *op == "logical-restore" || *op == "thaw") && *snapshot != "") {
+		ref := snapshots.Ref{Env: *env, Cluster: *cluster}
+		return ref, ref.ValidateCluster()
+	}
+	if *snapshot == "" {
+		return snapshots.Ref{}, errors.New("snapshot flag is not set so a restore cannot be performed")
+	}
+	if !strings.Contains(*snapshot, "/") {
+		return snapshots.NewRef(*env, *cluster, *snapshot)
+	}
+	ref, err := snapshots.ParseRef(*snapshot)
+	if err != nil {
+		return snapshots.Ref{}, err
+	}
+	if *env != "" && *env != ref.Env {
+		return snapshots.Ref{}, errors.Errorf("env %s does not match snapshot %s", *env, ref)
+	}
+	if *cluster != "" && *cluster != ref.Cluster {
+		return snapshots.Ref{}, errors.Errorf("cluster %s does not match snapshot %s", *cluster, ref)
+	}
+	return ref, nil
+}
+
+func parseMode(name, value string) (os.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("invalid %s %s, expected an octal mode such as 0750", name, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+func restorePostActions() (restore.PostActions, error) {
+	dirPerm, err := parseMode("dir_mode", *dirMode)
+	if err != nil {
+		return restore.PostActions{}, err
+	}
+	filePerm, err := parseMode("file_mode", *fileMode)
+	if err != nil {
+		return restore.PostActions{}, err
+	}
+	return restore.PostActions{
+		Owner:        *owner,
+		Group:        *group,
+		DirMode:      dirPerm,
+		FileMode:     filePerm,
+		PreHook:      *preHook,
+		PostHook:     *postHook,
+		Service:      *service,
+		StartCommand: strings.Fields(*startCommand),
+		NoStart:      *noStart,
+		Socket:       *mysqlSocket,
+		StartTimeout: *startTimeout,
+	}, nil
+}
+
+// parseTime accepts either a date or an RFC3339 timestamp, an empty value means no bound.
+// With endOfDay a date is the last instant of that day, so an upper bound includes the whole day.
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %s, use 2006-01-02 or RFC3339", value)
+	}
+	return t, nil
+}
+
+func listFilter() (snapshots.Filter, error) {
+	sinceTime, err := parseTime(*since, false)
+	if err != nil {
+		return snapshots.Filter{}, errors.Wrap(err, "invalid since flag")
+	}
+	untilTime, err := parseTime(*until, true)
+	if err != nil {
+		return snapshots.Filter{}, errors.Wrap(err, "invalid until flag")
+	}
+	return snapshots.Filter{Since: sinceTime, Until: untilTime, Limit: *limit}, nil
+}
+
+func tableRestorer() (restore.TableRestorer, func(), error) {
+	if *partialMode == "dump" {
+		return &restore.SQLDumper{DumpFile: *dumpFile, Owner: *owner}, func() {}, nil
+	}
+	db, err := openMysql()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &restore.TablespaceImporter{DB: db}, func() { db.Close() }, nil
+}
+
+// mysqlPassword reads -mysql_password_file, falling back to MYSQL_PASSWORD.
+func mysqlPassword() (string, error) {
+	if *mysqlPasswordFile != "" {
+		return mysqlcli.ReadPassword(*mysqlPasswordFile)
+	}
+	return os.Getenv("MYSQL_PASSWORD"), nil
+}
+
+// socketDSN is the DSN of a server on a unix socket.  The driver builds it, so passwords with @, / or : work.
+func socketDSN(user, password, socket string) string {
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = password
+	cfg.Net = "unix"
+	cfg.Addr = socket
+	return cfg.FormatDSN()
+}
+
+// openMysql connects to the local server on -mysql_socket.
+func openMysql() (*sql.DB, error) {
+	password, err := mysqlPassword()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", socketDSN(*mysqlUser, password, *mysqlSocket))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mysql connection")
+	}
+	return db, nil
+}
+
+// logicalRestore loads the dumps of a snapshot taken with mysqlbackup -engine mysqldump, the latest one when no
+// snapshot is given, into the server at -mysql_host or -mysql_socket.
+func logicalRestore(ctx context.Context, ref snapshots.Ref) error {
+	if ref.Name == "" {
+		latest, err := snapshots.LatestSnapshot(ctx, s3Options(), *bucket, ref)
+		if err != nil {
+			return err
+		}
+		ref = latest
+	}
+	if err := restore.ClearRestoreDir(*restoreDir); err != nil {
+		return err
+	}
+	if !*skipPreflight {
+		if err := preflightRestore(ctx, ref); err != nil {
+			return errors.Wrap(err, "pre-flight checks failed, use -skip_preflight to restore anyway")
+		}
+	}
+
+	password, err := mysqlPassword()
+	if err != nil {
+		return err
+	}
+	credentials, cleanup, err := mysqlcli.OptionFile(*mysqlUser, password)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	connection := mysqlcli.Connection{
+		Host:    *mysqlHost,
+		Port:    *mysqlPort,
+		Socket:  *mysqlSocket,
+		SSLMode: *sslMode,
+		SSLCA:   *sslCA,
+		SSLCert: *sslCert,
+		SSLKey:  *sslKey,
+	}
+	client := append(append([]string{"mysql"}, credentials...), connection.Args()...)
+
+	log.Infof("loading snapshot %v into %s", ref, strings.Join(connection.Args(), " "))
+	restorer := restore.LogicalRestorer{Client: client, Parallel: *loadParallel, Databases: tableFilter.Databases}
+	return restore.Logical(ctx, newRetriever(ref), *restoreDir, restorer)
+}
+
+// seedReplica restores the snapshot, starts mysql and points it at -source_host using the coordinates recorded in the backup.
+func seedReplica(ctx context.Context, ref snapshots.Ref) error {
+	if ref.Name == "" {
+		latest, err := snapshots.LatestSnapshot(ctx, s3Options(), *bucket, ref)
+		if err != nil {
+			return err
+		}
+		ref = latest
+	}
+	if err := restoreSnapshot(ctx, ref); err != nil {
+		return err
+	}
+
+	pos, err := restore.ReadBinlogPosition(*datadir, *coordinates)
+	if err != nil {
+		return err
+	}
+	db, err := openMysql()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	source := restore.ReplicationSource{
+		Host:     *sourceHost,
+		Port:     *sourcePort,
+		User:     *replicationUser,
+		Password: os.Getenv("REPLICATION_PASSWORD"),
+	}
+	return restore.SeedReplica(ctx, db, source, pos, *replicationTimeout)
+}
+
+// restoreSnapshot restores the whole datadir and starts mysql, or only the selected tables when a filter is set.
+func restoreSnapshot(ctx context.Context, ref snapshots.Ref) error {
+	log.Debugf("Clear out %s", *restoreDir)
+	if err := restore.ClearRestoreDir(*restoreDir); err != nil {
+		return err
+	}
+	if !*skipPreflight {
+		if err := preflightRestore(ctx, ref); err != nil {
+			return errors.Wrap(err, "pre-flight checks failed, use -skip_preflight to restore anyway")
+		}
+	}
+
+	if !tableFilter.Empty() {
+		restorer, closeRestorer, err := tableRestorer()
+		if err != nil {
+			return err
+		}
+		defer closeRestorer()
+		log.Infof("restoring %s %s from snapshot %v", strings.Join(tableFilter.Databases, ","), strings.Join(tableFilter.Tables, ","), ref)
+		if err := restore.Tables(ctx, newRetriever(ref), *restoreDir, tableFilter, tuningParams, encryptionOptions, restorer); err != nil {
+			return err
+		}
+		log.Infof("Restore Complete")
+		return nil
+	}
+
+	log.Infof("restoring snapshot %v, for env: %v", ref, ref.Env)
+	copyBack := restore.CopyBackOptions{Move: *moveBack, LogDir: *innodbLogDir, UndoDir: *innodbUndoDir}
+	if err := restore.Snapshot(ctx, newRetriever(ref), *restoreDir, *datadir, tuningParams, encryptionOptions, copyBack, postActions); err != nil {
+		return err
+	}
+	log.Infof("Restore Complete")
+	if err := postActions.Start(ctx); err != nil {
+		return err
+	}
+	return postActions.RunPostHook(ctx, *datadir)
+}
+
+// preflightRestore fails before anything is downloaded when the restore directory or the datadir
+// cannot hold the snapshot once it is extracted and decompressed.
+func preflightRestore(ctx context.Context, ref snapshots.Ref) error {
+	logical := *op == "logical-restore"
+	command := "innobackupex"
+	if logical {
+		command = "mysql"
+	}
+	if err := preflight.CheckCommands(command); err != nil {
+		return err
+	}
+	size, err := newRetriever(ref).Size(ctx)
+	if err != nil {
+		return err
+	}
+	extracted := int64(float64(size) * *decompressionFactor)
+	log.Infof("snapshot %v is %s in s3, about %s once extracted", ref, preflight.FormatBytes(size), preflight.FormatBytes(extracted))
+
+	requirements := []preflight.Requirement{
+		{Path: *restoreDir, Bytes: size + extracted, Purpose: "archives and extracted backups"},
+	}
+	if tableFilter.Empty() && !logical {
+		// files already in the datadir are overwritten, only the growth needs free space.
+		current, err := preflight.DirSize(*datadir)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+		renamed, err := preflight.SameFilesystem(*restoreDir, *datadir)
+		if err != nil {
+			return err
+		}
+		if !*moveBack || !renamed {
+			requirements = append(requirements, preflight.Requirement{Path: *datadir, Bytes: extracted - current, Purpose: "datadir"})
+		}
+	}
+	return preflight.CheckSpace(requirements...)
+}
+
+// finish notifies the outcome of a restore operation and exits with the matching code.
+func finish(ctx context.Context, ref snapshots.Ref, err error) {
+	fields := map[string]string{"operation": *op, "snapshot": ref.String(), "datadir": *datadir}
+	if !tableFilter.Empty() {
+		selected := append(append([]string{}, tableFilter.Databases...), tableFilter.Tables...)
+		fields["tables"] = strings.Join(selected, ",")
+	}
+	notifier.Result(ctx, notify.RestoreSucceeded, notify.RestoreFailed, "restore of "+ref.String(), fields, err)
+	if err != nil {
+		fatal(err)
+	}
+	os.Exit(exitOK)
+}
+
+// s3Options are the S3 endpoint and region of the -s3_endpoint and -aws_region flags.
+func s3Options() execute.S3Options {
+	return execute.S3Options{Endpoint: *s3Endpoint, Region: *awsRegion}
+}
+
+func newRetriever(snapshot snapshots.Ref) *archive.S3Retriever {
+	return &archive.S3Retriever{
+		S3:              s3Options(),
+		Bucket:          *bucket,
+		Snapshot:        snapshot,
+		DownloadWorkers: *downloadWorkers,
+		ExtractWorkers:  *extractWorkers,
+		PartSize:        *partSize,
+		PartConcurrency: *partConcurrency,
+		ThawOptions: archive.ThawOptions{
+			Days: *thawDays,
+			Tier: *thawTier,
+			Wait: *thawWait,
+		},
+	}
+}
+
+// thawSnapshot requests restores of the archived files of the snapshot, the latest one when none is given, so a later
+// restore does not have to wait for them.  It returns archive.ErrThawPending until every file can be downloaded.
+func thawSnapshot(ctx context.Context, ref snapshots.Ref) error {
+	if ref.Name == "" {
+		latest, err := snapshots.LatestSnapshot(ctx, s3Options(), *bucket, ref)
+		if err != nil {
+			return err
+		}
+		ref = latest
+	}
+	status, err := newRetriever(ref).Thaw(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot %s: %d archives, %d in glacier storage classes, %d still being restored\n", ref, status.Archives, status.Archived, status.Pending)
+	if !status.Ready() {
+		return errors.Wrapf(archive.ErrThawPending, "%d archives of %s are still being restored", status.Pending, ref)
+	}
+	return nil
+}
+
 func main() {
 	ctx := context.Background()
 	err := setup()
 	if err != nil {
 		flag.Usage()
-		log.Fatalln(err)
+		log.Error(err)
+		os.Exit(exitUsage)
 	}
 
 	switch *op {
 	case "list":
 		log.Debugf("listing snapshots for %v\n", *env)
-		snapshots, mostRecentSnapshot, err := snapshots.ListSnapshots(*env, *bucket, *cluster)
+		filter, err := listFilter()
 		if err != nil {
-			log.Fatalln(err)
-		}
-		usage := strings.Builder{}
-		usage.WriteString("Here are the list of snapshots.\n")
-		for _, snapshot := range snapshots {
-			usage.WriteString(fmt.Sprintf("Path: %+v, Snapshot: %+v, Timestamp: %+v\n", snapshot.Path, snapshot.SnapshotName, snapshot.Timestamp))
-		}
-		usage.WriteString("\n")
-		usage.WriteString("Select one to restore from, to use the most resent, execute the following command:\n")
-		txt := fmt.Sprintf("mysqlrestore -operation restore -env %s -bucket %s -snapshot %s -directory /opt/mysqlrestore -debug true", *env, *bucket, mostRecentSnapshot)
-		usage.WriteString(txt)
-		fmt.Println(usage.String())
-		os.Exit(0)
-	case "restore":
-		if err := restore.ClearRestoreDir(*restoreDir); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		log.Infof("restoring snapshot %v, for env: %v", *snapshot, *env)
-		if err := restore.Snapshot(ctx, &archive.S3Retriever{Bucket: *bucket, Snapshot: *snapshot}, *restoreDir, *datadir); err != nil {
-			log.Fatal(err)
-		}
-		log.Infof("Restore Complete")
-		log.Infof("Starting MySQL")
-		err := restore.StartMysql(ctx)
+		snapshotList, mostRecentSnapshot, err := snapshots.ListSnapshots(ctx, s3Options(), *bucket, target)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		os.Exit(0)
+		listing := snapshots.Listing{
+			Env:       target.Env,
+			Bucket:    *bucket,
+			Cluster:   target.Cluster,
+			Latest:    mostRecentSnapshot.String(),
+			Snapshots: snapshots.FilterSnapshots(snapshotList, filter),
+			Details:   *details,
+		}
+		if *details {
+			if err := snapshots.Describe(ctx, s3Options(), *bucket, listing.Snapshots); err != nil {
+				fatal(err)
+			}
+		}
+		if err := snapshots.WriteListing(os.Stdout, *output, listing); err != nil {
+			fatal(err)
+		}
+		os.Exit(exitOK)
+	case "restore":
+		finish(ctx, target, restoreSnapshot(ctx, target))
 	case "latest":
-		log.Debugf("Generate most resent snapshot %v\n", *env)
-		_, mostRecentSnapshot, err := snapshots.ListSnapshots(*env, *bucket, *cluster)
+		log.Debugf("Generate most resent snapshot %v\n", target.ClusterPrefix())
+		mostRecentSnapshot, err := snapshots.LatestSnapshot(ctx, s3Options(), *bucket, target)
 		if err != nil {
-			log.Fatalln(err)
+			finish(ctx, target, err)
 		}
-
-		log.Debugf("Clear out %s", *restoreDir)
-		if err := restore.ClearRestoreDir(*restoreDir); err != nil {
-			log.Fatal(err)
+		finish(ctx, mostRecentSnapshot, restoreSnapshot(ctx, mostRecentSnapshot))
+	case "seed-replica":
+		err := seedReplica(ctx, target)
+		if err == nil {
+			log.Infof("Replica seeded from %s", *sourceHost)
 		}
-
-		log.Infof("restoring snapshot %v, for env: %v", mostRecentSnapshot, *env)
-		if err := restore.Snapshot(ctx, &archive.S3Retriever{Bucket: *bucket, Snapshot: mostRecentSnapshot}, *restoreDir, *datadir); err != nil {
-			log.Fatal(err)
+		finish(ctx, target, err)
+	case "logical-restore":
+		finish(ctx, target, logicalRestore(ctx, target))
+	case "thaw":
+		if err := thawSnapshot(ctx, target); err != nil {
+			fatal(err)
 		}
-		log.Infof("Restore Complete")
-		log.Infof("Starting MySQL")
-		err = restore.StartMysql(ctx)
+		os.Exit(exitOK)
+	case "rebuild-catalog":
+		entries, err := snapshots.RebuildCatalog(ctx, s3Options(), *bucket, target)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		os.Exit(0)
+		log.Infof("catalog of %s rebuilt with %d archives", target.ClusterPrefix(), entries)
+		os.Exit(exitOK)
 	default:
-		log.Fatalf("operation not support %s, supported operations: list or restore\n", *op)
+		log.Errorf("operation not support %s, supported operations: list, restore, latest, seed-replica, logical-restore, thaw or rebuild-catalog\n", *op)
+		os.Exit(exitUsage)
 	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/archive"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/snapshots"
+)
+
+func TestParseTime(t *testing.T) {
+	assert := require.New(t)
+	since, err := parseTime("2019-05-01", false)
+	assert.NoError(err)
+	assert.Equal(time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC), since)
+
+	until, err := parseTime("2019-05-01", true)
+	assert.NoError(err)
+	assert.True(until.After(time.Date(2019, 5, 1, 23, 59, 59, 0, time.UTC)))
+	assert.True(until.Before(time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC)))
+
+	exact, err := parseTime("2019-05-01T12:00:00Z", true)
+	assert.NoError(err)
+	assert.Equal(time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC), exact)
+
+	_, err = parseTime("yesterday", false)
+	assert.Error(err)
+}
+
+func TestSocketDSN(t *testing.T) {
+	assert := require.New(t)
+	cfg, err := mysql.ParseDSN(socketDSN("restore", "p@ss/w:rd", "/var/lib/mysql/mysql.sock"))
+	assert.NoError(err)
+	assert.Equal("restore", cfg.User)
+	assert.Equal("p@ss/w:rd", cfg.Passwd)
+	assert.Equal("unix", cfg.Net)
+	assert.Equal("/var/lib/mysql/mysql.sock", cfg.Addr)
+}
+
+func TestExitCode(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal(exitOK, exitCode(nil))
+	assert.Equal(exitNoSnapshots, exitCode(errors.Wrap(snapshots.ErrNoSnapshots, "check bucket backups")))
+	assert.Equal(exitThawPending, exitCode(errors.Wrap(archive.ErrThawPending, "snapshot_2019_05_01")))
+	assert.Equal(exitCredentialsUnavailable, exitCode(errors.WithStack(encryption.ErrKeyRequired)))
+	assert.Equal(exitFailure, exitCode(errors.New("boom")))
+}
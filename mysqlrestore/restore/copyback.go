@@ -0,0 +1,215 @@
+package restore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	innodbLogFile  = regexp.MustCompile(`^ib_logfile\d+$`)
+	innodbUndoFile = regexp.MustCompile(`^undo\d+$`)
+)
+
+// lseek whences of Linux that find the data and holes of sparse files, the syscall package does not define them.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// CopyBackOptions controls how a prepared full backup is placed into the datadir.
+type CopyBackOptions struct {
+	// Move renames files out of the backup instead of copying them, so the restore does not need twice the disk space.
+	// Files are still copied when the backup and the datadir are on different filesystems.
+	Move bool
+	// LogDir and UndoDir receive the InnoDB redo logs and undo tablespaces when the server keeps them outside the datadir.
+	LogDir  string
+	UndoDir string
+}
+
+// Run places every file, directory and symlink of the backup into the datadir, preserving modes and mtimes.
+func (o CopyBackOptions) Run(fullBackupDir, datadir string) error {
+	if err := os.MkdirAll(datadir, 0700); err != nil {
+		return errors.Wrapf(err, "could not create directory %s", datadir)
+	}
+
+	var dirs []string
+	dirTimes := map[string]time.Time{}
+	walkFn := func(srcPath string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(fullBackupDir, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := o.destination(datadir, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "could not create directory %s", dstPath)
+			}
+			if err := os.Chmod(dstPath, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "could not chmod %s", dstPath)
+			}
+			dirs = append(dirs, dstPath)
+			dirTimes[dstPath] = info.ModTime()
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			return copySymlink(srcPath, dstPath)
+		case info.Mode().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+				return errors.Wrapf(err, "could not create directory %s", filepath.Dir(dstPath))
+			}
+			if o.Move {
+				return moveFile(srcPath, dstPath, info)
+			}
+			return copyRegularFile(srcPath, dstPath, info)
+		default:
+			log.Warnf("skipping %s, it is not a regular file, directory or symlink", srcPath)
+			return nil
+		}
+	}
+	if err := filepath.Walk(fullBackupDir, walkFn); err != nil {
+		return err
+	}
+
+	for _, dir := range append(dirs, o.LogDir, o.UndoDir) {
+		if dir == "" {
+			continue
+		}
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	// Directory mtimes change while their files are written, so they are restored last and deepest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := os.Chtimes(dir, dirTimes[dir], dirTimes[dir]); err != nil {
+			return errors.Wrapf(err, "could not set mtime of %s", dir)
+		}
+	}
+	return nil
+}
+
+// destination maps a path relative to the backup to where it belongs on the server.
+func (o CopyBackOptions) destination(datadir, rel string) string {
+	if !strings.Contains(rel, string(filepath.Separator)) {
+		if o.LogDir != "" && innodbLogFile.MatchString(rel) {
+			return filepath.Join(o.LogDir, rel)
+		}
+		if o.UndoDir != "" && innodbUndoFile.MatchString(rel) {
+			return filepath.Join(o.UndoDir, rel)
+		}
+	}
+	return filepath.Join(datadir, rel)
+}
+
+func copySymlink(srcPath, dstPath string) error {
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not read symlink %s", srcPath)
+	}
+	if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not replace %s", dstPath)
+	}
+	return errors.Wrapf(os.Symlink(target, dstPath), "could not create symlink %s", dstPath)
+}
+
+// moveFile renames the file and falls back to a copy when the datadir is on another filesystem.
+func moveFile(srcPath, dstPath string, info os.FileInfo) error {
+	err := os.Rename(srcPath, dstPath)
+	if err == nil {
+		return nil
+	}
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return errors.Wrapf(err, "could not move %s to %s", srcPath, dstPath)
+	}
+	if err := copyRegularFile(srcPath, dstPath, info); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Remove(srcPath), "could not remove %s after copying it", srcPath)
+}
+
+func copyRegularFile(srcPath, dstPath string, info os.FileInfo) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", srcPath)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return errors.Wrapf(err, "could not create %s", dstPath)
+	}
+	if err := copySparse(dst, src, info.Size()); err != nil {
+		dst.Close()
+		return errors.Wrapf(err, "could not copy %s to %s", srcPath, dstPath)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return errors.Wrapf(err, "could not sync %s", dstPath)
+	}
+	if err := dst.Close(); err != nil {
+		return errors.Wrapf(err, "could not close %s", dstPath)
+	}
+	// O_CREATE only applies the mode to new files and is subject to the umask.
+	if err := os.Chmod(dstPath, info.Mode().Perm()); err != nil {
+		return errors.Wrapf(err, "could not chmod %s", dstPath)
+	}
+	return errors.Wrapf(os.Chtimes(dstPath, info.ModTime(), info.ModTime()), "could not set mtime of %s", dstPath)
+}
+
+// copySparse copies only the data regions of src and leaves the holes of punch hole compressed tablespaces unallocated
+// in dst.  Filesystems that cannot report holes get a plain copy.
+func copySparse(dst, src *os.File, size int64) error {
+	var offset int64
+	for offset < size {
+		data, err := src.Seek(offset, seekData)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+				// only a hole is left.
+				break
+			}
+			return copyRange(dst, src, offset, size-offset)
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return copyRange(dst, src, offset, size-offset)
+		}
+		if err := copyRange(dst, src, data, hole-data); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return dst.Truncate(size)
+}
+
+func copyRange(dst, src *os.File, offset, length int64) error {
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(dst, src, length)
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "could not sync %s", dir)
+}
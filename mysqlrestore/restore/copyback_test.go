@@ -0,0 +1,99 @@
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createBackupLayout(t *testing.T, dir string, mtime time.Time) {
+	assert := require.New(t)
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "app"), 0750))
+	files := map[string]os.FileMode{
+		"ibdata1":       0640,
+		"ib_logfile0":   0640,
+		"undo001":       0640,
+		"app/users.ibd": 0600,
+	}
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(ioutil.WriteFile(path, []byte(name), mode))
+		assert.NoError(os.Chmod(path, mode))
+		assert.NoError(os.Chtimes(path, mtime, mtime))
+	}
+	assert.NoError(os.Symlink("users.ibd", filepath.Join(dir, "app", "link.ibd")))
+}
+
+func TestCopyBack(t *testing.T) {
+	for _, move := range []bool{false, true} {
+		assert := require.New(t)
+		dir, err := ioutil.TempDir("", "copyback")
+		assert.NoError(err)
+		defer os.RemoveAll(dir)
+
+		mtime := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+		backup := filepath.Join(dir, "backup")
+		createBackupLayout(t, backup, mtime)
+
+		options := CopyBackOptions{Move: move, LogDir: filepath.Join(dir, "logs"), UndoDir: filepath.Join(dir, "undo")}
+		datadir := filepath.Join(dir, "data")
+		assert.NoError(options.Run(backup, datadir))
+
+		info, err := os.Stat(filepath.Join(datadir, "app", "users.ibd"))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+		assert.True(info.ModTime().Equal(mtime), "mtime %v was not preserved", info.ModTime())
+
+		info, err = os.Stat(filepath.Join(datadir, "app"))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0750), info.Mode().Perm())
+
+		target, err := os.Readlink(filepath.Join(datadir, "app", "link.ibd"))
+		assert.NoError(err)
+		assert.Equal("users.ibd", target)
+
+		assert.FileExists(filepath.Join(dir, "logs", "ib_logfile0"))
+		assert.FileExists(filepath.Join(dir, "undo", "undo001"))
+		assert.FileExists(filepath.Join(datadir, "ibdata1"))
+
+		_, err = os.Stat(filepath.Join(backup, "ibdata1"))
+		assert.Equal(move, os.IsNotExist(err), "move: %v", move)
+	}
+}
+
+func TestCopySparseFile(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "sparse")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	const size = 8 << 20
+	src := filepath.Join(dir, "orders.ibd")
+	f, err := os.Create(src)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("page"), 2<<20)
+	assert.NoError(err)
+	assert.NoError(f.Truncate(size))
+	assert.NoError(f.Close())
+	info, err := os.Stat(src)
+	assert.NoError(err)
+	if info.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+		t.Skip("the filesystem of the temporary directory does not support sparse files")
+	}
+
+	dst := filepath.Join(dir, "copy.ibd")
+	assert.NoError(copyRegularFile(src, dst, info))
+	copied, err := os.Stat(dst)
+	assert.NoError(err)
+	assert.Equal(int64(size), copied.Size())
+	assert.True(copied.Sys().(*syscall.Stat_t).Blocks*512 < size, "holes are not allocated")
+	content, err := ioutil.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal("page", string(content[2<<20:2<<20+4]))
+	assert.Equal(make([]byte, 2<<20), content[:2<<20])
+}
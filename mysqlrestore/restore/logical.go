@@ -0,0 +1,140 @@
+package restore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+// dumpSuffix names the per database dumps mysqlbackup -engine mysqldump writes.
+const dumpSuffix = ".sql.gz"
+
+// ErrNoDumps is returned when a snapshot restored as logical backup holds no database dumps.
+var ErrNoDumps = errors.New("no logical dumps found")
+
+// LogicalRestorer loads the per database dumps of a logical backup with the mysql client.
+type LogicalRestorer struct {
+	// Client is the mysql command line including login and connection options.
+	Client []string
+	// Parallel is the number of databases loaded at the same time.
+	Parallel int
+	// Databases limits the restore to these databases, every dump is loaded when it is empty.
+	Databases []string
+}
+
+// Logical downloads and extracts a logical backup and loads its dumps into the server the restorer connects to.
+// The dumps create their databases, existing tables of the same name are replaced.
+func Logical(ctx context.Context, retriever SnapshotRetriever, restoreDir string, restorer LogicalRestorer) error {
+	log.Debug("Downloading snapshot..")
+	if err := retriever.Get(ctx, restoreDir); err != nil {
+		return errors.Wrap(err, "failed to get snapshot from archive")
+	}
+	log.Infof("Untar backups")
+	if err := retriever.Prepare(ctx, restoreDir); err != nil {
+		return errors.Wrap(err, "failed to get snapshot from archive")
+	}
+
+	dumps, err := findDumps(restoreDir, restorer.Databases)
+	if err != nil {
+		return err
+	}
+	log.Infof("loading %d database dumps from %s", len(dumps), restoreDir)
+	return restorer.Load(ctx, dumps)
+}
+
+// findDumps maps database names to their dump files below restoreDir, limited to databases when it is not empty.
+func findDumps(restoreDir string, databases []string) (map[string]string, error) {
+	dumps := map[string]string{}
+	err := filepath.Walk(restoreDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), dumpSuffix) {
+			dumps[strings.TrimSuffix(info.Name(), dumpSuffix)] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to search %s for dumps", restoreDir)
+	}
+	if len(dumps) == 0 {
+		return nil, errors.Wrapf(ErrNoDumps, "in %s, was the snapshot taken with -engine mysqldump", restoreDir)
+	}
+	if len(databases) == 0 {
+		return dumps, nil
+	}
+
+	selected := map[string]string{}
+	for _, database := range databases {
+		path, ok := dumps[database]
+		if !ok {
+			return nil, errors.Wrapf(ErrNoDumps, "for database %s", database)
+		}
+		selected[database] = path
+	}
+	return selected, nil
+}
+
+// Load feeds every dump to the mysql client, Parallel at a time, and stops at the first failure.
+func (l LogicalRestorer) Load(ctx context.Context, dumps map[string]string) error {
+	databases := make([]string, 0, len(dumps))
+	for database := range dumps {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	parallel := l.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	group, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, parallel)
+	for _, database := range databases {
+		database := database
+		group.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			return l.loadDump(ctx, database, dumps[database])
+		})
+	}
+	return group.Wait()
+}
+
+func (l LogicalRestorer) loadDump(ctx context.Context, database, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open dump %s", path)
+	}
+	defer f.Close()
+	dump, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decompress dump %s", path)
+	}
+	defer dump.Close()
+
+	log.Infof("loading database %s from %s", database, path)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, l.Client[0], l.Client[1:]...)
+	cmd.Stdin = dump
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "failed to load %s with %s, stderr: %s", path, redact.Command(l.Client), stderr.String())
+	}
+	log.Infof("loaded database %s", database)
+	return nil
+}
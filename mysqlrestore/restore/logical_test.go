@@ -0,0 +1,59 @@
+package restore
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDump(t *testing.T, path, content string) {
+	assert := require.New(t)
+	f, err := os.Create(path)
+	assert.NoError(err)
+	w := gzip.NewWriter(f)
+	_, err = w.Write([]byte(content))
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	assert.NoError(f.Close())
+}
+
+func TestLogicalRestore(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "logical")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	backupDir := filepath.Join(dir, "2019_05_01_00_00_00Z")
+	assert.NoError(os.MkdirAll(backupDir, 0700))
+	for _, database := range []string{"app", "billing", "audit"} {
+		writeDump(t, filepath.Join(backupDir, database+dumpSuffix), "CREATE DATABASE "+database+";\n")
+	}
+
+	_, err = findDumps(dir, []string{"app", "missing"})
+	assert.Equal(ErrNoDumps, errors.Cause(err))
+
+	dumps, err := findDumps(dir, []string{"app", "billing"})
+	assert.NoError(err)
+	assert.Len(dumps, 2)
+
+	loaded := filepath.Join(dir, "loaded.sql")
+	restorer := LogicalRestorer{Client: []string{"sh", "-c", "cat >> " + loaded}, Parallel: 1}
+	assert.NoError(restorer.Load(context.Background(), dumps))
+	content, err := ioutil.ReadFile(loaded)
+	assert.NoError(err)
+	statements := strings.Split(strings.TrimSpace(string(content)), "\n")
+	sort.Strings(statements)
+	assert.Equal([]string{"CREATE DATABASE app;", "CREATE DATABASE billing;"}, statements)
+
+	restorer.Client = []string{"sh", "-c", "echo access denied >&2; exit 1"}
+	err = restorer.Load(context.Background(), dumps)
+	assert.Contains(err.Error(), "access denied")
+}
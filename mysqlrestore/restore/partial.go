@@ -0,0 +1,410 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
+)
+
+// Table is a single table in a prepared backup.
+type Table struct {
+	Database string
+	Name     string
+}
+
+func (t Table) String() string {
+	return t.Database + "." + t.Name
+}
+
+// TableFilter selects the databases and tables restored from a snapshot.
+// Tables are given as database.table.
+type TableFilter struct {
+	Databases []string
+	Tables    []string
+}
+
+// ParseTableFilter parses the comma separated -databases and -tables flags.
+func ParseTableFilter(databases, tables string) (TableFilter, error) {
+	filter := TableFilter{Databases: splitList(databases), Tables: splitList(tables)}
+	for _, table := range filter.Tables {
+		parts := strings.Split(table, ".")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return TableFilter{}, errors.Errorf("invalid table %s, expected database.table", table)
+		}
+	}
+	return filter, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Empty reports whether the filter selects nothing, in which case the whole datadir is restored.
+func (f TableFilter) Empty() bool {
+	return len(f.Databases) == 0 && len(f.Tables) == 0
+}
+
+func (f TableFilter) Match(table Table) bool {
+	for _, database := range f.Databases {
+		if database == table.Database {
+			return true
+		}
+	}
+	for _, t := range f.Tables {
+		if t == table.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTables returns the tables in the prepared backup that match the filter.
+// Every database and table named by the filter has to exist in the backup.
+func selectTables(fullBackupDir string, filter TableFilter) ([]Table, error) {
+	entries, err := ioutil.ReadDir(fullBackupDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", fullBackupDir)
+	}
+
+	found := map[string]bool{}
+	var tables []Table
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		names, err := tableNames(filepath.Join(fullBackupDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			table := Table{Database: entry.Name(), Name: name}
+			if !filter.Match(table) {
+				continue
+			}
+			found[table.Database] = true
+			found[table.String()] = true
+			tables = append(tables, table)
+		}
+	}
+
+	var missing []string
+	for _, name := range append(append([]string{}, filter.Databases...), filter.Tables...) {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("not found in the snapshot: %s", strings.Join(missing, ", "))
+	}
+	return tables, nil
+}
+
+// tableNames lists the tables of a database directory from their .frm files, or .ibd files when there are none.
+func tableNames(databaseDir string) ([]string, error) {
+	for _, ext := range []string{".frm", ".ibd"} {
+		files, err := filepath.Glob(filepath.Join(databaseDir, "*"+ext))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list tables in %s", databaseDir)
+		}
+		if len(files) == 0 {
+			continue
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, strings.TrimSuffix(filepath.Base(file), ext))
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	return nil, nil
+}
+
+// TableRestorer restores the selected tables of a prepared full backup.
+type TableRestorer interface {
+	RestoreTables(ctx context.Context, fullBackupDir string, tables []Table) error
+}
+
+// Tables prepares the snapshot for export and hands the tables selected by the filter to the restorer.
+func Tables(ctx context.Context, retriever SnapshotRetriever, restoreDir string, filter TableFilter, params tuning.Params, crypt encryption.Options, restorer TableRestorer) error {
+	if filter.Empty() {
+		return errors.New("no databases or tables selected")
+	}
+
+	fullBackupDir, err := PrepareSnapshot(ctx, retriever, restoreDir, true, params, crypt)
+	if err != nil {
+		return err
+	}
+
+	tables, err := selectTables(fullBackupDir, filter)
+	if err != nil {
+		return err
+	}
+	log.Infof("restoring %d tables from %s", len(tables), fullBackupDir)
+	return restorer.RestoreTables(ctx, fullBackupDir, tables)
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func quoteTable(table Table) string {
+	return quoteIdentifier(table.Database) + "." + quoteIdentifier(table.Name)
+}
+
+// TablespaceImporter imports tablespaces into a running server with ALTER TABLE ... DISCARD/IMPORT TABLESPACE.
+// The tables have to exist on the server with the same definition they had when the backup was taken.
+type TablespaceImporter struct {
+	DB *sql.DB
+}
+
+func (t *TablespaceImporter) RestoreTables(ctx context.Context, fullBackupDir string, tables []Table) error {
+	var datadir string
+	if err := t.DB.QueryRowContext(ctx, "SELECT @@datadir").Scan(&datadir); err != nil {
+		return errors.Wrap(err, "failed to look up the server datadir")
+	}
+
+	conn, err := t.DB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get a database connection")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET SESSION foreign_key_checks = 0"); err != nil {
+		return errors.Wrap(err, "failed to disable foreign key checks")
+	}
+	// Closing conn returns it to the pool, the next user of the connection must not inherit the setting.
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SET SESSION foreign_key_checks = 1"); err != nil {
+			log.Errorf("failed to enable foreign key checks again: %v", err)
+		}
+	}()
+	for _, table := range tables {
+		if err := importTablespace(ctx, conn, fullBackupDir, datadir, table); err != nil {
+			return errors.Wrapf(err, "failed to import %s", table)
+		}
+		log.Infof("imported tablespace for %s", table)
+	}
+	return nil
+}
+
+func importTablespace(ctx context.Context, conn *sql.Conn, fullBackupDir, datadir string, table Table) error {
+	srcDir := filepath.Join(fullBackupDir, table.Database)
+	dstDir := filepath.Join(datadir, table.Database)
+	if _, err := os.Stat(filepath.Join(srcDir, table.Name+".ibd")); err != nil {
+		return errors.Wrapf(err, "%s has no tablespace in the backup, only innodb file per table tables can be imported", table)
+	}
+
+	var count int
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?"
+	if err := conn.QueryRowContext(ctx, query, table.Database, table.Name).Scan(&count); err != nil {
+		return errors.Wrap(err, "failed to check if the table exists")
+	}
+	if count == 0 {
+		return errors.Errorf("table %s does not exist on the server, create it with its original definition or use the dump mode", table)
+	}
+
+	dirInfo, err := os.Stat(dstDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat database directory %s", dstDir)
+	}
+	stat, ok := dirInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Errorf("failed to read the owner of %s", dstDir)
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DISCARD TABLESPACE", quoteTable(table))); err != nil {
+		return errors.Wrap(err, "failed to discard tablespace")
+	}
+	for _, ext := range []string{".ibd", ".cfg", ".exp"} {
+		src := filepath.Join(srcDir, table.Name+ext)
+		info, err := os.Stat(src)
+		if os.IsNotExist(err) && ext != ".ibd" {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", src)
+		}
+		dst := filepath.Join(dstDir, table.Name+ext)
+		if err := copyRegularFile(src, dst, info); err != nil {
+			return err
+		}
+		if err := os.Chown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.Wrapf(err, "failed to chown %s", dst)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s IMPORT TABLESPACE", quoteTable(table))); err != nil {
+		return errors.Wrap(err, "failed to import tablespace")
+	}
+	for _, ext := range []string{".cfg", ".exp"} {
+		os.Remove(filepath.Join(dstDir, table.Name+ext))
+	}
+	return nil
+}
+
+// SQLDumper starts a scratch mysqld on the prepared backup and dumps the tables with mysqldump into DumpFile.
+type SQLDumper struct {
+	DumpFile string
+	// Owner is the user the scratch mysqld runs as, it defaults to mysql.
+	Owner string
+	// StartTimeout is how long to wait for the scratch mysqld to accept connections.
+	StartTimeout time.Duration
+}
+
+func (d *SQLDumper) RestoreTables(ctx context.Context, fullBackupDir string, tables []Table) error {
+	if d.Owner == "" {
+		d.Owner = "mysql"
+	}
+	if err := (PostActions{Owner: d.Owner}).SetOwnership(fullBackupDir); err != nil {
+		return errors.Wrap(err, "scratch mysqld needs to own the backup directory")
+	}
+
+	socket := filepath.Join(filepath.Dir(fullBackupDir), "scratch-mysqld.sock")
+	stop, err := d.startScratchMysqld(ctx, fullBackupDir, socket)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	dumpFile, err := os.OpenFile(d.DumpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create dump file %s", d.DumpFile)
+	}
+	defer dumpFile.Close()
+
+	for _, args := range dumpArguments(tables) {
+		// mysqldump only names the database with --databases, which cannot be combined with a table list.
+		if _, err := dumpFile.WriteString(useDatabase(args[0])); err != nil {
+			return errors.Wrapf(err, "failed to write to dump file %s", d.DumpFile)
+		}
+		cmdLine := append([]string{
+			"mysqldump",
+			"--socket=" + socket,
+			"--user=root",
+			"--single-transaction",
+			"--routines",
+			"--triggers",
+		}, args...)
+		log.Debugf("executing %s", redact.Command(cmdLine))
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+		cmd.Stdout = dumpFile
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "cmd failed %s, stderr: %s", redact.Command(cmdLine), stderr.String())
+		}
+	}
+	log.Infof("dumped %d tables to %s", len(tables), d.DumpFile)
+	return errors.Wrapf(dumpFile.Sync(), "failed to sync %s", d.DumpFile)
+}
+
+// useDatabase creates the database if needed and switches to it, so the tables that follow in the dump are loaded into
+// the database they were dumped from.
+func useDatabase(database string) string {
+	return fmt.Sprintf("\nCREATE DATABASE IF NOT EXISTS %s;\nUSE %s;\n", quoteIdentifier(database), quoteIdentifier(database))
+}
+
+// dumpArguments groups the tables by database into mysqldump arguments, the database comes first.
+func dumpArguments(tables []Table) [][]string {
+	var databases []string
+	byDatabase := map[string][]string{}
+	for _, table := range tables {
+		if _, ok := byDatabase[table.Database]; !ok {
+			databases = append(databases, table.Database)
+		}
+		byDatabase[table.Database] = append(byDatabase[table.Database], table.Name)
+	}
+
+	var args [][]string
+	for _, database := range databases {
+		args = append(args, append([]string{database}, byDatabase[database]...))
+	}
+	return args
+}
+
+func (d *SQLDumper) startScratchMysqld(ctx context.Context, fullBackupDir, socket string) (func(), error) {
+	cmdLine := []string{
+		"mysqld",
+		"--defaults-file=" + filepath.Join(fullBackupDir, "backup-my.cnf"),
+		"--datadir=" + fullBackupDir,
+		"--socket=" + socket,
+		"--pid-file=" + filepath.Join(filepath.Dir(fullBackupDir), "scratch-mysqld.pid"),
+		"--log-error=" + filepath.Join(filepath.Dir(fullBackupDir), "scratch-mysqld.err"),
+		"--user=" + d.Owner,
+		"--skip-networking",
+		"--skip-grant-tables",
+		"--skip-slave-start",
+	}
+	log.Infof("starting scratch mysqld: %s", redact.Command(cmdLine))
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start scratch mysqld")
+	}
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Infof("scratch mysqld exited: %v", err)
+		close(exited)
+	}()
+	stop := func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		<-exited
+	}
+
+	timeout := d.StartTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	db, err := sql.Open("mysql", fmt.Sprintf("root@unix(%s)/", socket))
+	if err != nil {
+		stop()
+		return nil, errors.Wrap(err, "failed to open scratch mysqld connection")
+	}
+	defer db.Close()
+	if err := waitForMysql(ctx, db, timeout, exited); err != nil {
+		stop()
+		return nil, errors.Wrap(err, "scratch mysqld did not start, check scratch-mysqld.err")
+	}
+	return stop, nil
+}
+
+// waitForMysql pings the server until it answers, the timeout passes or the process exits.
+// exited can be nil when the server is not a child process.
+func waitForMysql(ctx context.Context, db *sql.DB, timeout time.Duration, exited <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if err := db.PingContext(ctx); err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return errors.New("mysqld exited before accepting connections")
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "mysqld did not accept connections")
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectTables(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "partial")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"app/users.frm", "app/users.ibd", "app/orders.frm", "app/orders.ibd", "audit/events.frm", "mysql/user.frm"} {
+		assert.NoError(os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0700))
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, file), nil, 0600))
+	}
+
+	filter, err := ParseTableFilter("audit", "app.users")
+	assert.NoError(err)
+	tables, err := selectTables(dir, filter)
+	assert.NoError(err)
+	assert.Equal([]Table{{"app", "users"}, {"audit", "events"}}, tables)
+
+	filter, err = ParseTableFilter("", "app.missing")
+	assert.NoError(err)
+	_, err = selectTables(dir, filter)
+	assert.Error(err)
+
+	_, err = ParseTableFilter("", "users")
+	assert.Error(err)
+}
+
+func TestDumpArguments(t *testing.T) {
+	assert := require.New(t)
+	args := dumpArguments([]Table{{"app", "users"}, {"audit", "events"}, {"app", "orders"}})
+	assert.Equal([][]string{{"app", "users", "orders"}, {"audit", "events"}}, args)
+	assert.Equal("\nCREATE DATABASE IF NOT EXISTS `a``b`;\nUSE `a``b`;\n", useDatabase("a`b"))
+}
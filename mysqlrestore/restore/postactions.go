@@ -0,0 +1,210 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+// PostActions configures what happens to the datadir around a restore.
+// Hooks are called with the datadir as their only argument.
+type PostActions struct {
+	// Owner and Group own every restored file, they can be names or numeric ids.
+	// An empty Group uses the primary group of Owner.
+	Owner string
+	Group string
+	// DirMode and FileMode are applied to every restored directory and file when they are not zero.
+	DirMode  os.FileMode
+	FileMode os.FileMode
+
+	// PreHook runs before the datadir is replaced, PostHook runs after mysql is started.
+	PreHook  string
+	PostHook string
+
+	// Service is the systemd unit started after the restore, StartCommand replaces systemctl when it is set.
+	// StartCommand may run mysqld in the foreground, it is left running once mysql accepts connections on Socket.
+	Service      string
+	StartCommand []string
+	NoStart      bool
+	Socket       string
+	// StartTimeout is how long StartCommand has to get mysql to accept connections, DefaultStartTimeout when 0.
+	StartTimeout time.Duration
+}
+
+// DefaultStartTimeout leaves mysql time for crash recovery after a restore.
+const DefaultStartTimeout = 10 * time.Minute
+
+// startPollInterval is how often the socket is checked while mysql starts.
+const startPollInterval = 200 * time.Millisecond
+
+// DefaultPostActions matches a systemd host running the mysql unit as the mysql user.
+func DefaultPostActions() PostActions {
+	return PostActions{Owner: "mysql", Service: "mysql"}
+}
+
+// ownerIDs resolves Owner and Group into a uid and gid.
+func (p PostActions) ownerIDs() (int, int, error) {
+	owner := p.Owner
+	if owner == "" {
+		owner = "mysql"
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		if u, err = user.LookupId(owner); err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to look up user %s", owner)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	gidValue := u.Gid
+	if p.Group != "" {
+		g, err := user.LookupGroup(p.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(p.Group); err != nil {
+				return 0, 0, errors.Wrapf(err, "failed to look up group %s", p.Group)
+			}
+		}
+		gidValue = g.Gid
+	}
+	gid, err := strconv.Atoi(gidValue)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// SetOwnership chowns everything under dir and applies the configured modes.
+func (p PostActions) SetOwnership(dir string) error {
+	uid, gid, err := p.ownerIDs()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("chown -R %d:%d for %s", uid, gid, dir)
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(name, uid, gid); err != nil {
+			return errors.Wrapf(err, "could not chown %s", name)
+		}
+		mode := p.FileMode
+		if info.IsDir() {
+			mode = p.DirMode
+		}
+		if mode == 0 || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return errors.Wrapf(os.Chmod(name, mode), "could not chmod %s", name)
+	})
+}
+
+func (p PostActions) startCommand() []string {
+	if len(p.StartCommand) > 0 {
+		return p.StartCommand
+	}
+	service := p.Service
+	if service == "" {
+		service = "mysql"
+	}
+	return []string{"/bin/systemctl", "start", service}
+}
+
+// Start starts mysql with the configured command unless NoStart is set.
+func (p PostActions) Start(ctx context.Context) error {
+	if p.NoStart {
+		log.Infof("not starting mysql, it was disabled")
+		return nil
+	}
+
+	startMysqlCmdLine := p.startCommand()
+	log.Infof("starting mysql: %s", redact.Command(startMysqlCmdLine))
+	if len(p.StartCommand) > 0 {
+		return p.startDetached(ctx, startMysqlCmdLine)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := execute.CmdRun(ctx, startMysqlCmdLine); err != nil {
+		return errors.Wrapf(err, "cmd failed %s.", redact.Command(startMysqlCmdLine))
+	}
+	return nil
+}
+
+// startDetached runs the start command in its own session so a command that keeps mysqld in the foreground, like
+// mysqld_safe, outlives mysqlrestore, and waits until mysql accepts connections on Socket.  A command that daemonizes
+// and exits successfully works as well, a command that fails before mysql is up fails the start.
+func (p PostActions) startDetached(ctx context.Context, cmdLine []string) error {
+	if p.Socket == "" {
+		return errors.New("a start command needs the socket of mysql to know when it started")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "cmd failed %s", redact.Command(cmdLine))
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timeout := p.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		if conn, err := net.Dial("unix", p.Socket); err == nil {
+			conn.Close()
+			log.Infof("mysql accepts connections on %s", p.Socket)
+			return nil
+		}
+		select {
+		case err := <-exited:
+			if err != nil {
+				return errors.Wrapf(err, "cmd failed %s, stderr: %s", redact.Command(cmdLine), stderr.String())
+			}
+			// the command daemonized mysql, keep waiting for the socket.
+			exited = nil
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "mysql started with %s does not accept connections on %s", redact.Command(cmdLine), p.Socket)
+		case <-time.After(startPollInterval):
+		}
+	}
+}
+
+func (p PostActions) RunPreHook(ctx context.Context, datadir string) error {
+	return runHook(ctx, "pre", p.PreHook, datadir)
+}
+
+func (p PostActions) RunPostHook(ctx context.Context, datadir string) error {
+	return runHook(ctx, "post", p.PostHook, datadir)
+}
+
+func runHook(ctx context.Context, name, hook, datadir string) error {
+	if hook == "" {
+		return nil
+	}
+	log.Infof("running %s hook %s", name, hook)
+	if err := execute.CmdRun(ctx, []string{hook, datadir}); err != nil {
+		return errors.Wrapf(err, "%s hook %s failed", name, hook)
+	}
+	return nil
+}
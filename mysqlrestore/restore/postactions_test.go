@@ -0,0 +1,71 @@
+package restore
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOwnershipModes(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "postactions")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "app"), 0700))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "app", "users.ibd"), nil, 0600))
+
+	current, err := user.Current()
+	assert.NoError(err)
+	actions := PostActions{Owner: current.Uid, DirMode: 0750, FileMode: 0640}
+	assert.NoError(actions.SetOwnership(dir))
+
+	info, err := os.Stat(filepath.Join(dir, "app"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, "app", "users.ibd"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestStartCommand(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal([]string{"/bin/systemctl", "start", "mysql"}, DefaultPostActions().startCommand())
+	assert.Equal([]string{"/bin/systemctl", "start", "mysqld"}, PostActions{Service: "mysqld"}.startCommand())
+	assert.Equal([]string{"mysqld_safe", "--user=mysql"}, PostActions{Service: "mysqld", StartCommand: []string{"mysqld_safe", "--user=mysql"}}.startCommand())
+}
+
+func TestStartDetached(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "start")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "mysql.sock")
+	ctx := context.Background()
+
+	// A foreground command does not block the start once the socket accepts connections.
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		listener, err := net.Listen("unix", socket)
+		if err == nil {
+			defer listener.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	start := time.Now()
+	assert.NoError(PostActions{StartCommand: []string{"sleep", "10"}, Socket: socket, StartTimeout: 5 * time.Second}.Start(ctx))
+	assert.True(time.Since(start) < 5*time.Second)
+
+	err = PostActions{StartCommand: []string{"false"}, Socket: filepath.Join(dir, "missing.sock")}.Start(ctx)
+	assert.Error(err)
+	err = PostActions{StartCommand: []string{"true"}, Socket: filepath.Join(dir, "missing.sock"), StartTimeout: time.Second}.Start(ctx)
+	assert.Equal(context.DeadlineExceeded, errors.Cause(err))
+}
@@ -0,0 +1,207 @@
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CoordinatesBinlog replicates from the server the backup was taken on, using xtrabackup_binlog_info.
+	CoordinatesBinlog = "binlog"
+	// CoordinatesSlave replicates from the master of the server the backup was taken on, using xtrabackup_slave_info.
+	CoordinatesSlave = "slave"
+)
+
+var (
+	slaveInfoLogFile = regexp.MustCompile(`MASTER_LOG_FILE\s*=\s*'([^']+)'`)
+	slaveInfoLogPos  = regexp.MustCompile(`MASTER_LOG_POS\s*=\s*(\d+)`)
+	slaveInfoGTID    = regexp.MustCompile(`gtid_purged\s*=\s*'([^']*)'`)
+)
+
+// BinlogPosition is where a restored server starts replicating from.
+// When GTIDSet is set the replica uses auto positioning instead of File and Position.
+type BinlogPosition struct {
+	File     string
+	Position uint64
+	GTIDSet  string
+}
+
+func (p BinlogPosition) String() string {
+	if p.GTIDSet != "" {
+		return "gtid " + p.GTIDSet
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Position)
+}
+
+// ReplicationSource is the server a seeded replica replicates from.
+type ReplicationSource struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+}
+
+// ReadBinlogPosition reads the coordinates recorded by xtrabackup in a restored datadir.
+func ReadBinlogPosition(datadir, coordinates string) (BinlogPosition, error) {
+	switch coordinates {
+	case CoordinatesBinlog:
+		return readBinlogInfo(filepath.Join(datadir, "xtrabackup_binlog_info"))
+	case CoordinatesSlave:
+		return readSlaveInfo(filepath.Join(datadir, "xtrabackup_slave_info"))
+	default:
+		return BinlogPosition{}, errors.Errorf("coordinates %s not supported, use %s or %s", coordinates, CoordinatesBinlog, CoordinatesSlave)
+	}
+}
+
+// readBinlogInfo parses "<file>\t<position>[\t<gtid set>]".
+func readBinlogInfo(path string) (BinlogPosition, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return BinlogPosition{}, errors.Wrapf(err, "failed to read %s, was binary logging enabled on the backed up server", path)
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) < 2 {
+		return BinlogPosition{}, errors.Errorf("unexpected content in %s: %q", path, content)
+	}
+	position, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return BinlogPosition{}, errors.Wrapf(err, "invalid binlog position in %s", path)
+	}
+	pos := BinlogPosition{File: fields[0], Position: position}
+	if len(fields) > 2 {
+		// GTID sets spanning several servers are written comma separated across lines.
+		pos.GTIDSet = strings.Join(fields[2:], "")
+	}
+	return pos, nil
+}
+
+// readSlaveInfo parses the CHANGE MASTER statement xtrabackup writes when --slave-info is used on a replica.
+func readSlaveInfo(path string) (BinlogPosition, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return BinlogPosition{}, errors.Wrapf(err, "failed to read %s, was the backup taken on a replica", path)
+	}
+	if match := slaveInfoGTID.FindSubmatch(content); match != nil {
+		return BinlogPosition{GTIDSet: strings.Replace(string(match[1]), "\n", "", -1)}, nil
+	}
+	file := slaveInfoLogFile.FindSubmatch(content)
+	position := slaveInfoLogPos.FindSubmatch(content)
+	if file == nil || position == nil {
+		return BinlogPosition{}, errors.Errorf("unexpected content in %s: %q", path, content)
+	}
+	pos, err := strconv.ParseUint(string(position[1]), 10, 64)
+	if err != nil {
+		return BinlogPosition{}, errors.Wrapf(err, "invalid binlog position in %s", path)
+	}
+	return BinlogPosition{File: string(file[1]), Position: pos}, nil
+}
+
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
+
+// changeMasterStatements returns the statements that point the restored server at the source.
+func changeMasterStatements(source ReplicationSource, pos BinlogPosition) []string {
+	change := fmt.Sprintf("CHANGE MASTER TO MASTER_HOST=%s, MASTER_PORT=%d, MASTER_USER=%s, MASTER_PASSWORD=%s",
+		quoteString(source.Host), source.Port, quoteString(source.User), quoteString(source.Password))
+	if pos.GTIDSet != "" {
+		return []string{
+			"STOP SLAVE",
+			"RESET SLAVE ALL",
+			"RESET MASTER",
+			fmt.Sprintf("SET GLOBAL gtid_purged=%s", quoteString(pos.GTIDSet)),
+			change + ", MASTER_AUTO_POSITION=1",
+		}
+	}
+	return []string{
+		"STOP SLAVE",
+		"RESET SLAVE ALL",
+		fmt.Sprintf("%s, MASTER_LOG_FILE=%s, MASTER_LOG_POS=%d", change, quoteString(pos.File), pos.Position),
+	}
+}
+
+// SeedReplica configures replication on a freshly restored server, starts it and waits until SHOW SLAVE STATUS is healthy.
+func SeedReplica(ctx context.Context, db *sql.DB, source ReplicationSource, pos BinlogPosition, timeout time.Duration) error {
+	if err := waitForMysql(ctx, db, timeout, nil); err != nil {
+		return err
+	}
+
+	log.Infof("replicating from %s:%d at %s", source.Host, source.Port, pos)
+	for _, statement := range changeMasterStatements(source, pos) {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			// Keep the password out of the logs, the statement itself is not part of the error.
+			return errors.Wrapf(err, "failed to configure replication, %s", strings.SplitN(statement, " MASTER_PASSWORD", 2)[0])
+		}
+	}
+	if _, err := db.ExecContext(ctx, "START SLAVE"); err != nil {
+		return errors.Wrap(err, "failed to start replication")
+	}
+	return waitForReplication(ctx, db, timeout)
+}
+
+// waitForReplication polls SHOW SLAVE STATUS until both replication threads are running.
+func waitForReplication(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		status, err := ShowSlaveStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		io, sqlThread := status["Slave_IO_Running"], status["Slave_SQL_Running"]
+		if io == "Yes" && sqlThread == "Yes" {
+			log.Infof("replication is running, seconds behind master: %s", status["Seconds_Behind_Master"])
+			return nil
+		}
+		if status["Last_IO_Error"] != "" || status["Last_SQL_Error"] != "" {
+			return errors.Errorf("replication failed, io thread: %s %s, sql thread: %s %s",
+				io, status["Last_IO_Error"], sqlThread, status["Last_SQL_Error"])
+		}
+		log.Debugf("waiting for replication, io thread: %s, sql thread: %s", io, sqlThread)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "replication did not start, io thread: %s, sql thread: %s", io, sqlThread)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// ShowSlaveStatus returns the SHOW SLAVE STATUS row keyed by column name, it is empty when the server is not a replica.
+func ShowSlaveStatus(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query slave status")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read slave status columns")
+	}
+	status := map[string]string{}
+	if !rows.Next() {
+		return status, errors.Wrap(rows.Err(), "failed to read slave status")
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, errors.Wrap(err, "failed to scan slave status")
+	}
+	for i, column := range columns {
+		status[column] = string(values[i])
+	}
+	return status, nil
+}
@@ -3,22 +3,24 @@ package restore
 import (
 	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"os/user"
-	"path"
 	"path/filepath"
-	"runtime"
-	"strconv"
-	"strings"
 
+	"bb.dev.norvax.net/dep/operator/backups/checkpoints"
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrChainBroken is returned when the backups in a snapshot do not form a full backup followed by
+// incrementals that each start where the previous backup ended.
+var ErrChainBroken = errors.New("backup chain broken")
+
 // Snapshot interface that splits up the restore into two Method.
 // Get: downloads the snapshot passed in at runtime.
 // Prepare: Will untar the snapshot(full and incrementals)
@@ -30,40 +32,65 @@ type SnapshotRetriever interface {
 
 // Generic function that is called in main.go to perform a full snapshot restore.
 // Combines all the functions in the mysqlrestore module(download, untar, decompress, prepare, etc..).
-func Snapshot(ctx context.Context, retriever SnapshotRetriever, restoreDir string, datadir string) error {
+// The post actions run their pre hook before the datadir is replaced and fix ownership and modes afterwards,
+// starting mysql is left to the caller.
+func Snapshot(ctx context.Context, retriever SnapshotRetriever, restoreDir string, datadir string, params tuning.Params, crypt encryption.Options, copyBack CopyBackOptions, actions PostActions) error {
+	fullBackupDir, err := PrepareSnapshot(ctx, retriever, restoreDir, false, params, crypt)
+	if err != nil {
+		return err
+	}
+
+	if err := actions.RunPreHook(ctx, datadir); err != nil {
+		return err
+	}
+
+	log.Infof("Moving full backupdir %s to %s", fullBackupDir, datadir)
+	if err = copyBack.Run(fullBackupDir, datadir); err != nil {
+		return errors.Wrapf(err, "unable to move full backup from %s to %s", restoreDir, datadir)
+	}
+
+	// mysqld has to own the redo logs and undo tablespaces placed outside the datadir as well.
+	for _, dir := range []string{datadir, copyBack.LogDir, copyBack.UndoDir} {
+		if dir == "" {
+			continue
+		}
+		if err := actions.SetOwnership(dir); err != nil {
+			return errors.Wrapf(err, "unable to set ownership of %s", dir)
+		}
+	}
+
+	return nil
+}
 
+// PrepareSnapshot downloads, untars, decrypts, decompresses and prepares a snapshot in restoreDir and returns the prepared full backup directory.
+// With export set the prepared tablespaces can be imported one at a time into another server.
+// crypt is only needed for snapshots mysqlbackup encrypted.
+func PrepareSnapshot(ctx context.Context, retriever SnapshotRetriever, restoreDir string, export bool, params tuning.Params, crypt encryption.Options) (string, error) {
 	log.Debug("Downloading snapshot..")
 	if err := retriever.Get(ctx, restoreDir); err != nil {
-		return errors.Wrap(err, "failed to get snapshot from archive")
+		return "", errors.Wrap(err, "failed to get snapshot from archive")
 	}
 
 	log.Infof("Untar backups")
 	if err := retriever.Prepare(ctx, restoreDir); err != nil {
-		return errors.Wrap(err, "failed to get snapshot from archive")
+		return "", errors.Wrap(err, "failed to get snapshot from archive")
+	}
+
+	if err := decryptMySQLFiles(ctx, restoreDir, crypt, params); err != nil {
+		return "", errors.Wrapf(err, "failed to decrypt snapshots")
 	}
 
 	log.Debugf("Decompressing snapshots in %s", restoreDir)
 	if err := decompressMySQLFiles(ctx, restoreDir); err != nil {
-		return errors.Wrapf(err, "failed to decompressMySQLFiles snapshots")
+		return "", errors.Wrapf(err, "failed to decompressMySQLFiles snapshots")
 	}
 
 	log.Debugf("Preparing snapshots")
-	fullBackupDir, err := prepare(ctx, restoreDir)
+	fullBackupDir, err := prepare(ctx, restoreDir, export, params)
 	if err != nil {
-		return errors.Wrapf(err, "failed to prepare snapshots")
-	}
-
-	log.Infof("Moving full backupdir %s to %s", fullBackupDir, datadir)
-	if err = moveFullBackup(fullBackupDir, datadir); err != nil {
-		return errors.Wrapf(err, "unable to move full backup from %s to /var/lib/mysql/data", restoreDir)
+		return "", errors.Wrapf(err, "failed to prepare snapshots")
 	}
-
-	log.Infof("Chown mysql:mysql %s", datadir)
-	if err := chownMysqlDir(datadir); err != nil {
-		return errors.Wrapf(err, "unable to move full backup from %s to %s", restoreDir, datadir)
-	}
-
-	return nil
+	return fullBackupDir, nil
 }
 
 // Will ensure that the restore directory that is passed in at runtime is empty.
@@ -94,16 +121,19 @@ func ClearRestoreDir(restoreDir string) error {
 	return nil
 }
 
+// DecompressScript decompresses the qpress compressed files below the directory it is run with, the rpm installs it.
+var DecompressScript = "/usr/local/bin/decompress_mysql_snapshot.sh"
+
 func decompressMySQLFiles(ctx context.Context, restoreDir string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	if _, err := os.Stat("/usr/local/bin/decompress_mysql_snapshot.sh"); os.IsNotExist(err) {
-		return errors.Wrapf(err, "/usr/local/bin/decompress_mysql_snapshot.sh does not exist on the server")
+	if _, err := os.Stat(DecompressScript); os.IsNotExist(err) {
+		return errors.Wrapf(err, "%s does not exist on the server", DecompressScript)
 	}
 
-	cmdLine := []string{"/usr/local/bin/decompress_mysql_snapshot.sh", restoreDir}
+	cmdLine := []string{DecompressScript, restoreDir}
 
-	log.Debugf("executing %s on directories %s", cmdLine, restoreDir)
+	log.Debugf("executing %s on directories %s", redact.Command(cmdLine), restoreDir)
 	err := execute.CmdRun(ctx, cmdLine)
 	if err != nil {
 		return errors.Wrapf(err, "cmd failed")
@@ -113,7 +143,45 @@ func decompressMySQLFiles(ctx context.Context, restoreDir string) error {
 	return nil
 }
 
-func prepare(ctx context.Context, restoreDir string) (string, error) {
+// decryptMySQLFiles decrypts the backups in restoreDir when they were encrypted, the files have to be decrypted before
+// they can be decompressed.
+func decryptMySQLFiles(ctx context.Context, restoreDir string, crypt encryption.Options, params tuning.Params) error {
+	encrypted, err := encryption.Encrypted(restoreDir)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return nil
+	}
+	if !crypt.Enabled() {
+		return errors.WithStack(encryption.ErrKeyRequired)
+	}
+	keyArgs, cleanup, err := crypt.Args(true)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	backupDirectories, err := ioutil.ReadDir(restoreDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, backupDir := range backupDirectories {
+		if !backupDir.IsDir() {
+			continue
+		}
+		cmdLine := append([]string{"innobackupex"}, keyArgs...)
+		cmdLine = params.Wrap(append(cmdLine, fmt.Sprintf("--parallel=%d", params.Parallel), "--remove-original", filepath.Join(restoreDir, backupDir.Name())))
+		log.Debugf("executing %s", redact.Command(cmdLine))
+		if err := execute.CmdRun(ctx, cmdLine); err != nil {
+			return errors.Wrapf(err, "cmd failed %s", redact.Command(cmdLine))
+		}
+	}
+	log.Infof("Successfully decrypted directories in %s", restoreDir)
+	return nil
+}
+
+func prepare(ctx context.Context, restoreDir string, export bool, params tuning.Params) (string, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	backupDirectories, err := ioutil.ReadDir(restoreDir)
@@ -122,7 +190,7 @@ func prepare(ctx context.Context, restoreDir string) (string, error) {
 	}
 
 	if len(backupDirectories) == 0 {
-		return "", errors.New("backup Directory is empty")
+		return "", errors.Wrapf(ErrChainBroken, "backup directory %s is empty", restoreDir)
 	}
 	var snapshotDir []string
 	for _, backupFile := range backupDirectories {
@@ -131,126 +199,63 @@ func prepare(ctx context.Context, restoreDir string) (string, error) {
 	log.Debugf("list of backups that need to be prepared for mysql restore: %s", snapshotDir)
 
 	fullBackupDir := snapshotDir[0]
-	if len(snapshotDir[0]) == 0 {
-		log.Errorf("Snapshot directory empty, could not find a full backup in %s", fullBackupDir)
+	if err := checkChain(snapshotDir); err != nil {
+		return "", err
 	}
 	log.Debugf("preparing full backup %s", fullBackupDir)
-	prepareCmdLine := []string{
-		"innobackupex",
-		"--apply-log",
-		"--redo-only",
-		fmt.Sprintf("---parallel=%d", runtime.NumCPU()),
-		"--use-memory=2G", fullBackupDir,
-	}
+	prepareCmdLine := append([]string{"innobackupex", "--apply-log", "--redo-only"}, params.PrepareArgs()...)
+	prepareCmdLine = params.Wrap(append(prepareCmdLine, fullBackupDir))
 
 	err = execute.CmdRun(ctx, prepareCmdLine)
 	if err != nil {
-		return "", errors.Wrapf(err, "cmd failed %s", strings.Join(prepareCmdLine, " "))
+		return "", errors.Wrapf(err, "cmd failed %s", redact.Command(prepareCmdLine))
 	}
 
 	for _, incrementalBackupPath := range snapshotDir[1:] {
 		log.Debugf("preparing incrementalBackupPath for incremental backups %s", incrementalBackupPath)
-		prepareCmdLine := []string{
-			"innobackupex",
-			"--apply-log",
-			"--redo-only",
-			fmt.Sprintf("---parallel=%d", runtime.NumCPU()),
-			"--use-memory=2G",
-			fullBackupDir, fmt.Sprintf("--incremental=%s", incrementalBackupPath),
-		}
+		prepareCmdLine := append([]string{"innobackupex", "--apply-log", "--redo-only"}, params.PrepareArgs()...)
+		prepareCmdLine = params.Wrap(append(prepareCmdLine, fullBackupDir, fmt.Sprintf("--incremental=%s", incrementalBackupPath)))
 
 		err := execute.CmdRun(ctx, prepareCmdLine)
 		if err != nil {
-			return "", errors.Wrapf(err, "cmd failed %s", strings.Join(prepareCmdLine, " "))
+			return "", errors.Wrapf(err, "cmd failed %s", redact.Command(prepareCmdLine))
 		}
 	}
 
-	log.Infof("Successfully prepared directory %s", restoreDir)
-	return fullBackupDir, nil
-}
-
-func moveFullBackup(fullBackupDir string, mysqlDataDir string) error {
-
-	if _, err := os.Stat(mysqlDataDir); os.IsNotExist(err) {
-		err := os.MkdirAll(mysqlDataDir, 0700)
-		if err != nil {
-			return errors.Wrapf(err, "could not create directory %s", mysqlDataDir)
+	if export {
+		log.Debugf("preparing %s for exporting tablespaces", fullBackupDir)
+		exportCmdLine := append([]string{"innobackupex", "--apply-log", "--export"}, params.PrepareArgs()...)
+		exportCmdLine = params.Wrap(append(exportCmdLine, fullBackupDir))
+		if err := execute.CmdRun(ctx, exportCmdLine); err != nil {
+			return "", errors.Wrapf(err, "cmd failed %s", redact.Command(exportCmdLine))
 		}
 	}
-	walkFn := func(archivePath string, info os.FileInfo, walkErr error) error {
-		if info.IsDir() {
-			return nil
-		}
-		if walkErr != nil {
-			return walkErr
-		}
-		dstPath := strings.TrimPrefix(archivePath, fullBackupDir)
 
-		if err := os.MkdirAll(path.Dir(path.Join(mysqlDataDir, dstPath)), 0700); err != nil {
-			return errors.Wrapf(err, "could not create directory %s", mysqlDataDir)
-		}
+	log.Infof("Successfully prepared directory %s", restoreDir)
+	return fullBackupDir, nil
+}
 
-		dstPath = filepath.Join(mysqlDataDir, dstPath)
-		dstFile, err := os.Create(dstPath)
-		if err != nil {
-			return errors.Wrap(err, "failed to create destination path")
-		}
-		archiveFile, err := os.Open(archivePath)
+// checkChain makes sure the first backup is a full backup and every incremental starts at the LSN the previous one ended at.
+func checkChain(backupDirs []string) error {
+	var previous checkpoints.Checkpoints
+	for i, backupDir := range backupDirs {
+		cp, err := checkpoints.Read(backupDir)
 		if err != nil {
-			return errors.Wrap(err, "failed to create archive file")
+			return errors.Wrapf(ErrChainBroken, "%v", err)
 		}
-		_, err = io.Copy(dstFile, archiveFile)
-
-		return errors.Wrapf(err, "failed to copy file from %v to %v", archiveFile, dstFile)
-	}
-	return filepath.Walk(fullBackupDir, walkFn)
-}
-
-func chownMysqlExecute(path string, uid int, gid int) error {
-	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
-		if err == nil {
-			err = os.Chown(name, uid, gid)
+		if i == 0 {
+			if !cp.Full() {
+				return errors.Wrapf(ErrChainBroken, "could not find a full backup in %s, backup_type is %q", backupDir, cp.BackupType)
+			}
+		} else {
+			if cp.BackupType != checkpoints.TypeIncremental {
+				return errors.Wrapf(ErrChainBroken, "expected an incremental backup in %s, backup_type is %q", backupDir, cp.BackupType)
+			}
+			if cp.FromLSN != previous.ToLSN {
+				return errors.Wrapf(ErrChainBroken, "incremental %s starts at lsn %d but the previous backup ends at lsn %d", backupDir, cp.FromLSN, previous.ToLSN)
+			}
 		}
-		return err
-	})
-}
-
-func chownMysqlDir(mysqlDataDir string) error {
-
-	mysqlUser, err := user.Lookup("mysql")
-	if err != nil {
-		return errors.Wrapf(err, "failed to look up user mysql")
-	}
-
-	mysqlUID, err := strconv.Atoi(mysqlUser.Uid)
-	if err != nil {
-		return err
-	}
-
-	mysqlGID, err := strconv.Atoi(mysqlUser.Gid)
-	if err != nil {
-		return err
-	}
-
-	log.Debugf("chown -R mysql:mysql for %s, uid: %d, gui: %d", mysqlDataDir, mysqlUID, mysqlGID)
-	err = chownMysqlExecute(mysqlDataDir, mysqlUID, mysqlGID)
-	if err != nil {
-		return errors.Wrapf(err, "could not chwon %s", mysqlDataDir)
-	}
-	return nil
-}
-
-// Will execute 'systemctl start mysqld' once the snapshot is restored.
-func StartMysql(ctx context.Context) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	log.Infof("starting mysql")
-	startMysqlCmdLine := []string{"/bin/systemctl", "start", "mysql"}
-	err := execute.CmdRun(ctx, startMysqlCmdLine)
-
-	if err != nil {
-		return errors.Wrapf(err, "cmd failed %s.", startMysqlCmdLine)
+		previous = cp
 	}
 	return nil
 }
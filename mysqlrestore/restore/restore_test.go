@@ -18,7 +18,9 @@ import (
 	"github.com/prometheus/common/log"
 	"github.com/stretchr/testify/require"
 
+	"bb.dev.norvax.net/dep/operator/backups/encryption"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/archive"
+	"bb.dev.norvax.net/dep/operator/backups/tuning"
 )
 
 var (
@@ -77,7 +79,7 @@ func TestRestore(t *testing.T) {
 	assert.NoError(err, "fail to open db connection")
 	defer db.Close()
 
-	assert.NoError(Snapshot(ctx, &MockPreparer{}, rootBackupDir, mysqlDataDir), "failed to restore snapshots")
+	assert.NoError(Snapshot(ctx, &MockPreparer{}, rootBackupDir, mysqlDataDir, tuning.Default(), encryption.Options{}, CopyBackOptions{}, DefaultPostActions()), "failed to restore snapshots")
 }
 
 func createBackupDir() string {
@@ -216,3 +218,54 @@ func createBackup(ctx context.Context, backupDir string, backupType string) erro
 	return nil
 
 }
+
+func writeCheckpoints(t *testing.T, dir, backupType string, fromLSN, toLSN int) string {
+	assert := require.New(t)
+	assert.NoError(os.MkdirAll(dir, 0700))
+	content := fmt.Sprintf("backup_type = %s\nfrom_lsn = %d\nto_lsn = %d\nlast_lsn = %d\ncompact = 0\n", backupType, fromLSN, toLSN, toLSN)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "xtrabackup_checkpoints"), []byte(content), 0600))
+	return dir
+}
+
+func TestCheckChain(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	full := writeCheckpoints(t, filepath.Join(dir, "2019_05_01_00_00_00Z"), "full-backuped", 0, 100)
+	first := writeCheckpoints(t, filepath.Join(dir, "2019_05_01_01_00_00Z"), "incremental", 100, 200)
+	gap := writeCheckpoints(t, filepath.Join(dir, "2019_05_01_02_00_00Z"), "incremental", 250, 300)
+
+	assert.NoError(checkChain([]string{full, first}))
+	assert.Equal(ErrChainBroken, errors.Cause(checkChain([]string{full, first, gap})))
+	assert.Equal(ErrChainBroken, errors.Cause(checkChain([]string{first})))
+	assert.Equal(ErrChainBroken, errors.Cause(checkChain([]string{full, filepath.Join(dir, "missing")})))
+}
+
+func TestReadBinlogPosition(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "binlog")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "xtrabackup_binlog_info"), []byte("mysql-bin.000042\t1337\n"), 0600))
+	pos, err := ReadBinlogPosition(dir, CoordinatesBinlog)
+	assert.NoError(err)
+	assert.Equal(BinlogPosition{File: "mysql-bin.000042", Position: 1337}, pos)
+
+	slaveInfo := "CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000007', MASTER_LOG_POS=4242\n"
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "xtrabackup_slave_info"), []byte(slaveInfo), 0600))
+	pos, err = ReadBinlogPosition(dir, CoordinatesSlave)
+	assert.NoError(err)
+	assert.Equal(BinlogPosition{File: "mysql-bin.000007", Position: 4242}, pos)
+
+	slaveInfo = "SET GLOBAL gtid_purged='3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5';\nCHANGE MASTER TO MASTER_AUTO_POSITION=1\n"
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "xtrabackup_slave_info"), []byte(slaveInfo), 0600))
+	pos, err = ReadBinlogPosition(dir, CoordinatesSlave)
+	assert.NoError(err)
+	assert.Equal("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5", pos.GTIDSet)
+
+	statements := changeMasterStatements(ReplicationSource{Host: "db1", Port: 3306, User: "repl", Password: "it's"}, pos)
+	assert.Contains(statements[len(statements)-1], "MASTER_PASSWORD='it\\'s', MASTER_AUTO_POSITION=1")
+}
@@ -0,0 +1,223 @@
+package snapshots
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/catalog"
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+)
+
+// errCodeNotFound is the code of a HeadObject of a missing key, its response has no body to carry NoSuchKey.
+const errCodeNotFound = "NotFound"
+
+// catalogObjects returns the archives recorded in the cluster's catalog as the objects a listing would return them.
+// A catalog created after the cluster's first uploads does not hold the older archives, the months up to its
+// creation are listed and merged in.  Entries outside the cluster's snapshot layout make the catalog unusable.
+func catalogObjects(ctx context.Context, s3Client *s3.S3, bucket string, cluster Ref) ([]*s3.Object, error) {
+	key := catalog.Key(cluster.Env, cluster.Cluster)
+	c, _, err := catalog.Read(ctx, s3Client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*s3.Object, 0, len(c.Entries))
+	seen := map[string]bool{}
+	for _, entry := range c.Entries {
+		ref, _, err := RefFromKey(entry.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "catalog %s holds an entry outside the snapshot layout", key)
+		}
+		if ref.Env != cluster.Env || ref.Cluster != cluster.Cluster {
+			return nil, errors.Errorf("catalog %s holds entry %s of another cluster", key, entry.Key)
+		}
+		seen[entry.Key] = true
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(entry.Key),
+			Size:         aws.Int64(entry.Size),
+			LastModified: aws.Time(entry.Uploaded),
+			StorageClass: aws.String(entry.StorageClass),
+		})
+	}
+	if c.Since.IsZero() {
+		return objects, nil
+	}
+
+	older, err := objectsUntil(ctx, s3Client, bucket, cluster, c.Since)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range older {
+		if !seen[aws.StringValue(object.Key)] {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// objectsUntil lists the archives of the months up to and including the month of until.
+func objectsUntil(ctx context.Context, s3Client *s3.S3, bucket string, cluster Ref, until time.Time) ([]*s3.Object, error) {
+	months, err := monthPrefixes(ctx, s3Client, bucket, cluster)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover snapshot months")
+	}
+
+	last := until.Year()*12 + int(until.Month())
+	var objects []*s3.Object
+	for _, month := range months {
+		year, monthOfYear, err := monthOf(month)
+		if err != nil || year*12+monthOfYear > last {
+			continue
+		}
+		monthObjects, err := ListObjects(ctx, s3Client, bucket, month)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("found %d objects under %s, uploaded before the catalog", len(monthObjects), month)
+		objects = append(objects, monthObjects...)
+	}
+	return objects, nil
+}
+
+// monthOf returns the year and month of a <cluster prefix>/<year>/<month>/ prefix.
+func monthOf(prefix string) (int, int, error) {
+	parts := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+	if len(parts) < 2 {
+		return 0, 0, errors.Errorf("invalid month prefix %s", prefix)
+	}
+	year, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid month prefix %s", prefix)
+	}
+	month, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid month prefix %s", prefix)
+	}
+	return year, month, nil
+}
+
+// catalogEntries turns the archives of a listing into catalog entries, skipping keys outside the snapshot layout.
+func catalogEntries(objects []*s3.Object) []catalog.Entry {
+	var entries []catalog.Entry
+	for _, object := range objects {
+		ref, _, err := RefFromKey(aws.StringValue(object.Key))
+		if err != nil {
+			log.Debugf("skipping key %s: %v", aws.StringValue(object.Key), err)
+			continue
+		}
+		piece := pieceFromObject(object)
+		entries = append(entries, catalog.Entry{
+			Key:          piece.Key,
+			Snapshot:     ref.Name,
+			Type:         piece.Type,
+			Size:         piece.Size,
+			Uploaded:     piece.LastModified,
+			StorageClass: aws.StringValue(object.StorageClass),
+		})
+	}
+	return entries
+}
+
+// RebuildCatalog lists every archive of the cluster and replaces the cluster's catalog with them, keeping the LSNs
+// mysqlbackup recorded.  Entries of archives that no longer exist, e.g. expired by a lifecycle rule, are dropped.  The
+// catalog is written on the condition that mysqlbackup did not append to it meanwhile, else it is rebuilt again.
+// It returns how many archives the catalog holds.
+func RebuildCatalog(ctx context.Context, store execute.S3Options, bucket string, cluster Ref) (int, error) {
+	if err := cluster.ValidateCluster(); err != nil {
+		return 0, err
+	}
+
+	s3Client, err := execute.GetS3Client(store)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create s3 client")
+	}
+	var entries int
+	err = catalog.Update(ctx, s3Client, bucket, catalog.Key(cluster.Env, cluster.Cluster), func(c *catalog.Catalog, exists bool) error {
+		objects, err := getSnapshots(ctx, s3Client, bucket, cluster)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		kept, err := keepEntries(ctx, s3Client, bucket, c.Entries, catalogEntries(objects))
+		if err != nil {
+			return err
+		}
+		*c = catalog.Catalog{}
+		c.Add(kept...)
+		entries = len(c.Entries)
+		return nil
+	})
+	return entries, err
+}
+
+// keepEntries returns the listed entries with the type and LSNs recorded for them, and the recorded entries the
+// listing missed whose archives still exist.
+func keepEntries(ctx context.Context, s3Client *s3.S3, bucket string, recorded, listed []catalog.Entry) ([]catalog.Entry, error) {
+	byKey := map[string]catalog.Entry{}
+	for _, entry := range recorded {
+		byKey[entry.Key] = entry
+	}
+	var entries []catalog.Entry
+	for _, entry := range listed {
+		if r, ok := byKey[entry.Key]; ok {
+			entry.Type, entry.FromLSN, entry.ToLSN = r.Type, r.FromLSN, r.ToLSN
+			delete(byKey, entry.Key)
+		}
+		entries = append(entries, entry)
+	}
+	for _, entry := range recorded {
+		if _, ok := byKey[entry.Key]; !ok {
+			continue
+		}
+		exists, err := objectExists(ctx, s3Client, bucket, entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			log.Infof("dropping %s from the catalog, the archive no longer exists", entry.Key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// objectExists reports whether key is in the bucket.
+func objectExists(ctx context.Context, s3Client *s3.S3, bucket, key string) (bool, error) {
+	_, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == errCodeNotFound || aerr.Code() == s3.ErrCodeNoSuchKey) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to look up %s in bucket %s", key, bucket)
+	}
+	return true, nil
+}
+
+// dropExpired removes the snapshots listed from the catalog whose full backup no longer exists, e.g. expired by a
+// lifecycle rule, since none of their archives can be restored without it.
+func dropExpired(ctx context.Context, s3Client *s3.S3, bucket string, snapshotList []SnapshotMeta) ([]SnapshotMeta, error) {
+	var kept []SnapshotMeta
+	for _, snapshot := range snapshotList {
+		expired := false
+		for _, piece := range snapshot.Full {
+			exists, err := objectExists(ctx, s3Client, bucket, piece.Key)
+			if err != nil {
+				return nil, err
+			}
+			expired = expired || !exists
+		}
+		if expired {
+			log.Infof("skipping snapshot %s, its full backup no longer exists, run rebuild-catalog to drop it from the catalog", snapshot.Ref)
+			continue
+		}
+		kept = append(kept, snapshot)
+	}
+	return kept, nil
+}
@@ -0,0 +1,105 @@
+package snapshots
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/catalog"
+	"bb.dev.norvax.net/dep/operator/backups/fakes3"
+)
+
+func TestCatalogObjects(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	server := fakes3.New()
+	defer server.Close()
+	cluster := Ref{Env: "qa", Cluster: "one"}
+	prefix := cluster.ClusterPrefix() + "/"
+	key := catalog.Key(cluster.Env, cluster.Cluster)
+
+	for _, archive := range []string{
+		"2019/4/snapshot_2019_04_30/full.tgz",
+		"2019/5/snapshot_2019_05_01/full.tgz",
+		"2019/5/snapshot_2019_05_02/full.tgz",
+		"2019/6/snapshot_2019_06_01/full.tgz",
+	} {
+		server.PutObject("bucket", prefix+archive, nil, "")
+	}
+	keys := func() []string {
+		objects, err := catalogObjects(ctx, server.Client(), "bucket", cluster)
+		assert.NoError(err)
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// The catalog was created in May, the archives of April and May are listed, June is not.
+	entry := catalog.Entry{Key: prefix + "2019/5/snapshot_2019_05_02/full.tgz", Snapshot: "snapshot_2019_05_02"}
+	since := time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC)
+	assert.NoError(catalog.Write(ctx, server.Client(), "bucket", key, &catalog.Catalog{Since: since, Entries: []catalog.Entry{entry}}))
+	assert.Equal([]string{
+		prefix + "2019/4/snapshot_2019_04_30/full.tgz",
+		prefix + "2019/5/snapshot_2019_05_01/full.tgz",
+		prefix + "2019/5/snapshot_2019_05_02/full.tgz",
+	}, keys())
+
+	// A rebuilt catalog holds every archive and is not completed by a listing.
+	assert.NoError(catalog.Write(ctx, server.Client(), "bucket", key, &catalog.Catalog{Entries: []catalog.Entry{entry}}))
+	assert.Equal([]string{entry.Key}, keys())
+
+	for _, bad := range []string{"mysqlbackups/qa/2019/May/2/snapshot_2019_05_02/full.tar", "qa/mysql/cluster_two/2019/5/snapshot_2019_05_02/full.tgz"} {
+		c := &catalog.Catalog{Entries: []catalog.Entry{{Key: bad}}}
+		assert.NoError(catalog.Write(ctx, server.Client(), "bucket", key, c))
+		_, err := catalogObjects(ctx, server.Client(), "bucket", cluster)
+		assert.Error(err, bad)
+	}
+}
+
+func TestExpiredEntries(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	server := fakes3.New()
+	defer server.Close()
+	cluster := Ref{Env: "qa", Cluster: "one"}
+	prefix := cluster.ClusterPrefix() + "/"
+
+	var recorded []catalog.Entry
+	for i, archive := range []string{
+		"2019/5/snapshot_2019_05_01/full_2019_05_01_00_00_00Z.tar",
+		"2019/5/snapshot_2019_05_01/incremental_2019_05_01_01_00_00Z.tar",
+		"2019/5/snapshot_2019_05_02/full_2019_05_02_00_00_00Z.tar",
+	} {
+		server.PutObject("bucket", prefix+archive, nil, "")
+		recorded = append(recorded, catalog.Entry{Key: prefix + archive, Uploaded: time.Date(2019, 5, 1, i, 0, 0, 0, time.UTC), ToLSN: uint64(i + 1)})
+	}
+	assert.NoError(catalog.Write(ctx, server.Client(), "bucket", catalog.Key(cluster.Env, cluster.Cluster), &catalog.Catalog{Entries: recorded}))
+	// A lifecycle rule expires the first snapshot, its entries stay in the catalog.
+	for _, entry := range recorded[:2] {
+		_, err := server.Client().DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String(entry.Key)})
+		assert.NoError(err)
+	}
+
+	objects, err := catalogObjects(ctx, server.Client(), "bucket", cluster)
+	assert.NoError(err)
+	kept, err := dropExpired(ctx, server.Client(), "bucket", groupSnapshots(objects))
+	assert.NoError(err)
+	assert.Len(kept, 1)
+	assert.Equal("snapshot_2019_05_02", kept[0].Ref.Name)
+
+	listed, err := getSnapshots(ctx, server.Client(), "bucket", cluster)
+	assert.NoError(err)
+	entries, err := keepEntries(ctx, server.Client(), "bucket", recorded, catalogEntries(listed))
+	assert.NoError(err)
+	assert.Len(entries, 1, "the expired entries are dropped")
+	assert.Equal(recorded[2].Key, entries[0].Key)
+	assert.Equal(uint64(3), entries[0].ToLSN, "the recorded LSNs are kept")
+}
@@ -0,0 +1,87 @@
+package snapshots
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
+)
+
+// userLabelPrefix marks the metadata keys mysqlbackup stores -labels under.
+const userLabelPrefix = "label-"
+
+// Describe loads the tags and metadata mysqlbackup recorded on every piece of the snapshots.
+// It makes two requests per piece, so it is only done for the snapshots that are listed.
+func Describe(ctx context.Context, store execute.S3Options, bucket string, snapshots []SnapshotMeta) error {
+	s3Client, err := execute.GetS3Client(store)
+	if err != nil {
+		return errors.Wrap(err, "failed to create s3 client")
+	}
+	for i := range snapshots {
+		for _, pieces := range [][]SnapshotPiece{snapshots[i].Full, snapshots[i].Incrementals} {
+			for j := range pieces {
+				if err := describePiece(ctx, s3Client, bucket, &pieces[j]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func describePiece(ctx context.Context, s3Client *s3.S3, bucket string, piece *SnapshotPiece) error {
+	head, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(piece.Key)})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get metadata of %s", piece.Key)
+	}
+	piece.Metadata = map[string]string{}
+	// The SDK returns metadata keys in canonical header form, e.g. Backup-Type.
+	for key, value := range head.Metadata {
+		piece.Metadata[strings.ToLower(key)] = aws.StringValue(value)
+	}
+
+	tagging, err := s3Client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(piece.Key)})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get tags of %s", piece.Key)
+	}
+	piece.Tags = map[string]string{}
+	for _, tag := range tagging.TagSet {
+		piece.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return nil
+}
+
+// Newest is the most recently uploaded piece of the snapshot.
+func (m SnapshotMeta) Newest() SnapshotPiece {
+	var newest SnapshotPiece
+	for _, pieces := range [][]SnapshotPiece{m.Full, m.Incrementals} {
+		for _, piece := range pieces {
+			if !piece.LastModified.Before(newest.LastModified) {
+				newest = piece
+			}
+		}
+	}
+	return newest
+}
+
+// Labels are the -labels of mysqlbackup and the trigger label of the snapshot's full backup as sorted key=value pairs.
+func (m SnapshotMeta) Labels() []string {
+	var labels []string
+	for _, piece := range m.Full {
+		for key, value := range piece.Metadata {
+			if strings.HasPrefix(key, userLabelPrefix) {
+				labels = append(labels, strings.TrimPrefix(key, userLabelPrefix)+"="+value)
+			}
+			if key == "label" {
+				labels = append(labels, "label="+value)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
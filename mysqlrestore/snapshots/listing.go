@@ -0,0 +1,140 @@
+package snapshots
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListObjects returns every object under prefix, following the listing across as many pages as the bucket returns.
+func ListObjects(ctx context.Context, s3Client *s3.S3, bucket, prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	log.Debugf("listing objects in bucket: %s, prefix: %s", bucket, prefix)
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list objects in s3 bucket %s with prefix %s", bucket, prefix)
+	}
+	return objects, nil
+}
+
+// listPrefixes returns the "directories" one level below prefix, each one ending in a slash.
+func listPrefixes(ctx context.Context, s3Client *s3.S3, bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(commonPrefix.Prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list prefixes in s3 bucket %s with prefix %s", bucket, prefix)
+	}
+	return prefixes, nil
+}
+
+// listNumericPrefixes returns the year or month prefixes below prefix, newest first.
+// Anything that is not a number is not part of the snapshot layout and is skipped.
+func listNumericPrefixes(ctx context.Context, s3Client *s3.S3, bucket, prefix string) ([]string, error) {
+	prefixes, err := listPrefixes(ctx, s3Client, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := map[string]int{}
+	var numeric []string
+	for _, p := range prefixes {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
+		if err != nil {
+			log.Debugf("skipping prefix %s, it is not part of the snapshot layout", p)
+			continue
+		}
+		numbers[p] = n
+		numeric = append(numeric, p)
+	}
+	sort.Slice(numeric, func(i, j int) bool {
+		return numbers[numeric[i]] > numbers[numeric[j]]
+	})
+	return numeric, nil
+}
+
+// monthPrefixes walks <env>/mysql/cluster_<cluster>/<year>/<month>/ and returns every month prefix, newest first.
+func monthPrefixes(ctx context.Context, s3Client *s3.S3, bucket string, cluster Ref) ([]string, error) {
+	years, err := listNumericPrefixes(ctx, s3Client, bucket, cluster.ClusterPrefix()+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var months []string
+	for _, year := range years {
+		yearMonths, err := listNumericPrefixes(ctx, s3Client, bucket, year)
+		if err != nil {
+			return nil, err
+		}
+		months = append(months, yearMonths...)
+	}
+	return months, nil
+}
+
+// snapshotsInMonth returns the snapshots under a month prefix, newest first.
+func snapshotsInMonth(ctx context.Context, s3Client *s3.S3, bucket, month string) ([]Ref, error) {
+	prefixes, err := listPrefixes(ctx, s3Client, bucket, month)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []Ref
+	for _, p := range prefixes {
+		ref, err := ParseRef(p)
+		if err != nil {
+			log.Debugf("skipping prefix %s: %v", p, err)
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name > refs[j].Name
+	})
+	return refs, nil
+}
+
+// latestSnapshot walks the newest years and months first and stops at the first month holding a snapshot.
+func latestSnapshot(ctx context.Context, s3Client *s3.S3, bucket string, cluster Ref) (Ref, error) {
+	years, err := listNumericPrefixes(ctx, s3Client, bucket, cluster.ClusterPrefix()+"/")
+	if err != nil {
+		return Ref{}, err
+	}
+	for _, year := range years {
+		months, err := listNumericPrefixes(ctx, s3Client, bucket, year)
+		if err != nil {
+			return Ref{}, err
+		}
+		for _, month := range months {
+			refs, err := snapshotsInMonth(ctx, s3Client, bucket, month)
+			if err != nil {
+				return Ref{}, err
+			}
+			if len(refs) > 0 {
+				return refs[0], nil
+			}
+		}
+	}
+	return Ref{}, errors.Wrapf(ErrNoSnapshots, "check bucket %s, prefix %s", bucket, cluster.ClusterPrefix())
+}
@@ -0,0 +1,58 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/fakes3"
+)
+
+func TestListing(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	server := fakes3.New()
+	defer server.Close()
+	cluster := Ref{Env: "qa", Cluster: "one"}
+	prefix := cluster.ClusterPrefix() + "/"
+
+	// More incrementals than fit in one page of 1000 keys.
+	for i := 0; i < 1200; i++ {
+		server.PutObject("bucket", fmt.Sprintf("%s2019/5/snapshot_2019_05_01/incremental_%04d.tgz", prefix, i), nil, "")
+	}
+	for _, key := range []string{
+		"2018/12/snapshot_2018_12_30/full.tgz",
+		"2018/12/snapshot_2018_12_31/full.tgz",
+		"2019/5/snapshot_2019_05_01/full.tgz",
+		"2019/5/snapshot_2019_05_02/full.tgz",
+		"2019/10/notes.txt",
+		"2019/unsorted/snapshot_2019_06_01/full.tgz",
+	} {
+		server.PutObject("bucket", prefix+key, nil, "")
+	}
+	server.PutObject("bucket", "qa/mysql/cluster_two/2020/1/snapshot_2020_01_01/full.tgz", nil, "")
+
+	objects, err := ListObjects(ctx, server.Client(), "bucket", prefix+"2019/5/")
+	assert.NoError(err)
+	assert.Len(objects, 1202)
+	assert.Equal(2, server.Requests("ListObjectsV2"))
+
+	server.MaxKeys = 1
+	months, err := monthPrefixes(ctx, server.Client(), "bucket", cluster)
+	assert.NoError(err)
+	assert.Equal([]string{prefix + "2019/10/", prefix + "2019/5/", prefix + "2018/12/"}, months)
+
+	refs, err := snapshotsInMonth(ctx, server.Client(), "bucket", prefix+"2018/12/")
+	assert.NoError(err)
+	assert.Equal([]string{"snapshot_2018_12_31", "snapshot_2018_12_30"}, []string{refs[0].Name, refs[1].Name})
+
+	latest, err := latestSnapshot(ctx, server.Client(), "bucket", cluster)
+	assert.NoError(err)
+	assert.Equal(Ref{Env: "qa", Cluster: "one", Year: 2019, Month: 5, Name: "snapshot_2019_05_02"}, latest)
+
+	_, err = latestSnapshot(ctx, server.Client(), "bucket", Ref{Env: "qa", Cluster: "three"})
+	assert.Equal(ErrNoSnapshots, errors.Cause(err))
+}
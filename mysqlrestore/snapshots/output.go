@@ -0,0 +1,106 @@
+package snapshots
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"bb.dev.norvax.net/dep/operator/backups/preflight"
+)
+
+const (
+	OutputText  = "text"
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// Listing is the document written for the json output format.
+type Listing struct {
+	Env       string         `json:"env"`
+	Bucket    string         `json:"bucket"`
+	Cluster   string         `json:"cluster"`
+	Latest    string         `json:"latest"`
+	Snapshots []SnapshotMeta `json:"snapshots"`
+	// Details adds the host, LSN and labels from the snapshots' metadata to the table, see Describe.
+	Details bool `json:"-"`
+}
+
+// ValidOutput reports whether format is one of the supported list output formats.
+func ValidOutput(format string) bool {
+	switch format {
+	case OutputText, OutputTable, OutputJSON:
+		return true
+	}
+	return false
+}
+
+// WriteListing writes the snapshots in the requested output format.
+func WriteListing(w io.Writer, format string, listing Listing) error {
+	switch format {
+	case OutputJSON:
+		if listing.Snapshots == nil {
+			listing.Snapshots = []SnapshotMeta{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.Wrap(encoder.Encode(listing), "failed to encode snapshots as json")
+	case OutputTable:
+		return writeTable(w, listing)
+	case OutputText:
+		return writeText(w, listing)
+	default:
+		return errors.Errorf("output format %s not supported, use text, table or json", format)
+	}
+}
+
+func writeTable(w io.Writer, listing Listing) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "SNAPSHOT\tCLUSTER\tFULL\tINCREMENTALS\tSIZE\tSTARTED\tLATEST"
+	if listing.Details {
+		header += "\tHOST\tTO_LSN\tVERSION\tLABELS"
+	}
+	fmt.Fprintln(table, header)
+	for _, snapshot := range listing.Snapshots {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%s\t%s\t%s",
+			snapshot.SnapshotName,
+			snapshot.Cluster,
+			len(snapshot.Full),
+			len(snapshot.Incrementals),
+			preflight.FormatBytes(snapshot.TotalSize),
+			snapshot.Timestamp.UTC().Format(time.RFC3339),
+			snapshot.LatestTimestamp.UTC().Format(time.RFC3339))
+		if listing.Details {
+			newest := snapshot.Newest().Metadata
+			fmt.Fprintf(table, "\t%s\t%s\t%s\t%s", orDash(newest["host"]), orDash(newest["to-lsn"]),
+				orDash(newest["tool-version"]), orDash(strings.Join(snapshot.Labels(), ",")))
+		}
+		fmt.Fprintln(table)
+	}
+	return errors.Wrap(table.Flush(), "failed to write snapshot table")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func writeText(w io.Writer, listing Listing) error {
+	usage := strings.Builder{}
+	usage.WriteString("Here are the list of snapshots.\n")
+	for _, snapshot := range listing.Snapshots {
+		usage.WriteString(fmt.Sprintf("Path: %+v, Snapshot: %+v, Timestamp: %+v\n", snapshot.Path, snapshot.SnapshotName, snapshot.Timestamp))
+	}
+	usage.WriteString("\n")
+	usage.WriteString("Select one to restore from, to use the most resent, execute the following command:\n")
+	txt := fmt.Sprintf("mysqlrestore -operation restore -env %s -bucket %s -snapshot %s -directory /opt/mysqlrestore -debug true", listing.Env, listing.Bucket, listing.Latest)
+	usage.WriteString(txt)
+	_, err := fmt.Fprintln(w, usage.String())
+	return err
+}
@@ -0,0 +1,184 @@
+package snapshots
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotPrefix     = "snapshot_"
+	snapshotDateFormat = "2006_01_02"
+	// snapshotTimeFormat names the snapshot of a full backup taken after another one completed the same day.
+	snapshotTimeFormat = "2006_01_02_15_04_05Z"
+	clusterPrefix      = "cluster_"
+)
+
+// Envs are the environments snapshots are taken in.
+var Envs = []string{"dev", "qa", "ga", "prod", "testing"}
+
+// Ref identifies a snapshot in the bucket.
+// Its string form is the S3 key prefix of the snapshot: <env>/mysql/cluster_<cluster>/<year>/<month>/<name>.
+// A Ref with only Env and Cluster set refers to every snapshot of that cluster.
+type Ref struct {
+	Env     string
+	Cluster string
+	Year    int
+	Month   int
+	Name    string
+}
+
+// NewRef builds the reference for a snapshot name such as snapshot_2019_05_01 or snapshot_2019_05_01_12_00_00Z, the
+// date comes from the name.
+func NewRef(env, cluster, name string) (Ref, error) {
+	date, err := snapshotDate(name)
+	if err != nil {
+		return Ref{}, err
+	}
+	ref := Ref{Env: env, Cluster: cluster, Year: date.Year(), Month: int(date.Month()), Name: name}
+	return ref, ref.Validate()
+}
+
+// ParseRef parses the string form of a Ref.
+func ParseRef(s string) (Ref, error) {
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	if len(parts) != 6 {
+		return Ref{}, errors.Errorf("invalid snapshot %s, expected <env>/mysql/cluster_<cluster>/<year>/<month>/<snapshot>", s)
+	}
+	return refFromParts(parts)
+}
+
+// RefFromKey returns the snapshot an object key belongs to and the archive name within the snapshot.
+func RefFromKey(key string) (Ref, string, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 7 || parts[6] == "" {
+		return Ref{}, "", errors.Errorf("key %s is not part of a snapshot", key)
+	}
+	ref, err := refFromParts(parts[:6])
+	if err != nil {
+		return Ref{}, "", err
+	}
+	return ref, strings.Join(parts[6:], "/"), nil
+}
+
+func refFromParts(parts []string) (Ref, error) {
+	if parts[1] != "mysql" || !strings.HasPrefix(parts[2], clusterPrefix) {
+		return Ref{}, errors.Errorf("invalid snapshot %s, expected <env>/mysql/cluster_<cluster>/...", strings.Join(parts, "/"))
+	}
+	year, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return Ref{}, errors.Errorf("invalid snapshot year %s in %s", parts[3], strings.Join(parts, "/"))
+	}
+	month, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return Ref{}, errors.Errorf("invalid snapshot month %s in %s", parts[4], strings.Join(parts, "/"))
+	}
+	ref := Ref{
+		Env:     parts[0],
+		Cluster: strings.TrimPrefix(parts[2], clusterPrefix),
+		Year:    year,
+		Month:   month,
+		Name:    parts[5],
+	}
+	return ref, ref.Validate()
+}
+
+// ValidateCluster checks the env and cluster, which is all that is needed to list snapshots.
+func (r Ref) ValidateCluster() error {
+	if !validEnv(r.Env) {
+		return errors.Errorf("invalid env %s.  Try %s", r.Env, strings.Join(Envs, ", "))
+	}
+	if r.Cluster == "" {
+		return errors.New("failed to specify which cluster to use(one or two).")
+	}
+	if strings.Contains(r.Cluster, "/") {
+		return errors.Errorf("invalid cluster %s", r.Cluster)
+	}
+	return nil
+}
+
+// Validate checks every part of the reference.
+func (r Ref) Validate() error {
+	if err := r.ValidateCluster(); err != nil {
+		return err
+	}
+	if r.Year < 1 || r.Month < 1 || r.Month > 12 {
+		return errors.Errorf("invalid snapshot date %d/%d", r.Year, r.Month)
+	}
+	if r.Name == "" || strings.Contains(r.Name, "/") {
+		return errors.Errorf("invalid snapshot name %s", r.Name)
+	}
+	return nil
+}
+
+// ClusterPrefix is the key prefix holding every snapshot of the cluster.
+func (r Ref) ClusterPrefix() string {
+	return path.Join(r.Env, "mysql", clusterPrefix+r.Cluster)
+}
+
+// Prefix is the key prefix holding the snapshot's archives, it always ends in a slash.
+func (r Ref) Prefix() string {
+	return r.String() + "/"
+}
+
+// Key returns the key of an archive in the snapshot.
+func (r Ref) Key(archive string) string {
+	return r.Prefix() + archive
+}
+
+// Date is the day the snapshot was started, parsed from its name.
+func (r Ref) Date() (time.Time, error) {
+	return snapshotDate(r.Name)
+}
+
+func snapshotDate(name string) (time.Time, error) {
+	if strings.HasPrefix(name, snapshotPrefix) {
+		for _, format := range []string{snapshotDateFormat, snapshotTimeFormat} {
+			if date, err := time.Parse(format, strings.TrimPrefix(name, snapshotPrefix)); err == nil {
+				return date, nil
+			}
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid snapshot name %s, expected %s%s", name, snapshotPrefix, snapshotDateFormat)
+}
+
+func (r Ref) String() string {
+	return path.Join(r.ClusterPrefix(), strconv.Itoa(r.Year), strconv.Itoa(r.Month), r.Name)
+}
+
+// IsZero reports whether the reference is unset.
+func (r Ref) IsZero() bool {
+	return r == Ref{}
+}
+
+func (r Ref) MarshalText() ([]byte, error) {
+	if r.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(r.String()), nil
+}
+
+func (r *Ref) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*r = Ref{}
+		return nil
+	}
+	ref, err := ParseRef(string(text))
+	if err != nil {
+		return err
+	}
+	*r = ref
+	return nil
+}
+
+func validEnv(env string) bool {
+	for _, e := range Envs {
+		if env == e {
+			return true
+		}
+	}
+	return false
+}
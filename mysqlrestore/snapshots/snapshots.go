@@ -1,13 +1,13 @@
 package snapshots
 
 import (
-	"fmt"
-	"os"
-	"path/filepath"
+	"context"
+	"path"
 	"sort"
 	"strings"
 	"time"
 
+	"bb.dev.norvax.net/dep/operator/backups/catalog"
 	"bb.dev.norvax.net/dep/operator/backups/mysqlrestore/execute"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -15,75 +15,225 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrNoSnapshots is returned when a cluster has no snapshots in the bucket.
+	ErrNoSnapshots = errors.New("no snapshots available")
+	// ErrSnapshotNotFound is returned when a snapshot reference has no archives in the bucket.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+const (
+	FullBackup        = "full"
+	IncrementalBackup = "incremental"
+)
+
+// SnapshotPiece is a single archive (full or incremental backup) stored in a snapshot.
+type SnapshotPiece struct {
+	Key          string    `json:"key"`
+	Type         string    `json:"type"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	// Tags and Metadata are only loaded by Describe.
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// SnapshotMeta describes a snapshot: one full backup and the incrementals taken on top of it.
+// Timestamp is when the full backup was uploaded, LatestTimestamp is when the newest piece was uploaded.
 type SnapshotMeta struct {
-	SnapshotName string
-	Timestamp    time.Time
-	Path         string
+	Ref             Ref             `json:"ref"`
+	SnapshotName    string          `json:"snapshot"`
+	Timestamp       time.Time       `json:"timestamp"`
+	LatestTimestamp time.Time       `json:"latest_timestamp"`
+	Path            string          `json:"path"`
+	Env             string          `json:"env"`
+	Cluster         string          `json:"cluster"`
+	Full            []SnapshotPiece `json:"full"`
+	Incrementals    []SnapshotPiece `json:"incrementals"`
+	TotalSize       int64           `json:"total_size"`
+}
+
+// Filter limits the snapshots returned to the ones started in [Since, Until].
+// Zero values are ignored, Limit keeps only the most recent snapshots.
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	Limit int
 }
 
 type snapshotSlices []SnapshotMeta
 
-func getSnapshots(env, bucket, cluster string) ([]s3.Object, error) {
-	snapshotObjects := []s3.Object{}
-	s3Client, err := execute.GetS3Client()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create s3 client")
-	}
-	cluster_type := fmt.Sprintf("cluster_%s", cluster)
-	params := &s3.ListObjectsInput{
-		Bucket: aws.String(bucket),
-		//Prefix: aws.String(filepath.Join(env)),
-		Prefix: aws.String(filepath.Join(env, "mysql", cluster_type)),
-		// We only care about snapshot groups w/ full backups. This also helps limit the returns.
-		Delimiter: aws.String("incremental_backup"),
-	}
-	log.Debugf("s3 request bucket: %s, prefix: %s", *params.Bucket, *params.Prefix)
-	resp, err := s3Client.ListObjects(params)
+// getSnapshots discovers the month prefixes of the cluster and lists the archives under each of them.
+func getSnapshots(ctx context.Context, s3Client *s3.S3, bucket string, cluster Ref) ([]*s3.Object, error) {
+	months, err := monthPrefixes(ctx, s3Client, bucket, cluster)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to list objects in s3 bucket %s", bucket)
+		return nil, errors.Wrap(err, "failed to discover snapshot months")
 	}
 
-	for _, key := range resp.Contents {
-		log.Debugf("s3 object key names are %s", *key.Key)
-		if strings.HasSuffix(*key.Key, "full_backup") {
-			log.Infof("key name with full backup hasSuffix %s", *key.Key)
+	var snapshotObjects []*s3.Object
+	for _, month := range months {
+		objects, err := ListObjects(ctx, s3Client, bucket, month)
+		if err != nil {
+			return nil, err
 		}
-		snapshotObjects = append(snapshotObjects, *key)
+		log.Debugf("found %d objects under %s", len(objects), month)
+		snapshotObjects = append(snapshotObjects, objects...)
 	}
 
 	return snapshotObjects, nil
 }
 
-// Returns a json list of the snapshots available in s3 based on environment passed in at runtime.
-func ListSnapshots(env, bucket, cluster string) ([]SnapshotMeta, string, error) {
+// Returns the snapshots available in s3 for the env and cluster of the reference, oldest first,
+// along with the reference of the most recent snapshot.
+// The snapshots are read from the cluster's catalog, clusters without a usable catalog are listed key by key.
+func ListSnapshots(ctx context.Context, store execute.S3Options, bucket string, cluster Ref) ([]SnapshotMeta, Ref, error) {
+	if err := cluster.ValidateCluster(); err != nil {
+		return nil, Ref{}, err
+	}
 
-	var snapshotList []SnapshotMeta
-	//var snapshotList []string
-	snapshots, err := getSnapshots(env, bucket, cluster)
+	s3Client, err := execute.GetS3Client(store)
 	if err != nil {
-		return nil, "", errors.WithStack(err)
+		return nil, Ref{}, errors.Wrap(err, "failed to create s3 client")
 	}
-
-	for _, snapshot := range snapshots {
-		snapshotkey := strings.Split(*snapshot.Key, "/")
-		s3UrlPrefix := strings.Join(snapshotkey[0:5], "/")
-		snapshotList = append(snapshotList, SnapshotMeta{snapshotkey[5], *snapshot.LastModified, s3UrlPrefix})
+	fromCatalog := true
+	snapshots, err := catalogObjects(ctx, s3Client, bucket, cluster)
+	if err != nil {
+		if errors.Cause(err) == catalog.ErrNotFound {
+			log.Infof("%v, listing the bucket instead", err)
+		} else {
+			log.Warnf("%v, listing the bucket instead", err)
+		}
+		fromCatalog = false
+		snapshots, err = getSnapshots(ctx, s3Client, bucket, cluster)
+	}
+	if err != nil {
+		return nil, Ref{}, errors.WithStack(err)
+	}
+	snapshotList := groupSnapshots(snapshots)
+	if fromCatalog {
+		if snapshotList, err = dropExpired(ctx, s3Client, bucket, snapshotList); err != nil {
+			return nil, Ref{}, err
+		}
 	}
 
-	log.Debugf("snapshot object %s", snapshotList)
+	log.Debugf("snapshot object %+v", snapshotList)
 	sortedSnapshots := sortSnapshots(snapshotList)
 
-	// Building this string for convenience when outputting latest snapshot
 	if len(sortedSnapshots) == 0 {
-		log.Infof("there are no snapshots available, check bucket: %s", bucket)
-		os.Exit(1)
+		return nil, Ref{}, errors.Wrapf(ErrNoSnapshots, "check bucket %s, prefix %s", bucket, cluster.ClusterPrefix())
 	}
-	snapshotLen := len(sortedSnapshots)
-	mostRecentSnapshot := fmt.Sprintf("%s/mysql/cluster_%s/%d/%d/%s", env, cluster, sortedSnapshots[snapshotLen-1].Timestamp.Year(), sortedSnapshots[snapshotLen-1].Timestamp.Month(), sortedSnapshots[snapshotLen-1].SnapshotName)
+	mostRecentSnapshot := sortedSnapshots[len(sortedSnapshots)-1].Ref
 
 	return sortedSnapshots, mostRecentSnapshot, nil
 }
 
+// LatestSnapshot returns the most recent snapshot of the cluster by walking the newest prefixes first,
+// so it does not have to list every archive the cluster ever uploaded.
+func LatestSnapshot(ctx context.Context, store execute.S3Options, bucket string, cluster Ref) (Ref, error) {
+	if err := cluster.ValidateCluster(); err != nil {
+		return Ref{}, err
+	}
+
+	s3Client, err := execute.GetS3Client(store)
+	if err != nil {
+		return Ref{}, errors.Wrap(err, "failed to create s3 client")
+	}
+	return latestSnapshot(ctx, s3Client, bucket, cluster)
+}
+
+// groupSnapshots folds the archive objects into one SnapshotMeta per snapshot directory.
+// Keys are laid out as <env>/mysql/cluster_<n>/<year>/<month>/<snapshot>/<archive>.
+func groupSnapshots(objects []*s3.Object) []SnapshotMeta {
+	var snapshotList []SnapshotMeta
+	index := map[Ref]int{}
+	for _, object := range objects {
+		ref, _, err := RefFromKey(aws.StringValue(object.Key))
+		if err != nil {
+			log.Debugf("skipping key %s: %v", aws.StringValue(object.Key), err)
+			continue
+		}
+		i, ok := index[ref]
+		if !ok {
+			i = len(snapshotList)
+			index[ref] = i
+			snapshotList = append(snapshotList, SnapshotMeta{
+				Ref:          ref,
+				SnapshotName: ref.Name,
+				Path:         path.Dir(ref.String()),
+				Env:          ref.Env,
+				Cluster:      ref.Cluster,
+			})
+		}
+		snapshotList[i].add(pieceFromObject(object))
+	}
+
+	for i := range snapshotList {
+		if snapshotList[i].Timestamp.IsZero() {
+			snapshotList[i].Timestamp = snapshotList[i].earliest()
+		}
+		sort.Slice(snapshotList[i].Incrementals, func(a, b int) bool {
+			return snapshotList[i].Incrementals[a].LastModified.Before(snapshotList[i].Incrementals[b].LastModified)
+		})
+	}
+	return snapshotList
+}
+
+func pieceFromObject(object *s3.Object) SnapshotPiece {
+	piece := SnapshotPiece{
+		Key:          aws.StringValue(object.Key),
+		Type:         FullBackup,
+		Size:         aws.Int64Value(object.Size),
+		LastModified: aws.TimeValue(object.LastModified),
+	}
+	if strings.Contains(path.Base(piece.Key), IncrementalBackup) {
+		piece.Type = IncrementalBackup
+	}
+	return piece
+}
+
+func (m *SnapshotMeta) add(piece SnapshotPiece) {
+	if piece.Type == IncrementalBackup {
+		m.Incrementals = append(m.Incrementals, piece)
+	} else {
+		m.Full = append(m.Full, piece)
+		if m.Timestamp.IsZero() || piece.LastModified.Before(m.Timestamp) {
+			m.Timestamp = piece.LastModified
+		}
+	}
+	if piece.LastModified.After(m.LatestTimestamp) {
+		m.LatestTimestamp = piece.LastModified
+	}
+	m.TotalSize += piece.Size
+}
+
+func (m *SnapshotMeta) earliest() time.Time {
+	var earliest time.Time
+	for _, piece := range m.Incrementals {
+		if earliest.IsZero() || piece.LastModified.Before(earliest) {
+			earliest = piece.LastModified
+		}
+	}
+	return earliest
+}
+
+// FilterSnapshots returns the sorted snapshots that match the filter.
+func FilterSnapshots(snapshots []SnapshotMeta, filter Filter) []SnapshotMeta {
+	var filtered []SnapshotMeta
+	for _, snapshot := range snapshots {
+		if !filter.Since.IsZero() && snapshot.Timestamp.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && snapshot.Timestamp.After(filter.Until) {
+			continue
+		}
+		filtered = append(filtered, snapshot)
+	}
+	if filter.Limit > 0 && len(filtered) > filter.Limit {
+		filtered = filtered[len(filtered)-filter.Limit:]
+	}
+	return filtered
+}
+
 func (s snapshotSlices) Len() int {
 	return len(s)
 }
@@ -0,0 +1,155 @@
+package snapshots
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/require"
+)
+
+func object(key string, size int64, modified time.Time) *s3.Object {
+	return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+}
+
+func TestGroupSnapshots(t *testing.T) {
+	assert := require.New(t)
+	day := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	objects := []*s3.Object{
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full_backup.tgz", 100, day),
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/incremental_backup_2.tgz", 5, day.Add(2*time.Hour)),
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/incremental_backup_1.tgz", 10, day.Add(time.Hour)),
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_02/full_backup.tgz", 200, day.Add(24*time.Hour)),
+		object("qa/mysql/cluster_one/2019/5/", 0, day),
+	}
+
+	snapshots := sortSnapshots(groupSnapshots(objects))
+
+	assert.Len(snapshots, 2)
+	first := snapshots[0]
+	assert.Equal("snapshot_2019_05_01", first.SnapshotName)
+	assert.Equal("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01", first.Ref.String())
+	assert.Equal("qa/mysql/cluster_one/2019/5", first.Path)
+	assert.Equal("one", first.Cluster)
+	assert.Len(first.Full, 1)
+	assert.Len(first.Incrementals, 2)
+	assert.Equal("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/incremental_backup_1.tgz", first.Incrementals[0].Key)
+	assert.Equal(int64(115), first.TotalSize)
+	assert.Equal(day, first.Timestamp)
+	assert.Equal(day.Add(2*time.Hour), first.LatestTimestamp)
+}
+
+func TestFilterSnapshots(t *testing.T) {
+	assert := require.New(t)
+	day := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	var snapshots []SnapshotMeta
+	for i := 0; i < 5; i++ {
+		snapshots = append(snapshots, SnapshotMeta{SnapshotName: string(rune('a' + i)), Timestamp: day.AddDate(0, 0, i)})
+	}
+
+	filtered := FilterSnapshots(snapshots, Filter{Since: day.AddDate(0, 0, 1), Until: day.AddDate(0, 0, 3)})
+	assert.Len(filtered, 3)
+	assert.Equal("b", filtered[0].SnapshotName)
+
+	filtered = FilterSnapshots(snapshots, Filter{Limit: 2})
+	assert.Len(filtered, 2)
+	assert.Equal("d", filtered[0].SnapshotName)
+}
+
+func TestWriteListingJSON(t *testing.T) {
+	assert := require.New(t)
+	var out bytes.Buffer
+
+	assert.NoError(WriteListing(&out, OutputJSON, Listing{Env: "qa", Cluster: "one"}))
+
+	var listing Listing
+	assert.NoError(json.Unmarshal(out.Bytes(), &listing))
+	assert.Equal("qa", listing.Env)
+	assert.NotNil(listing.Snapshots)
+}
+
+func TestWriteListingDetails(t *testing.T) {
+	assert := require.New(t)
+	var out bytes.Buffer
+	snapshot := SnapshotMeta{
+		SnapshotName: "snapshot_2019_05_01",
+		Full: []SnapshotPiece{{
+			Key:          "full_backup.tgz",
+			LastModified: time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC),
+			Metadata:     map[string]string{"host": "db1", "to-lsn": "100", "label-team": "dba", "label": "pre-migration"},
+		}},
+		Incrementals: []SnapshotPiece{{
+			Key:          "incremental_backup.tgz",
+			LastModified: time.Date(2019, 5, 1, 1, 0, 0, 0, time.UTC),
+			Metadata:     map[string]string{"host": "db1", "to-lsn": "200", "tool-version": "0.1.2"},
+		}},
+	}
+
+	assert.Equal([]string{"label=pre-migration", "team=dba"}, snapshot.Labels())
+	assert.NoError(WriteListing(&out, OutputTable, Listing{Snapshots: []SnapshotMeta{snapshot}, Details: true}))
+	assert.Contains(out.String(), "TO_LSN")
+	assert.Contains(out.String(), "db1   200     0.1.2    label=pre-migration,team=dba")
+}
+
+func TestRefRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	ref, err := NewRef("qa", "one", "snapshot_2019_05_01")
+	assert.NoError(err)
+	assert.Equal("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01", ref.String())
+
+	parsed, err := ParseRef(ref.String() + "/")
+	assert.NoError(err)
+	assert.Equal(ref, parsed)
+
+	fromKey, archive, err := RefFromKey(ref.Key("full_backup.tgz"))
+	assert.NoError(err)
+	assert.Equal(ref, fromKey)
+	assert.Equal("full_backup.tgz", archive)
+
+	second, err := NewRef("qa", "one", "snapshot_2019_05_31_12_00_00Z")
+	assert.NoError(err)
+	assert.Equal("qa/mysql/cluster_one/2019/5/snapshot_2019_05_31_12_00_00Z", second.String())
+
+	text, err := json.Marshal(SnapshotMeta{Ref: ref})
+	assert.NoError(err)
+	var meta SnapshotMeta
+	assert.NoError(json.Unmarshal(text, &meta))
+	assert.Equal(ref, meta.Ref)
+}
+
+func TestRefValidation(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewRef("qa", "", "snapshot_2019_05_01")
+	assert.Error(err, "missing cluster")
+	_, err = NewRef("nope", "one", "snapshot_2019_05_01")
+	assert.Error(err, "unknown env")
+	_, err = NewRef("qa", "one", "2019_05_01")
+	assert.Error(err, "name without the snapshot prefix")
+	_, err = ParseRef("qa/mysql/cluster_/2019/5/snapshot_2019_05_01")
+	assert.Error(err, "empty cluster")
+	_, err = ParseRef("qa/mysql/cluster_one/2019/may/snapshot_2019_05_01")
+	assert.Error(err, "month is not a number")
+	_, _, err = RefFromKey("qa/mysql/cluster_one/2019/5/")
+	assert.Error(err, "key is not an archive")
+}
+
+func TestCatalogEntries(t *testing.T) {
+	assert := require.New(t)
+	day := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	objects := []*s3.Object{
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/full_backup.tgz", 100, day),
+		object("qa/mysql/cluster_one/2019/5/snapshot_2019_05_01/incremental_backup_1.tgz", 10, day.Add(time.Hour)),
+		object("qa/mysql/cluster_one/2019/5/", 0, day),
+	}
+
+	entries := catalogEntries(objects)
+	assert.Len(entries, 2)
+	assert.Equal("snapshot_2019_05_01", entries[1].Snapshot)
+	assert.Equal(IncrementalBackup, entries[1].Type)
+	assert.Equal(day.Add(time.Hour), entries[1].Uploaded)
+}
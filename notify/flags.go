@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultInterval is how long events of the same type are suppressed after one is sent.
+const DefaultInterval = 30 * time.Minute
+
+// Flags are the command line flags shared by mysqlbackup and mysqlrestore to configure notifications.
+type Flags struct {
+	webhook, slack, email, command                     *string
+	webhookEvents, slackEvents, emailEvents, cmdEvents *string
+
+	smtpAddr, smtpFrom, smtpUser *string
+	interval                     *time.Duration
+}
+
+// RegisterFlags adds the notification flags to fs, call it before fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	events := func(sink string) *string {
+		return fs.String("notify_"+sink+"_events", "", "comma separated event types sent to the "+sink+" sink: "+strings.Join(EventTypes, ", ")+"(default: all)")
+	}
+	return &Flags{
+		webhook:       fs.String("notify_webhook", "", "url events are posted to as JSON"),
+		webhookEvents: events("webhook"),
+		slack:         fs.String("notify_slack", "", "slack compatible incoming webhook url events are posted to"),
+		slackEvents:   events("slack"),
+		email:         fs.String("notify_email", "", "comma separated addresses events are mailed to"),
+		emailEvents:   events("email"),
+		command:       fs.String("notify_command", "", "command run for every event with the event as JSON on stdin"),
+		cmdEvents:     events("command"),
+		smtpAddr:      fs.String("smtp_addr", "localhost:25", "host:port of the SMTP server used by -notify_email, the password is read from SMTP_PASSWORD"),
+		smtpFrom:      fs.String("smtp_from", "", "sender address of notification emails(default: <tool>@<hostname>)"),
+		smtpUser:      fs.String("smtp_user", "", "SMTP user, leave empty for servers that do not require authentication"),
+		interval:      fs.Duration("notify_interval", DefaultInterval, "events of the same type are sent at most once per interval"),
+	}
+}
+
+// Notifier builds the notifier described by the parsed flags, it has no routes when no sink is configured.
+func (f *Flags) Notifier(tool string) (*Notifier, error) {
+	n := &Notifier{Tool: tool, Interval: *f.interval}
+	add := func(sink Sink, eventList string) error {
+		types, err := ParseEventTypes(eventList)
+		if err != nil {
+			return errors.Wrapf(err, "invalid notify_%s_events", sink.Name())
+		}
+		n.Routes = append(n.Routes, Route{Sink: sink, Events: types})
+		return nil
+	}
+
+	if *f.webhook != "" {
+		if err := add(&WebhookSink{URL: *f.webhook}, *f.webhookEvents); err != nil {
+			return nil, err
+		}
+	}
+	if *f.slack != "" {
+		if err := add(&SlackSink{URL: *f.slack}, *f.slackEvents); err != nil {
+			return nil, err
+		}
+	}
+	if to := splitAddresses(*f.email); len(to) > 0 {
+		from := *f.smtpFrom
+		if from == "" {
+			host, _ := os.Hostname()
+			from = tool + "@" + host
+		}
+		sink := &EmailSink{
+			Addr:     *f.smtpAddr,
+			From:     from,
+			To:       to,
+			Username: *f.smtpUser,
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if err := add(sink, *f.emailEvents); err != nil {
+			return nil, err
+		}
+	}
+	if *f.command != "" {
+		if err := add(&CommandSink{Command: strings.Fields(*f.command)}, *f.cmdEvents); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// splitAddresses splits the comma separated -notify_email list, ignoring the spaces around and empty entries.
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,199 @@
+// Package notify tells people about backups and restores that succeeded or failed through pluggable sinks.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+// Event types, a sink can be limited to a subset of them.
+// backup_skipped is sent when a backup was not taken because the server was unhealthy.
+const (
+	BackupSucceeded  = "backup_succeeded"
+	BackupFailed     = "backup_failed"
+	BackupSkipped    = "backup_skipped"
+	RestoreSucceeded = "restore_succeeded"
+	RestoreFailed    = "restore_failed"
+)
+
+// EventTypes are all the event types that are sent.
+var EventTypes = []string{BackupSucceeded, BackupFailed, BackupSkipped, RestoreSucceeded, RestoreFailed}
+
+// Event is a single notification, it is sent as JSON by the webhook and command sinks.
+type Event struct {
+	Type    string            `json:"type"`
+	Tool    string            `json:"tool"`
+	Host    string            `json:"host"`
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	// Suppressed counts the events of the same type dropped by rate limiting since the last one was sent.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// Failed reports whether the event is about a failure.
+func (e Event) Failed() bool {
+	return e.Type == BackupFailed || e.Type == RestoreFailed
+}
+
+// Subject is a one line summary of the event.
+func (e Event) Subject() string {
+	status := "succeeded"
+	if e.Failed() {
+		status = "FAILED"
+	} else if e.Type == BackupSkipped {
+		status = "skipped"
+	}
+	return fmt.Sprintf("[%s] %s %s on %s", e.Tool, strings.SplitN(e.Type, "_", 2)[0], status, e.Host)
+}
+
+// Text is the subject followed by the message, error, fields and suppressed count, one per line.
+func (e Event) Text() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s\n%s\n", e.Subject(), e.Message)
+	if e.Error != "" {
+		fmt.Fprintf(&text, "error: %s\n", e.Error)
+	}
+	for _, key := range sortedKeys(e.Fields) {
+		fmt.Fprintf(&text, "%s: %s\n", key, e.Fields[key])
+	}
+	if e.Suppressed > 0 {
+		fmt.Fprintf(&text, "%d more %s events were suppressed\n", e.Suppressed, e.Type)
+	}
+	return text.String()
+}
+
+// Sink delivers events somewhere.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// Route sends the listed event types to a sink, every event type when Events is empty.
+type Route struct {
+	Sink   Sink
+	Events []string
+}
+
+func (r Route) accepts(eventType string) bool {
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, e := range r.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifier sends events through its routes.
+// Events of a type already sent within Interval are counted and dropped, so a backup that fails every
+// second reports once per Interval instead of flooding the sinks.
+// A nil Notifier drops every event.
+type Notifier struct {
+	Tool     string
+	Routes   []Route
+	Interval time.Duration
+
+	mu         sync.Mutex
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+	now        func() time.Time
+}
+
+// Notify fills in the tool, host and time of the event and sends it through every route that accepts it.
+// Registered secrets are masked in the message and error, the sinks are read outside of the logs.
+// Errors from the sinks are logged, a broken sink never fails a backup or a restore.
+func (n *Notifier) Notify(ctx context.Context, event Event) {
+	if n == nil || len(n.Routes) == 0 {
+		return
+	}
+	event.Message, event.Error = redact.String(event.Message), redact.String(event.Error)
+	if !n.allow(&event) {
+		log.Debugf("suppressed %s notification, one was sent less than %v ago", event.Type, n.Interval)
+		return
+	}
+
+	for _, route := range n.Routes {
+		if !route.accepts(event.Type) {
+			continue
+		}
+		if err := route.Sink.Send(ctx, event); err != nil {
+			log.Errorf("failed to send %s notification to %s: %+v", event.Type, route.Sink.Name(), err)
+		}
+	}
+}
+
+// Result notifies success when err is nil and failure otherwise.
+func (n *Notifier) Result(ctx context.Context, succeeded, failed, message string, fields map[string]string, err error) {
+	event := Event{Type: succeeded, Message: message, Fields: fields}
+	if err != nil {
+		event.Type = failed
+		event.Error = err.Error()
+	}
+	n.Notify(ctx, event)
+}
+
+func (n *Notifier) allow(event *Event) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.now == nil {
+		n.now = time.Now
+	}
+	if n.lastSent == nil {
+		n.lastSent = map[string]time.Time{}
+		n.suppressed = map[string]int{}
+	}
+
+	now := n.now()
+	if last, ok := n.lastSent[event.Type]; ok && now.Sub(last) < n.Interval {
+		n.suppressed[event.Type]++
+		return false
+	}
+	n.lastSent[event.Type] = now
+	event.Suppressed = n.suppressed[event.Type]
+	n.suppressed[event.Type] = 0
+
+	event.Tool = n.Tool
+	event.Time = now.UTC()
+	if event.Host == "" {
+		event.Host, _ = os.Hostname()
+	}
+	return true
+}
+
+// ParseEventTypes splits a comma separated list of event types, an empty list selects every type.
+func ParseEventTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !validEventType(t) {
+			return nil, errors.Errorf("invalid event type %s.  Try %s", t, strings.Join(EventTypes, ", "))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+func validEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"bb.dev.norvax.net/dep/operator/backups/redact"
+)
+
+type recordingSink struct {
+	events []Event
+}
+
+func (r *recordingSink) Name() string { return "recording" }
+
+func (r *recordingSink) Send(ctx context.Context, event Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	all, failures := &recordingSink{}, &recordingSink{}
+	now := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	n := &Notifier{
+		Tool:     "mysqlbackup",
+		Interval: time.Hour,
+		Routes:   []Route{{Sink: all}, {Sink: failures, Events: []string{BackupFailed}}},
+		now:      func() time.Time { return now },
+	}
+
+	for i := 0; i < 5; i++ {
+		n.Result(ctx, BackupSucceeded, BackupFailed, "full backup", nil, errors.New("disk full"))
+		now = now.Add(time.Second)
+	}
+	n.Result(ctx, BackupSucceeded, BackupFailed, "full backup", nil, nil)
+	assert.Len(all.events, 2)
+	assert.Len(failures.events, 1)
+	assert.Equal("disk full", failures.events[0].Error)
+	assert.Equal("mysqlbackup", failures.events[0].Tool)
+
+	now = now.Add(time.Hour)
+	n.Result(ctx, BackupSucceeded, BackupFailed, "full backup", nil, errors.New("disk full"))
+	assert.Len(failures.events, 2)
+	assert.Equal(4, failures.events[1].Suppressed)
+	assert.Contains(failures.events[1].Text(), "4 more backup_failed events were suppressed")
+}
+
+func TestNotifierRedacts(t *testing.T) {
+	assert := require.New(t)
+	sink := &recordingSink{}
+	redact.AddSecret("hunter2")
+	n := &Notifier{Tool: "mysqlbackup", Routes: []Route{{Sink: sink}}}
+
+	n.Result(context.Background(), BackupSucceeded, BackupFailed, "backup as hunter2", nil, errors.New("mysql -phunter2 failed"))
+	assert.Len(sink.events, 1)
+	assert.Equal("backup as "+redact.Mask, sink.events[0].Message)
+	assert.Equal("mysql -p"+redact.Mask+" failed", sink.events[0].Error)
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := require.New(t)
+	var received Event
+	var decodeErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// require must not be called off the test goroutine, the error is checked once Notify returned.
+		decodeErr = json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	n := &Notifier{Tool: "mysqlrestore", Routes: []Route{{Sink: &WebhookSink{URL: server.URL}}}}
+	n.Notify(context.Background(), Event{Type: RestoreSucceeded, Message: "restore of dev/mysql/cluster_one"})
+	assert.NoError(decodeErr)
+	assert.Equal(RestoreSucceeded, received.Type)
+	assert.Equal("mysqlrestore", received.Tool)
+	assert.NotEmpty(received.Host)
+
+	_, err := ParseEventTypes("backup_failed,restore_done")
+	assert.Error(err)
+}
+
+func TestEmailFlags(t *testing.T) {
+	assert := require.New(t)
+	fs := flag.NewFlagSet("mysqlbackup", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	assert.NoError(fs.Parse([]string{"-notify_email", " dba@example.com, ops@example.com,,"}))
+	n, err := flags.Notifier("mysqlbackup")
+	assert.NoError(err)
+	assert.Len(n.Routes, 1)
+	assert.Equal([]string{"dba@example.com", "ops@example.com"}, n.Routes[0].Sink.(*EmailSink).To)
+}
@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout bounds how long a single sink may take to deliver an event.
+const DefaultTimeout = 30 * time.Second
+
+var httpClient = &http.Client{Timeout: DefaultTimeout}
+
+// WebhookSink posts the event as JSON to URL.
+type WebhookSink struct {
+	URL string
+}
+
+func (w *WebhookSink) Name() string { return "webhook" }
+
+func (w *WebhookSink) Send(ctx context.Context, event Event) error {
+	return postJSON(ctx, w.URL, event)
+}
+
+// SlackSink posts the event as a message to a Slack compatible incoming webhook.
+type SlackSink struct {
+	URL string
+}
+
+func (s *SlackSink) Name() string { return "slack" }
+
+func (s *SlackSink) Send(ctx context.Context, event Event) error {
+	text := event.Text()
+	if event.Failed() {
+		text = ":rotating_light: " + text
+	}
+	return postJSON(ctx, s.URL, map[string]string{"text": text})
+}
+
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode notification")
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create notification request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to post notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("notification webhook returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// EmailSink mails the event through the SMTP server at Addr, authenticating when Username is set.
+type EmailSink struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (e *EmailSink) Name() string { return "email" }
+
+func (e *EmailSink) Send(ctx context.Context, event Event) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host := e.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", event.Subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(event.Text(), "\n", "\r\n", -1))
+
+	// net/smtp does not take a context, the send is abandoned rather than cancelled.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(e.Addr, auth, e.From, e.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return errors.Wrapf(err, "failed to mail notification through %s", e.Addr)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(DefaultTimeout):
+		return errors.Errorf("timed out mailing notification through %s", e.Addr)
+	}
+}
+
+// CommandSink runs a local command with the event as JSON on stdin.
+// NOTIFY_TYPE, NOTIFY_SUBJECT and NOTIFY_ERROR are set in its environment for simple shell hooks.
+type CommandSink struct {
+	Command []string
+}
+
+func (c *CommandSink) Name() string { return "command" }
+
+func (c *CommandSink) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode notification")
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"NOTIFY_TYPE="+event.Type,
+		"NOTIFY_SUBJECT="+event.Subject(),
+		"NOTIFY_ERROR="+event.Error,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "notification command %s failed, output: %s", strings.Join(c.Command, " "), out)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,175 @@
+// Package preflight checks that a host has the disk space and tools a backup or restore needs before it starts.
+package preflight
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Headroom is the fraction added on top of every estimate, estimates are rough and a filesystem
+// that is filled to the last byte breaks mysql as well as the backup.
+const Headroom = 0.1
+
+var (
+	// ErrInsufficientSpace is returned when a filesystem does not have room for the estimated size.
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+	// ErrMissingCommand is returned when a required command is not in the PATH.
+	ErrMissingCommand = errors.New("required command not found")
+)
+
+// Requirement is space needed below Path, described by Purpose in error messages.
+type Requirement struct {
+	Path    string
+	Bytes   int64
+	Purpose string
+}
+
+type filesystem struct {
+	path     string
+	free     int64
+	needed   int64
+	purposes []string
+}
+
+// CheckSpace verifies every filesystem holding a requirement's path has room for the sum of the
+// requirements placed on it, plus Headroom.  Paths that do not exist yet are checked on their
+// nearest existing parent.
+func CheckSpace(requirements ...Requirement) error {
+	filesystems := map[uint64]*filesystem{}
+	var order []uint64
+	for _, r := range requirements {
+		if r.Bytes <= 0 {
+			continue
+		}
+		path, err := existingParent(r.Path)
+		if err != nil {
+			return err
+		}
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			return errors.Wrapf(err, "failed to stat filesystem of %s", path)
+		}
+		dev, err := device(path)
+		if err != nil {
+			return err
+		}
+		fs, ok := filesystems[dev]
+		if !ok {
+			fs = &filesystem{path: path, free: int64(stat.Bavail) * int64(stat.Bsize)}
+			filesystems[dev] = fs
+			order = append(order, dev)
+		}
+		fs.needed += r.Bytes + int64(float64(r.Bytes)*Headroom)
+		fs.purposes = append(fs.purposes, fmt.Sprintf("%s %s", r.Purpose, FormatBytes(r.Bytes)))
+	}
+
+	var problems []string
+	for _, dev := range order {
+		fs := filesystems[dev]
+		if fs.needed > fs.free {
+			problems = append(problems, fmt.Sprintf("%s has %s free but needs %s (%s)",
+				fs.path, FormatBytes(fs.free), FormatBytes(fs.needed), strings.Join(fs.purposes, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Wrap(ErrInsufficientSpace, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// CheckCommands verifies every command is in the PATH.
+func CheckCommands(commands ...string) error {
+	var missing []string
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			missing = append(missing, command)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Wrap(ErrMissingCommand, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// SameFilesystem reports whether a and b, or their nearest existing parents, are on the same filesystem.
+func SameFilesystem(a, b string) (bool, error) {
+	var devices [2]uint64
+	for i, path := range []string{a, b} {
+		parent, err := existingParent(path)
+		if err != nil {
+			return false, err
+		}
+		if devices[i], err = device(parent); err != nil {
+			return false, err
+		}
+	}
+	return devices[0] == devices[1], nil
+}
+
+// DirSize is the apparent size of every regular file below dir.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, errors.Wrapf(err, "failed to size %s", dir)
+}
+
+// FormatBytes prints size with a binary unit, e.g. 1.5GiB.
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func existingParent(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %s", path)
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "failed to stat %s", path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+		path = parent
+	}
+}
+
+func device(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to stat %s", path)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.Errorf("cannot determine the filesystem of %s", path)
+	}
+	return uint64(stat.Dev), nil
+}
@@ -0,0 +1,47 @@
+package preflight
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSpace(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "preflight")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	missing := filepath.Join(dir, "not", "created", "yet")
+	assert.NoError(CheckSpace(Requirement{Path: missing, Bytes: 1024, Purpose: "backup"}))
+
+	err = CheckSpace(
+		Requirement{Path: dir, Bytes: 1 << 61, Purpose: "backup"},
+		Requirement{Path: missing, Bytes: 1 << 61, Purpose: "tar file"},
+	)
+	assert.Equal(ErrInsufficientSpace, errors.Cause(err))
+	assert.Contains(err.Error(), "backup 2.0EiB, tar file 2.0EiB")
+
+	same, err := SameFilesystem(dir, missing)
+	assert.NoError(err)
+	assert.True(same)
+}
+
+func TestDirSize(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "preflight")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "app"), 0700))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "ibdata1"), make([]byte, 1000), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "app", "users.ibd"), make([]byte, 24), 0600))
+	size, err := DirSize(dir)
+	assert.NoError(err)
+	assert.Equal(int64(1024), size)
+	assert.Equal("1.0KiB", FormatBytes(size))
+}
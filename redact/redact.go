@@ -0,0 +1,109 @@
+// Package redact keeps passwords and keys out of logged command lines and log messages.
+package redact
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mask replaces every redacted value.
+const Mask = "********"
+
+// sensitiveOptions are option name suffixes whose values are secrets, e.g. --password, --master-password or --encrypt-key.
+// The path of --encrypt-key-file is kept out of the logs as well.
+var sensitiveOptions = []string{"password", "passwd", "secret", "encrypt-key", "encrypt-key-file", "token"}
+
+var (
+	mu      sync.RWMutex
+	secrets = map[string]bool{}
+)
+
+// AddSecret registers a value that is masked wherever it shows up in a log message or a command line.
+// Empty values are ignored.
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	secrets[secret] = true
+}
+
+// String masks every registered secret in s.
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for secret := range secrets {
+		s = strings.Replace(s, secret, Mask, -1)
+	}
+	return s
+}
+
+// Command joins cmdLine for logging with the values of password like options and registered secrets masked.
+// Both --password=secret and --password secret are masked, as is mysql's -psecret.
+func Command(cmdLine []string) string {
+	redacted := make([]string, len(cmdLine))
+	maskNext := false
+	for i, arg := range cmdLine {
+		switch {
+		case maskNext:
+			redacted[i] = Mask
+			maskNext = false
+		case strings.HasPrefix(arg, "-p") && !strings.HasPrefix(arg, "--") && len(arg) > 2:
+			redacted[i] = "-p" + Mask
+		case strings.HasPrefix(arg, "-"):
+			name, _, hasValue := cut(arg, "=")
+			if !sensitive(name) {
+				redacted[i] = arg
+			} else if hasValue {
+				redacted[i] = name + "=" + Mask
+			} else {
+				redacted[i] = arg
+				maskNext = i+1 < len(cmdLine) && !strings.HasPrefix(cmdLine[i+1], "-")
+			}
+		default:
+			redacted[i] = arg
+		}
+	}
+	return String(strings.Join(redacted, " "))
+}
+
+func sensitive(option string) bool {
+	option = strings.ToLower(strings.TrimLeft(option, "-"))
+	option = strings.Replace(option, "_", "-", -1)
+	for _, suffix := range sensitiveOptions {
+		if strings.HasSuffix(option, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// Hook is a logrus hook that masks registered secrets in every message and string field.
+type Hook struct{}
+
+func (Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (Hook) Fire(entry *log.Entry) error {
+	entry.Message = String(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = String(v)
+		case error:
+			entry.Data[key] = String(v.Error())
+		}
+	}
+	return nil
+}
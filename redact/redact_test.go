@@ -0,0 +1,31 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommand(t *testing.T) {
+	assert := require.New(t)
+	AddSecret("hunter2")
+
+	cmdLine := []string{"innobackupex", "--user=root", "--password=s3cret", "--encrypt-key", "abc", "-pother", "--incremental-basedir=/opt/full", "/tmp/hunter2"}
+	assert.Equal("innobackupex --user=root --password=******** --encrypt-key ******** -p******** --incremental-basedir=/opt/full /tmp/********", Command(cmdLine))
+	assert.Equal("innobackupex --encrypt-key-file=********", Command([]string{"innobackupex", "--encrypt-key-file=/etc/key"}))
+}
+
+func TestHook(t *testing.T) {
+	assert := require.New(t)
+	AddSecret("correct horse")
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.AddHook(Hook{})
+	logger.WithField("dsn", "root:correct horse@unix(/tmp/mysql.sock)/").Errorf("login with correct horse failed")
+	assert.NotContains(out.String(), "correct horse")
+	assert.Contains(out.String(), Mask)
+}
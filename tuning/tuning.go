@@ -0,0 +1,204 @@
+// Package tuning holds the innobackupex performance options shared by mysqlbackup and mysqlrestore.
+package tuning
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ProfileDefault = "default"
+	ProfileAuto    = "auto"
+)
+
+// MaxAutoThreads caps the threads the auto profile uses, more rarely helps innobackupex.
+const MaxAutoThreads = 16
+
+// Params are the innobackupex performance options and the scheduling priority of the child process.
+type Params struct {
+	// Parallel is --parallel, the number of files copied or prepared at the same time.
+	Parallel int
+	// CompressThreads is --compress-threads, only used by backups.
+	CompressThreads int
+	// UseMemory is --use-memory, e.g. 2G, mostly used by prepare.
+	UseMemory string
+	// Throttle is --throttle, the IO operations per second of a backup, 0 does not limit IO.
+	Throttle int
+	// Nice runs innobackupex with nice -n Nice when it is not 0.
+	Nice int
+	// IOClass and IOLevel run innobackupex with ionice -c IOClass -n IOLevel when IOClass is not 0,
+	// 1 is realtime, 2 best-effort and 3 idle.
+	IOClass int
+	IOLevel int
+}
+
+// Default are the options mysqlbackup always used.
+func Default() Params {
+	return Params{Parallel: 8, CompressThreads: 8, UseMemory: "2G"}
+}
+
+// RestoreDefault are the options mysqlrestore always prepared with, one thread per CPU.
+func RestoreDefault() Params {
+	return Params{Parallel: runtime.NumCPU(), CompressThreads: 8, UseMemory: "2G"}
+}
+
+// Auto sizes the threads from the CPUs and --use-memory to memoryShare of the host's memory.
+// Backups share the host with mysqld and should pass a small share, restores can use most of it.
+func Auto(memoryShare float64) (Params, error) {
+	threads := runtime.NumCPU()
+	if threads > MaxAutoThreads {
+		threads = MaxAutoThreads
+	}
+	total, err := memTotal()
+	if err != nil {
+		return Params{}, err
+	}
+	memoryMB := int64(float64(total)*memoryShare) >> 20
+	if memoryMB < 128 {
+		memoryMB = 128
+	}
+	return Params{Parallel: threads, CompressThreads: threads, UseMemory: fmt.Sprintf("%dM", memoryMB)}, nil
+}
+
+// memTotal reads the host's memory in bytes from /proc/meminfo.
+func memTotal() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read the host's memory")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid MemTotal %s", fields[1])
+			}
+			return kb << 10, nil
+		}
+	}
+	return 0, errors.New("MemTotal not found in /proc/meminfo")
+}
+
+// BackupArgs are the innobackupex options of a backup.
+func (p Params) BackupArgs() []string {
+	args := []string{
+		fmt.Sprintf("--compress-threads=%d", p.CompressThreads),
+		fmt.Sprintf("--parallel=%d", p.Parallel),
+		"--use-memory=" + p.UseMemory,
+	}
+	if p.Throttle > 0 {
+		args = append(args, fmt.Sprintf("--throttle=%d", p.Throttle))
+	}
+	return args
+}
+
+// PrepareArgs are the innobackupex options of an --apply-log.
+func (p Params) PrepareArgs() []string {
+	return []string{fmt.Sprintf("--parallel=%d", p.Parallel), "--use-memory=" + p.UseMemory}
+}
+
+// Wrap prefixes cmdLine with nice and ionice when a priority is set.
+func (p Params) Wrap(cmdLine []string) []string {
+	var prefix []string
+	if p.IOClass != 0 {
+		prefix = append(prefix, "ionice", "-c", strconv.Itoa(p.IOClass))
+		if p.IOClass != 3 {
+			prefix = append(prefix, "-n", strconv.Itoa(p.IOLevel))
+		}
+	}
+	if p.Nice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(p.Nice))
+	}
+	return append(prefix, cmdLine...)
+}
+
+// Validate checks the options are in the ranges innobackupex, nice and ionice accept.
+func (p Params) Validate() error {
+	switch {
+	case p.Parallel < 1:
+		return errors.Errorf("invalid parallel %d, it must be at least 1", p.Parallel)
+	case p.CompressThreads < 1:
+		return errors.Errorf("invalid compress_threads %d, it must be at least 1", p.CompressThreads)
+	case p.UseMemory == "":
+		return errors.New("use_memory must not be empty")
+	case p.Throttle < 0:
+		return errors.Errorf("invalid throttle %d, it must not be negative", p.Throttle)
+	case p.Nice < -20 || p.Nice > 19:
+		return errors.Errorf("invalid nice %d, it must be between -20 and 19", p.Nice)
+	case p.IOClass < 0 || p.IOClass > 3:
+		return errors.Errorf("invalid ionice_class %d, use 1 for realtime, 2 for best-effort or 3 for idle", p.IOClass)
+	case p.IOLevel < 0 || p.IOLevel > 7:
+		return errors.Errorf("invalid ionice_level %d, it must be between 0 and 7", p.IOLevel)
+	}
+	return nil
+}
+
+// Flags are the command line flags that configure Params.
+type Flags struct {
+	fs                                  *flag.FlagSet
+	defaults                            Params
+	profile                             *string
+	parallel, compressThreads, throttle *int
+	nice, ioClass, ioLevel              *int
+	useMemory                           *string
+}
+
+// RegisterFlags adds the tuning flags to fs, call it before fs is parsed.
+// defaults are the options of the default profile, Default for backups and RestoreDefault for restores.
+func RegisterFlags(fs *flag.FlagSet, defaults Params) *Flags {
+	return &Flags{
+		fs:              fs,
+		defaults:        defaults,
+		profile:         fs.String("xtrabackup_profile", ProfileDefault, "innobackupex tuning profile: default, or auto to size threads and memory from the host, the flags below override it"),
+		parallel:        fs.Int("parallel", defaults.Parallel, "innobackupex --parallel"),
+		compressThreads: fs.Int("compress_threads", defaults.CompressThreads, "innobackupex --compress-threads of backups"),
+		useMemory:       fs.String("use_memory", defaults.UseMemory, "innobackupex --use-memory, e.g. 2G"),
+		throttle:        fs.Int("throttle", 0, "innobackupex --throttle IO operations per second of backups(default: unlimited)"),
+		nice:            fs.Int("nice", 0, "run innobackupex with this nice level"),
+		ioClass:         fs.Int("ionice_class", 0, "run innobackupex with this ionice class: 1 realtime, 2 best-effort, 3 idle"),
+		ioLevel:         fs.Int("ionice_level", 4, "ionice priority 0-7 of the realtime and best-effort classes"),
+	}
+}
+
+// Params resolves the profile and applies the flags that were set on top of it.
+// memoryShare is the share of the host's memory the auto profile uses.
+func (f *Flags) Params(memoryShare float64) (Params, error) {
+	var params Params
+	switch *f.profile {
+	case ProfileDefault:
+		params = f.defaults
+	case ProfileAuto:
+		auto, err := Auto(memoryShare)
+		if err != nil {
+			return Params{}, err
+		}
+		params = auto
+	default:
+		return Params{}, errors.Errorf("invalid xtrabackup_profile %s.  Try default or auto", *f.profile)
+	}
+
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "parallel":
+			params.Parallel = *f.parallel
+		case "compress_threads":
+			params.CompressThreads = *f.compressThreads
+		case "use_memory":
+			params.UseMemory = *f.useMemory
+		}
+	})
+	params.Throttle = *f.throttle
+	params.Nice = *f.nice
+	params.IOClass = *f.ioClass
+	params.IOLevel = *f.ioLevel
+	return params, params.Validate()
+}
@@ -0,0 +1,46 @@
+package tuning
+
+import (
+	"flag"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	assert := require.New(t)
+	cmdLine := []string{"innobackupex", "/backup"}
+
+	assert.Equal(cmdLine, Default().Wrap(cmdLine))
+	assert.Equal([]string{"ionice", "-c", "2", "-n", "7", "nice", "-n", "10", "innobackupex", "/backup"},
+		Params{Nice: 10, IOClass: 2, IOLevel: 7}.Wrap(cmdLine))
+	assert.Equal([]string{"ionice", "-c", "3", "innobackupex", "/backup"}, Params{IOClass: 3, IOLevel: 4}.Wrap(cmdLine))
+}
+
+func TestFlagsParams(t *testing.T) {
+	assert := require.New(t)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs, Default())
+	assert.NoError(fs.Parse([]string{"-xtrabackup_profile", "auto", "-use_memory", "1G", "-throttle", "100"}))
+
+	params, err := flags.Params(0.5)
+	assert.NoError(err)
+	assert.Equal("1G", params.UseMemory)
+	assert.True(params.Parallel >= 1 && params.Parallel <= MaxAutoThreads)
+	assert.Contains(params.BackupArgs(), "--throttle=100")
+	assert.Equal([]string{"--parallel=2", "--use-memory=1G"}, Params{Parallel: 2, UseMemory: "1G"}.PrepareArgs())
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags = RegisterFlags(fs, Default())
+	assert.NoError(fs.Parse([]string{"-xtrabackup_profile", "fast"}))
+	_, err = flags.Params(0.5)
+	assert.Error(err)
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags = RegisterFlags(fs, RestoreDefault())
+	assert.NoError(fs.Parse(nil))
+	params, err = flags.Params(0.5)
+	assert.NoError(err)
+	assert.Equal(runtime.NumCPU(), params.Parallel)
+}